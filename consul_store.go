@@ -0,0 +1,709 @@
+package couchbasearray
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// consulMinimumTTL is the shortest session TTL accepted by Consul
+const consulMinimumTTL = 10
+
+// ConsulStore is a Store backed by the Consul KV API.
+// Keys written with a TTL are acquired by a Consul session with the delete behavior,
+// so they are removed when the session owning them stops being renewed. Close stops
+// renewing the sessions and destroys them, deleting their keys.
+type ConsulStore struct {
+	address string
+	token   string
+	client  *http.Client
+
+	mutex    sync.Mutex
+	sessions map[uint64]string
+	closed   chan struct{}
+	// snapshots is the keys each watched prefix last held, to detect keys deleted
+	// between watches
+	snapshots map[string]map[string]consulKV
+}
+
+// NewConsulStore creates a Store talking to the Consul agent at address
+func NewConsulStore(address string, token string, client *http.Client) *ConsulStore {
+	if client == nil {
+		client = &http.Client{}
+	}
+
+	return &ConsulStore{
+		address:   strings.TrimRight(address, "/"),
+		token:     token,
+		client:    client,
+		sessions:  make(map[uint64]string),
+		closed:    make(chan struct{}),
+		snapshots: make(map[string]map[string]consulKV),
+	}
+}
+
+type consulKV struct {
+	Key         string `json:"Key"`
+	Value       []byte `json:"Value"`
+	ModifyIndex uint64 `json:"ModifyIndex"`
+	Session     string `json:"Session"`
+}
+
+// Get returns a single key
+func (s *ConsulStore) Get(key string) (StoreNode, error) {
+	kv, err := s.get(storeKey(key))
+	if err != nil {
+		return StoreNode{}, err
+	}
+
+	return consulStoreNode(kv), nil
+}
+
+// GetDir returns the keys directly beneath dir
+func (s *ConsulStore) GetDir(dir string) ([]StoreNode, error) {
+	prefix := storeKey(dir) + "/"
+	kvs, _, err := s.list(context.Background(), prefix, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(kvs) == 0 {
+		return nil, ErrKeyNotFound
+	}
+
+	var nodes []StoreNode
+	for _, kv := range kvs {
+		node := consulStoreNode(kv)
+		if strings.Contains(node.Key[len(prefix):], "/") {
+			continue
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	return nodes, nil
+}
+
+// Set writes a key, binding it to the session for ttl unless ttl is zero
+func (s *ConsulStore) Set(key string, value string, ttl uint64) (StoreNode, error) {
+	key = storeKey(key)
+	if ttl == 0 {
+		if _, err := s.put(key, value, nil); err != nil {
+			return StoreNode{}, err
+		}
+
+		return s.Get(key)
+	}
+
+	acquired, err := s.acquire(key, value, ttl)
+	if err != nil {
+		return StoreNode{}, err
+	}
+
+	if !acquired {
+		// the key is held by another session, take it over
+		if err = s.Delete(key, false); err != nil && err != ErrKeyNotFound {
+			return StoreNode{}, err
+		}
+
+		if acquired, err = s.acquire(key, value, ttl); err != nil {
+			return StoreNode{}, err
+		}
+
+		if !acquired {
+			return StoreNode{}, ErrLockInUse
+		}
+	}
+
+	return s.Get(key)
+}
+
+// Create writes a key only if it does not already exist
+func (s *ConsulStore) Create(key string, value string, ttl uint64) (StoreNode, error) {
+	key = storeKey(key)
+	ok, err := s.put(key, value, url.Values{"cas": {"0"}})
+	if err != nil {
+		return StoreNode{}, err
+	}
+
+	if !ok {
+		return StoreNode{}, ErrNodeExist
+	}
+
+	if ttl > 0 {
+		acquired, err := s.acquire(key, value, ttl)
+		if err != nil {
+			return StoreNode{}, err
+		}
+
+		if !acquired {
+			return StoreNode{}, ErrLockInUse
+		}
+	}
+
+	return s.Get(key)
+}
+
+// CompareAndSwap writes a key only if its current value or modify index matches
+func (s *ConsulStore) CompareAndSwap(key string, value string, ttl uint64, prevValue string, prevIndex uint64) (StoreNode, error) {
+	key = storeKey(key)
+	index, err := s.compare(key, prevValue, prevIndex)
+	if err != nil {
+		return StoreNode{}, err
+	}
+
+	ok, err := s.put(key, value, url.Values{"cas": {strconv.FormatUint(index, 10)}})
+	if err != nil {
+		return StoreNode{}, err
+	}
+
+	if !ok {
+		return StoreNode{}, ErrCompareFailed
+	}
+
+	if ttl > 0 {
+		acquired, err := s.acquire(key, value, ttl)
+		if err != nil {
+			return StoreNode{}, err
+		}
+
+		if !acquired {
+			return StoreNode{}, ErrLockInUse
+		}
+	}
+
+	return s.Get(key)
+}
+
+// FencedCompareAndSwap writes a key in a transaction which checks fenceKey has not been
+// modified since it was read holding fenceValue, see FencedStore
+func (s *ConsulStore) FencedCompareAndSwap(fenceKey string, fenceValue string, key string, value string, ttl uint64, prevIndex uint64) (StoreNode, error) {
+	key = storeKey(key)
+	fence, err := s.get(storeKey(fenceKey))
+	if err == ErrKeyNotFound || (err == nil && string(fence.Value) != fenceValue) {
+		return StoreNode{}, ErrStaleToken
+	}
+
+	if err != nil {
+		return StoreNode{}, err
+	}
+
+	ops := []consulTxnOp{
+		{KV: consulTxnKV{Verb: "check-index", Key: strings.TrimPrefix(fence.Key, "/"), Index: fence.ModifyIndex}},
+		{KV: consulTxnKV{Verb: "cas", Key: strings.TrimPrefix(key, "/"), Value: []byte(value), Index: prevIndex}},
+	}
+
+	if ttl > 0 {
+		session, err := s.session(ttl)
+		if err != nil {
+			return StoreNode{}, err
+		}
+
+		ops = append(ops, consulTxnOp{KV: consulTxnKV{Verb: "lock", Key: strings.TrimPrefix(key, "/"), Value: []byte(value), Session: session}})
+	}
+
+	failed, err := s.txn(ops)
+	if err != nil {
+		return StoreNode{}, err
+	}
+
+	switch {
+	case failed < 0:
+		return s.Get(key)
+	case failed == 0:
+		return StoreNode{}, ErrStaleToken
+	case prevIndex == 0:
+		return StoreNode{}, ErrNodeExist
+	}
+
+	if _, err = s.get(key); err != nil {
+		return StoreNode{}, err
+	}
+
+	return StoreNode{}, ErrCompareFailed
+}
+
+// CompareAndDelete removes a key only if its current value or modify index matches
+func (s *ConsulStore) CompareAndDelete(key string, prevValue string, prevIndex uint64) error {
+	key = storeKey(key)
+	index, err := s.compare(key, prevValue, prevIndex)
+	if err != nil {
+		return err
+	}
+
+	var ok bool
+	if err = s.do("DELETE", "/v1/kv"+key, url.Values{"cas": {strconv.FormatUint(index, 10)}}, nil, &ok); err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrCompareFailed
+	}
+
+	return nil
+}
+
+// Delete removes a key, or every key beneath it when recursive is set
+func (s *ConsulStore) Delete(key string, recursive bool) error {
+	key = storeKey(key)
+	_, err := s.get(key)
+	if err != nil && (err != ErrKeyNotFound || !recursive) {
+		return err
+	}
+
+	found := err == nil
+	if found {
+		if err = s.do("DELETE", "/v1/kv"+key, nil, nil, nil); err != nil {
+			return err
+		}
+	}
+
+	if !recursive {
+		return nil
+	}
+
+	// Consul recurses over every key sharing the prefix, so /a/states would take
+	// /a/states-old with it without the trailing slash
+	prefix := key + "/"
+	kvs, _, err := s.list(context.Background(), prefix, 0)
+	if err != nil {
+		return err
+	}
+
+	if len(kvs) == 0 {
+		if found {
+			return nil
+		}
+		return ErrKeyNotFound
+	}
+
+	return s.do("DELETE", "/v1/kv"+prefix, url.Values{"recurse": {""}}, nil, nil)
+}
+
+// Watch blocks until a key beneath prefix changes at or after waitIndex or stop is signalled.
+// It uses Consul blocking queries and diffs successive results to find the changed key,
+// starting from the keys the last watch of prefix saw so deletes between watches are found.
+func (s *ConsulStore) Watch(prefix string, waitIndex uint64, stop chan bool) (StoreEvent, error) {
+	prefix = storeKey(prefix)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	s.mutex.Lock()
+	previous := s.snapshots[prefix]
+	s.mutex.Unlock()
+
+	var index uint64
+	for {
+		kvs, next, err := s.list(ctx, prefix, index)
+		if err != nil {
+			if ctx.Err() != nil {
+				return StoreEvent{}, ErrWatchStopped
+			}
+			return StoreEvent{}, err
+		}
+
+		if waitIndex == 0 {
+			waitIndex = next + 1
+		}
+
+		snapshot := make(map[string]consulKV)
+		for _, kv := range kvs {
+			node := consulStoreNode(kv)
+			if node.Key != prefix && !strings.HasPrefix(node.Key, prefix+"/") {
+				continue
+			}
+
+			snapshot[node.Key] = kv
+		}
+
+		for key, kv := range previous {
+			if _, ok := snapshot[key]; !ok {
+				// the other deletes are reported by the next watch
+				remaining := make(map[string]consulKV, len(previous))
+				for other, otherKV := range previous {
+					if other != key {
+						remaining[other] = otherKV
+					}
+				}
+				s.saveSnapshot(prefix, remaining)
+				node := consulStoreNode(kv)
+				node.ModifiedIndex = next
+				return StoreEvent{Action: StoreActionDelete, Node: node}, nil
+			}
+		}
+
+		s.saveSnapshot(prefix, snapshot)
+		// report the earliest change so the next watch from its index misses none
+		var changed consulKV
+		found := false
+		for _, kv := range snapshot {
+			if kv.ModifyIndex >= waitIndex && (!found || kv.ModifyIndex < changed.ModifyIndex) {
+				changed, found = kv, true
+			}
+		}
+
+		if found {
+			return StoreEvent{Action: StoreActionSet, Node: consulStoreNode(changed)}, nil
+		}
+
+		previous = snapshot
+		index = next
+	}
+}
+
+// saveSnapshot records the keys prefix holds for the next watch of prefix
+func (s *ConsulStore) saveSnapshot(prefix string, snapshot map[string]consulKV) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.snapshots[prefix] = snapshot
+}
+
+// AcquireLock acquires namespace with the Consul session for durationInSeconds,
+// returning the modify index of the lock key
+func (s *ConsulStore) AcquireLock(identifier string, namespace string, durationInSeconds uint64) (uint64, error) {
+	key := storeKey(namespace)
+	acquired, err := s.acquire(key, identifier, durationInSeconds)
+	if err != nil {
+		return 0, err
+	}
+
+	if !acquired {
+		return 0, ErrLockInUse
+	}
+
+	kv, err := s.get(key)
+	if err != nil {
+		return 0, err
+	}
+
+	return kv.ModifyIndex, nil
+}
+
+// ReleaseLock releases namespace if it is held by identifier
+func (s *ConsulStore) ReleaseLock(identifier string, namespace string) error {
+	key := storeKey(namespace)
+	kv, err := s.get(key)
+	if err != nil {
+		return err
+	}
+
+	if string(kv.Value) != identifier || kv.Session == "" {
+		return ErrLockInUse
+	}
+
+	var ok bool
+	return s.do("PUT", "/v1/kv"+key, url.Values{"release": {kv.Session}}, kv.Value, &ok)
+}
+
+func (s *ConsulStore) compare(key string, prevValue string, prevIndex uint64) (uint64, error) {
+	if prevValue == "" && prevIndex == 0 {
+		return 0, fmt.Errorf("prevValue or prevIndex is required")
+	}
+
+	kv, err := s.get(key)
+	if err != nil {
+		return 0, err
+	}
+
+	if prevValue != "" && string(kv.Value) != prevValue {
+		return 0, ErrCompareFailed
+	}
+
+	if prevIndex != 0 && kv.ModifyIndex != prevIndex {
+		return 0, ErrCompareFailed
+	}
+
+	return kv.ModifyIndex, nil
+}
+
+func (s *ConsulStore) get(key string) (consulKV, error) {
+	var kvs []consulKV
+	if err := s.do("GET", "/v1/kv"+key, nil, nil, &kvs); err != nil {
+		return consulKV{}, err
+	}
+
+	if len(kvs) == 0 {
+		return consulKV{}, ErrKeyNotFound
+	}
+
+	return kvs[0], nil
+}
+
+func (s *ConsulStore) list(ctx context.Context, prefix string, index uint64) ([]consulKV, uint64, error) {
+	query := url.Values{"recurse": {""}}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", "5m")
+	}
+
+	req, err := s.request("GET", "/v1/kv"+prefix, query, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, next, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul %s: %s %s", prefix, resp.Status, string(body))
+	}
+
+	var kvs []consulKV
+	if err = json.Unmarshal(body, &kvs); err != nil {
+		return nil, 0, err
+	}
+
+	return kvs, next, nil
+}
+
+type consulTxnKV struct {
+	Verb    string `json:"Verb"`
+	Key     string `json:"Key"`
+	Value   []byte `json:"Value,omitempty"`
+	Index   uint64 `json:"Index,omitempty"`
+	Session string `json:"Session,omitempty"`
+}
+
+type consulTxnOp struct {
+	KV consulTxnKV `json:"KV"`
+}
+
+// txn applies ops atomically, returning the index of the first operation which failed
+// or -1 when the transaction was committed
+func (s *ConsulStore) txn(ops []consulTxnOp) (int, error) {
+	payload, err := json.Marshal(ops)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := s.request("PUT", "/v1/txn", nil, payload)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return -1, nil
+	case http.StatusConflict:
+		var response struct {
+			Errors []struct {
+				OpIndex int    `json:"OpIndex"`
+				What    string `json:"What"`
+			} `json:"Errors"`
+		}
+
+		if err = json.Unmarshal(data, &response); err != nil {
+			return 0, err
+		}
+
+		if len(response.Errors) == 0 {
+			return 0, fmt.Errorf("consul txn: %s", string(data))
+		}
+
+		return response.Errors[0].OpIndex, nil
+	}
+
+	return 0, fmt.Errorf("consul txn: %s %s", resp.Status, string(data))
+}
+
+func (s *ConsulStore) put(key string, value string, query url.Values) (bool, error) {
+	var ok bool
+	if err := s.do("PUT", "/v1/kv"+key, query, []byte(value), &ok); err != nil {
+		return false, err
+	}
+
+	return ok, nil
+}
+
+func (s *ConsulStore) acquire(key string, value string, ttl uint64) (bool, error) {
+	session, err := s.session(ttl)
+	if err != nil {
+		return false, err
+	}
+
+	return s.put(key, value, url.Values{"acquire": {session}})
+}
+
+// Close stops renewing the sessions and destroys them, deleting every key written with
+// a TTL and releasing the locks held. Keys written with a TTL after Close fail.
+func (s *ConsulStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	select {
+	case <-s.closed:
+		return nil
+	default:
+		close(s.closed)
+	}
+
+	var lastErr error
+	for ttl, id := range s.sessions {
+		if err := s.do("PUT", "/v1/session/destroy/"+id, nil, nil, nil); err != nil {
+			lastErr = err
+		}
+		delete(s.sessions, ttl)
+	}
+
+	return lastErr
+}
+
+// session returns the Consul session for ttl, creating it and starting its renewal on first use
+func (s *ConsulStore) session(ttl uint64) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	select {
+	case <-s.closed:
+		return "", ErrStoreClosed
+	default:
+	}
+
+	if id, ok := s.sessions[ttl]; ok {
+		return id, nil
+	}
+
+	sessionTTL := ttl
+	if sessionTTL < consulMinimumTTL {
+		sessionTTL = consulMinimumTTL
+	}
+
+	request := map[string]string{
+		"Name":      "couchbase-array",
+		"TTL":       fmt.Sprintf("%ds", sessionTTL),
+		"Behavior":  "delete",
+		"LockDelay": "0s",
+	}
+
+	var response struct {
+		ID string `json:"ID"`
+	}
+
+	payload, _ := json.Marshal(request)
+	if err := s.do("PUT", "/v1/session/create", nil, payload, &response); err != nil {
+		return "", err
+	}
+
+	s.sessions[ttl] = response.ID
+	go s.renew(ttl, response.ID, sessionTTL)
+	return response.ID, nil
+}
+
+func (s *ConsulStore) renew(ttl uint64, id string, sessionTTL uint64) {
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-time.After(time.Duration(sessionTTL) * time.Second / 2):
+		}
+
+		err := s.do("PUT", "/v1/session/renew/"+id, nil, nil, nil)
+		if err == ErrKeyNotFound {
+			log.Printf("consul session %s expired", id)
+			s.mutex.Lock()
+			if s.sessions[ttl] == id {
+				delete(s.sessions, ttl)
+			}
+			s.mutex.Unlock()
+			return
+		}
+
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (s *ConsulStore) request(method string, path string, query url.Values, body []byte) (*http.Request, error) {
+	endpoint := s.address + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if s.token != "" {
+		req.Header.Set("X-Consul-Token", s.token)
+	}
+
+	return req, nil
+}
+
+func (s *ConsulStore) do(method string, path string, query url.Values, body []byte, response interface{}) error {
+	req, err := s.request(method, path, query, body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrKeyNotFound
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul %s %s: %s %s", method, path, resp.Status, string(data))
+	}
+
+	if response == nil {
+		return nil
+	}
+
+	return json.Unmarshal(data, response)
+}
+
+func consulStoreNode(kv consulKV) StoreNode {
+	return StoreNode{Key: storeKey(kv.Key), Value: string(kv.Value), ModifiedIndex: kv.ModifyIndex}
+}
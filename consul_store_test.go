@@ -0,0 +1,325 @@
+package couchbasearray
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul serves the Consul KV, session and transaction endpoints. Blocking queries
+// are answered straight away. Another session takes the contended key as soon as it is
+// deleted.
+type fakeConsul struct {
+	mutex     sync.Mutex
+	index     uint64
+	kvs       map[string]consulKV
+	sessions  int
+	contended string
+}
+
+func newFakeConsul() *httptest.Server {
+	return httptest.NewServer(&fakeConsul{kvs: make(map[string]consulKV)})
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	query := r.URL.Query()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	switch {
+	case r.URL.Path == "/v1/session/create":
+		f.sessions++
+		json.NewEncoder(w).Encode(map[string]string{"ID": "session-" + strconv.Itoa(f.sessions)})
+	case strings.HasPrefix(r.URL.Path, "/v1/session/renew/"):
+		w.Write([]byte("[]"))
+	case strings.HasPrefix(r.URL.Path, "/v1/session/destroy/"):
+		session := strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/")
+		for key, kv := range f.kvs {
+			if kv.Session == session {
+				delete(f.kvs, key)
+			}
+		}
+
+		f.index++
+		json.NewEncoder(w).Encode(true)
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		switch r.Method {
+		case "GET":
+			var kvs []consulKV
+			for k, kv := range f.kvs {
+				_, recurse := query["recurse"]
+				if k == key || (recurse && strings.HasPrefix(k, key)) {
+					kvs = append(kvs, kv)
+				}
+			}
+
+			if len(kvs) == 0 {
+				http.NotFound(w, r)
+				return
+			}
+
+			json.NewEncoder(w).Encode(kvs)
+		case "PUT":
+			body, _ := ioutil.ReadAll(r.Body)
+			kv, exists := f.kvs[key]
+			ok := true
+			if cas, found := query["cas"]; found {
+				index, _ := strconv.ParseUint(cas[0], 10, 64)
+				ok = (index == 0 && !exists) || (exists && kv.ModifyIndex == index)
+			}
+
+			if session := query.Get("acquire"); session != "" {
+				ok = kv.Session == "" || kv.Session == session
+				if ok {
+					kv.Session = session
+				}
+			}
+
+			if session := query.Get("release"); session != "" {
+				ok = kv.Session == session
+				if ok {
+					kv.Session = ""
+				}
+			}
+
+			if ok {
+				f.index++
+				kv.Key = key
+				kv.Value = body
+				kv.ModifyIndex = f.index
+				f.kvs[key] = kv
+			}
+
+			json.NewEncoder(w).Encode(ok)
+		case "DELETE":
+			for k := range f.kvs {
+				if _, recurse := query["recurse"]; k == key || (recurse && strings.HasPrefix(k, key)) {
+					delete(f.kvs, k)
+				}
+			}
+
+			if key == f.contended {
+				f.kvs[key] = consulKV{Key: key, Session: "other"}
+			}
+
+			f.index++
+			json.NewEncoder(w).Encode(true)
+		}
+	case r.URL.Path == "/v1/txn":
+		var ops []consulTxnOp
+		json.NewDecoder(r.Body).Decode(&ops)
+		for i, op := range ops {
+			kv, exists := f.kvs[op.KV.Key]
+			ok := true
+			switch op.KV.Verb {
+			case "check-index":
+				ok = exists && kv.ModifyIndex == op.KV.Index
+			case "cas":
+				ok = (op.KV.Index == 0 && !exists) || (exists && kv.ModifyIndex == op.KV.Index)
+			case "lock":
+				ok = kv.Session == "" || kv.Session == op.KV.Session
+			}
+
+			if !ok {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(map[string]interface{}{"Errors": []map[string]interface{}{{"OpIndex": i, "What": "failed"}}})
+				return
+			}
+		}
+
+		f.index++
+		for _, op := range ops {
+			if op.KV.Verb == "check-index" {
+				continue
+			}
+
+			kv := f.kvs[op.KV.Key]
+			kv.Key = op.KV.Key
+			kv.Value = op.KV.Value
+			kv.ModifyIndex = f.index
+			if op.KV.Session != "" {
+				kv.Session = op.KV.Session
+			}
+			f.kvs[op.KV.Key] = kv
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"Errors": nil})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestConsulStoreLock(t *testing.T) {
+	server := newFakeConsul()
+	defer server.Close()
+
+	first := NewConsulStore(server.URL, "", nil)
+	second := NewConsulStore(server.URL, "", nil)
+	if _, err := first.AcquireLock("first", "/base/master", 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := first.AcquireLock("first", "/base/master", 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := second.AcquireLock("second", "/base/master", 5); err != ErrLockInUse {
+		t.Fatalf("Expected ErrLockInUse got %v", err)
+	}
+
+	if err := second.ReleaseLock("second", "/base/master"); err != ErrLockInUse {
+		t.Fatalf("Expected ErrLockInUse got %v", err)
+	}
+
+	if err := first.ReleaseLock("first", "/base/master"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := second.AcquireLock("second", "/base/master", 5); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsulStoreDirectories(t *testing.T) {
+	server := newFakeConsul()
+	defer server.Close()
+
+	s := NewConsulStore(server.URL, "", nil)
+	s.Set("/base/states/a", "1", 30)
+	s.Set("/base/states/b", "2", 30)
+	s.Set("/base/states/nested/c", "3", 0)
+
+	nodes, err := s.GetDir("/base/states/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(nodes) != 2 {
+		t.Fatalf("Expected 2 nodes got %v", nodes)
+	}
+
+	node, err := s.Get("/base/states/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.CompareAndSwap("/base/states/a", "3", 30, "", node.ModifiedIndex+100); err != ErrCompareFailed {
+		t.Fatalf("Expected ErrCompareFailed got %v", err)
+	}
+
+	if err = s.Delete("/base/states", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.GetDir("/base/states/"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound got %v", err)
+	}
+
+	s.Set("/base/states/a", "1", 0)
+	s.Set("/base/states-old/a", "1", 0)
+	if err = s.Delete("/base/states", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.Get("/base/states-old/a"); err != nil {
+		t.Fatalf("Expected a sibling sharing the prefix to be kept got %v", err)
+	}
+
+	if err = s.Delete("/base/states", true); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound got %v", err)
+	}
+}
+
+func TestConsulStoreWatch(t *testing.T) {
+	server := newFakeConsul()
+	defer server.Close()
+
+	s := NewConsulStore(server.URL, "", nil)
+	s.Set("/base/announcements/a", "1", 0)
+	s.Set("/base/announcements/b", "2", 0)
+
+	watch := func(waitIndex uint64) (StoreEvent, error) {
+		stop := make(chan bool)
+		timer := time.AfterFunc(2*time.Second, func() { close(stop) })
+		defer timer.Stop()
+		return s.Watch("/base/announcements/", waitIndex, stop)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.Set("/base/announcements/b", "3", 0)
+	}()
+
+	event, err := watch(0)
+	if err != nil || event.Action != StoreActionSet || event.Node.Key != "/base/announcements/b" {
+		t.Fatalf("Expected b to be set got %v %v", event, err)
+	}
+
+	// deleted while nothing was watching
+	if err = s.Delete("/base/announcements/a", false); err != nil {
+		t.Fatal(err)
+	}
+
+	event, err = watch(event.Node.ModifiedIndex + 1)
+	if err != nil || event.Action != StoreActionDelete || event.Node.Key != "/base/announcements/a" {
+		t.Fatalf("Expected a to be deleted got %v %v", event, err)
+	}
+}
+
+func TestConsulStoreSetContended(t *testing.T) {
+	fake := &fakeConsul{kvs: make(map[string]consulKV), contended: "base/master"}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	fake.kvs["base/master"] = consulKV{Key: "base/master", Session: "other"}
+	s := NewConsulStore(server.URL, "", nil)
+	if _, err := s.Set("/base/master", "1", 30); err != ErrLockInUse {
+		t.Fatalf("Expected ErrLockInUse got %v", err)
+	}
+}
+
+func TestConsulStoreDroppedStates(t *testing.T) {
+	server := newFakeConsul()
+	defer server.Close()
+
+	testDroppedStates(t, NewConsulStore(server.URL, "", nil))
+}
+
+func TestConsulStoreClose(t *testing.T) {
+	server := newFakeConsul()
+	defer server.Close()
+
+	s := NewConsulStore(server.URL, "", nil)
+	s.Set("/base/announcements/a", "1", 30)
+	s.Set("/base/config", "2", 0)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get("/base/announcements/a"); err != ErrKeyNotFound {
+		t.Fatalf("Expected the session keys to be deleted got %v", err)
+	}
+
+	if _, err := s.Get("/base/config"); err != nil {
+		t.Fatalf("Expected keys without a TTL to be kept got %v", err)
+	}
+
+	if _, err := s.Set("/base/announcements/a", "1", 30); err != ErrStoreClosed {
+		t.Fatalf("Expected ErrStoreClosed got %v", err)
+	}
+}
+
+func TestConsulStoreFencedCompareAndSwap(t *testing.T) {
+	server := newFakeConsul()
+	defer server.Close()
+
+	testFencedStore(t, NewConsulStore(server.URL, "", nil))
+}
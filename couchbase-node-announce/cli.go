@@ -1,454 +1,236 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
-	"strconv"
+	"os"
 	"strings"
 	"time"
-)
-
-func localOtpNode(liveNodeIP string, nodeIP string) (otpNode string, err error) {
 
-	otpNodeList, err := otpNodeList(liveNodeIP)
-	if err != nil {
-		return "", err
-	}
-
-	for _, otpNode := range otpNodeList {
-		if strings.Contains(otpNode, nodeIP) {
-			return otpNode, nil
-		}
-	}
+	couchbasearray "github.com/andrewwebber/couchbase-array"
+	"github.com/andrewwebber/couchbase-array/couchbase/provision"
+	"github.com/andrewwebber/couchbase-array/couchbase/rest"
+)
 
-	return "", fmt.Errorf("No otpnode found with ip %v in %v", nodeIP, otpNodeList)
+// rebalancePollInterval is how often rebalance progress is polled
+var rebalancePollInterval = time.Second
+
+// credentials supplies the couchbase administrator credentials for every request
+var credentials rest.CredentialsSource = rest.StaticCredentials{Username: "Administrator", Password: "password"}
+
+// credentialsSource selects where the credentials are read from. Flags take precedence
+// over a secret file, a store key and then the COUCHBASE_USERNAME and COUCHBASE_PASSWORD
+// environment variables. The file, key and environment are read on every request so
+// rotated credentials are used without restarting.
+func credentialsSource() rest.CredentialsSource {
+	switch {
+	case *usernameFlag != "" || *passwordFlag != "":
+		log.Println("Using couchbase credentials from flags")
+		return rest.StaticCredentials{Username: *usernameFlag, Password: *passwordFlag}
+	case *credentialsFileFlag != "":
+		log.Printf("Using couchbase credentials from %s\n", *credentialsFileFlag)
+		return rest.FileCredentials{Path: *credentialsFileFlag}
+	case *credentialsKeyFlag != "":
+		log.Printf("Using couchbase credentials from key %s\n", *credentialsKeyFlag)
+		return couchbasearray.StoreCredentials{Key: *credentialsKeyFlag}
+	case os.Getenv("COUCHBASE_USERNAME") != "":
+		log.Println("Using couchbase credentials from the environment")
+		return rest.EnvCredentials{UsernameVar: "COUCHBASE_USERNAME", PasswordVar: "COUCHBASE_PASSWORD"}
+	}
+
+	log.Println("Using default couchbase credentials")
+	return credentials
 }
 
-func otpNodeList(liveNodeIP string) ([]string, error) {
+// clusterConfig describes how the first node provisions the cluster
+var clusterConfig = provision.DefaultConfig()
 
-	otpNodeList := []string{}
+// nodeServices are the services this node runs
+var nodeServices []string
 
-	nodes, err := getClusterNodes(liveNodeIP)
-	if err != nil {
-		return otpNodeList, err
+// resolveServices selects the services this node runs. The -services flag takes precedence
+// over the COUCHBASE_SERVICES environment variable, which a pod label can be projected
+// into, the placement policy in the store and then the cluster config.
+func resolveServices(nodeIP string) []string {
+	if *servicesFlag != "" {
+		return strings.Split(*servicesFlag, ",")
 	}
 
-	for _, node := range nodes {
-
-		nodeMap, ok := node.(map[string]interface{})
-		if !ok {
-			return otpNodeList, fmt.Errorf("Node had unexpected data type")
-		}
-
-		otpNode := nodeMap["otpNode"] // ex: "ns_1@10.231.192.180"
-		otpNodeStr, ok := otpNode.(string)
-		log.Printf("OtpNodeList, otpNode: %v", otpNodeStr)
-
-		if !ok {
-			return otpNodeList, fmt.Errorf("No otpNode string found")
-		}
-
-		otpNodeList = append(otpNodeList, otpNodeStr)
-
+	if services := os.Getenv("COUCHBASE_SERVICES"); services != "" {
+		return strings.Split(services, ",")
 	}
 
-	return otpNodeList, nil
-}
-
-func getClusterNodes(liveNodeIP string) ([]interface{}, error) {
-	endpointURL := fmt.Sprintf("http://%v:8091/pools/default", liveNodeIP)
-	requestURL := fmt.Sprintf(endpointURL)
-	req, err := http.NewRequest("GET", requestURL, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	req.SetBasicAuth("Administrator", "password")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	policy, err := couchbasearray.GetPlacementPolicy(*servicePathFlag)
 	if err != nil {
-		return nil, err
+		log.Println(err)
+	} else if services := policy.ServicesFor(nodeIP); len(services) > 0 {
+		return services
 	}
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	defer resp.Body.Close()
-
-	if resp.StatusCode > 202 {
-		return nil, errors.New(resp.Status)
-	}
-
-	jsonMap := map[string]interface{}{}
-	if err := json.Unmarshal(body, &jsonMap); err != nil {
-		return nil, err
-	}
-
-	nodes := jsonMap["nodes"]
-
-	nodeMaps, ok := nodes.([]interface{})
-	if !ok {
-		return nil, fmt.Errorf("Unexpected data type in nodes field")
-	}
-
-	return nodeMaps, nil
+	return clusterConfig.Services
 }
 
-func setAutoFailover(masterIP string, timeoutInSeconds int) error {
-	endpointURL := fmt.Sprintf("http://%v:%v/settings/autoFailover", masterIP, 8091)
-	log.Println(endpointURL)
-	data := url.Values{
-		"enabled": {"true"},
-		"timeout": {strconv.Itoa(timeoutInSeconds)}}
-
-	preq, err := http.NewRequest("POST", endpointURL, bytes.NewBufferString(data.Encode()))
-	if err != nil {
-		return err
-	}
-
-	preq.SetBasicAuth("Administrator", "password")
-
-	preq.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+// nodeZone is the failure domain this node runs in, empty when it is not known
+var nodeZone string
 
-	pclient := &http.Client{}
-	presp, err := pclient.Do(preq)
-	if err != nil {
-		return err
+// resolveZone selects the zone this node runs in from the -zone flag, the COUCHBASE_ZONE
+// environment variable or the first line of the -zone-file written by cloud metadata
+func resolveZone() (string, error) {
+	if *zoneFlag != "" {
+		return *zoneFlag, nil
 	}
 
-	if presp.StatusCode != 200 {
-		log.Println(presp.Status)
-		return errors.New("Invalid status code")
-	}
-
-	return err
-}
-
-func addNodeToCluster(masterIP string, nodeIP string) (bool, error) {
-	endpointURL := fmt.Sprintf("http://%s:%v/controller/addNode", masterIP, 8091)
-	log.Println(endpointURL)
-	data := url.Values{
-		"hostname": {nodeIP},
-		"user":     {"Administrator"},
-		"password": {"password"},
-		"services": {"kv,index,n1ql"},
+	if zone := os.Getenv("COUCHBASE_ZONE"); zone != "" {
+		return zone, nil
 	}
 
-	preq, err := http.NewRequest("POST", endpointURL, bytes.NewBufferString(data.Encode()))
-	if err != nil {
-		return false, err
+	if *zoneFileFlag == "" {
+		return "", nil
 	}
 
-	preq.SetBasicAuth("Administrator", "password")
-
-	preq.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	pclient := &http.Client{}
-	presp, err := pclient.Do(preq)
+	contents, err := ioutil.ReadFile(*zoneFileFlag)
 	if err != nil {
-		return false, err
+		return "", err
 	}
 
-	body, err := ioutil.ReadAll(presp.Body)
-	if err != nil {
-		return false, err
-	}
+	return strings.TrimSpace(strings.SplitN(string(contents), "\n", 2)[0]), nil
+}
 
-	if presp.StatusCode != 200 {
-		log.Println(presp.Status)
-		log.Println(string(body))
-		if strings.Contains(string(body), "Prepare join failed. Node is already part of cluster.") {
-			return true, nil
-		}
+// couchbaseTLS enables https to the management api when set. It is built once at
+// startup and shared by every client.
+var couchbaseTLS *http.Client
 
-		return false, errors.New("Invalid status code")
+// couchbaseClient creates a REST client for the node at ip
+func couchbaseClient(ip string) *rest.Client {
+	if couchbaseTLS != nil {
+		return rest.NewTLSClient(ip, credentials, couchbaseTLS)
 	}
 
-	return false, err
+	return rest.NewClientWithCredentials(ip, credentials)
 }
 
-func recoverNode(masterIP string, nodeIP string) error {
-	local, err := localOtpNode(masterIP, nodeIP)
+// initializeCluster provisions this node as the first node of the cluster unless it is
+// already initialized. A master promoted while other nodes are cluster members refuses,
+// as provisioning it would start a second cluster.
+func initializeCluster(nodeIP string) error {
+	admin, err := credentials.Credentials()
 	if err != nil {
 		return err
 	}
 
-	endpointURL := fmt.Sprintf("http://%s:%v/controller/setRecoveryType", masterIP, 8091)
-	log.Println(endpointURL)
-	data := url.Values{
-		"otpNode":      {local},
-		"recoveryType": {"delta"},
-	}
-
-	preq, err := http.NewRequest("POST", endpointURL, bytes.NewBufferString(data.Encode()))
+	states, err := couchbasearray.GetClusterStates(*servicePathFlag)
 	if err != nil {
 		return err
 	}
 
-	preq.SetBasicAuth("Administrator", "password")
-
-	preq.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	pclient := &http.Client{}
-	presp, err := pclient.Do(preq)
-	if err != nil {
-		return err
+	var members []string
+	for _, state := range states {
+		if state.IPAddress != nodeIP && state.State.IsMember() {
+			members = append(members, state.IPAddress)
+		}
 	}
 
-	body, err := ioutil.ReadAll(presp.Body)
+	config := clusterConfig
+	config.Services = nodeServices
+	initialized, err := provision.InitializeNode(couchbaseClient(nodeIP), config, admin, nodeIP, members)
 	if err != nil {
 		return err
 	}
 
-	if presp.StatusCode != 200 {
-		log.Println(presp.Status)
-		log.Println(string(body))
-		return errors.New("Invalid status code")
+	if initialized {
+		log.Println("Initialized the cluster")
+	} else {
+		log.Println("Already master no action required")
 	}
 
-	return err
+	return nil
 }
 
-func rebalanceNode(masterIP string, nodeIP string) error {
-	pclient := &http.Client{}
-	endpointURL := fmt.Sprintf("http://%s:%v/pools/default/rebalanceProgress", masterIP, 8091)
-	log.Println(endpointURL)
-	for {
-		rebalanceRequest, err := http.NewRequest("GET", endpointURL, nil)
-		rebalanceRequest.SetBasicAuth("Administrator", "password")
-		rResp, err := pclient.Do(rebalanceRequest)
-		if err != nil {
-			return err
-		}
-
-		body, err := ioutil.ReadAll(rResp.Body)
-		if err != nil {
-			return err
-		}
-
-		if rResp.StatusCode != 200 {
-			log.Println(rResp.Status)
-			log.Println(string(body))
-			log.Println("Invalid status code")
-		}
-
-		type rebalanceStatus struct {
-			Status string `json:"status"`
-		}
-
-		var status rebalanceStatus
-		if err = json.Unmarshal(body, &status); err != nil {
-			return err
-		}
-
-		if status.Status != "running" {
-			log.Printf("rebalance status: %s", status.Status)
-			break
-		}
-
-		time.Sleep(1 * time.Second)
-		log.Println(status.Status)
-	}
-
-	otpNodeList, err := otpNodeList(masterIP)
-	if err != nil {
-		return err
-	}
-
-	otpNodes := strings.Join(otpNodeList, ",")
-
-	endpointURL = fmt.Sprintf("http://%s:%v/controller/rebalance", masterIP, 8091)
-	log.Println(endpointURL)
-	log.Println(endpointURL)
-	data := url.Values{
-		"ejectedNodes": {},
-		"knownNodes":   {otpNodes},
+// bucketReconciler converges the cluster buckets on the declared bucket specs
+func bucketReconciler() couchbasearray.Reconciler {
+	var source provision.BucketSource = provision.StoreBuckets{Key: *servicePathFlag + "/buckets"}
+	if *bucketSpecFlag != "" {
+		source = provision.FileBuckets{Path: *bucketSpecFlag}
 	}
 
-	preq, err := http.NewRequest("POST", endpointURL, bytes.NewBufferString(data.Encode()))
-	if err != nil {
-		return err
-	}
-
-	preq.SetBasicAuth("Administrator", "password")
-
-	preq.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	presp, err := pclient.Do(preq)
-	if err != nil {
-		return err
-	}
+	return provision.BucketReconciler{Source: source, Client: couchbaseClient, Delete: *deleteBucketsFlag}
+}
 
-	body, err := ioutil.ReadAll(presp.Body)
-	if err != nil {
-		return err
+// autoFailoverPolicy is the auto failover policy the scheduler keeps the cluster on
+func autoFailoverPolicy() provision.AutoFailoverPolicy {
+	return provision.AutoFailoverPolicy{
+		Enabled:            *autoFailoverTimeoutFlag > 0,
+		Timeout:            *autoFailoverTimeoutFlag,
+		MaxCount:           *autoFailoverMaxCountFlag,
+		ServerGroup:        *autoFailoverServerGroupFlag,
+		DataDiskIssues:     *autoFailoverDiskFlag > 0,
+		DataDiskTimePeriod: *autoFailoverDiskFlag,
 	}
+}
 
-	if presp.StatusCode != 200 {
-		log.Println(presp.Status)
-		log.Println(string(body))
-		return errors.New("Invalid status code")
+// addNodeToCluster adds the node to the cluster, reporting whether it was already a member
+func addNodeToCluster(masterIP string, nodeIP string) (bool, error) {
+	hostname := nodeIP
+	if couchbaseTLS != nil {
+		// the master joins the node over its tls port too
+		hostname = fmt.Sprintf("https://%s:%d", nodeIP, rest.DefaultTLSPort)
 	}
 
-	endpointURL = fmt.Sprintf("http://%s:%v/pools/default/rebalanceProgress", masterIP, 8091)
-	log.Println(endpointURL)
-
-	for {
-		rebalanceRequest, err := http.NewRequest("GET", endpointURL, nil)
-		rebalanceRequest.SetBasicAuth("Administrator", "password")
-		rResp, err := pclient.Do(rebalanceRequest)
-		if err != nil {
-			return err
-		}
-
-		body, err := ioutil.ReadAll(rResp.Body)
-		if err != nil {
-			return err
-		}
-
-		if rResp.StatusCode != 200 {
-			log.Println(rResp.Status)
-			log.Println(string(body))
-			return errors.New("Invalid status code")
-		}
-
-		type rebalanceStatus struct {
-			Status string `json:"status"`
-		}
-
-		var status rebalanceStatus
-		if err = json.Unmarshal(body, &status); err != nil {
-			return err
-		}
-
-		if status.Status != "running" {
-			log.Printf("rebalance status: %s", status.Status)
-			break
+	client := couchbaseClient(masterIP)
+	var err error
+	if nodeZone == "" {
+		err = client.AddNode(hostname, nodeServices)
+	} else {
+		// join straight into the server group of the zone so the rebalance places replicas
+		err = client.AddNodeToGroup(nodeZone, hostname, nodeServices)
+		if err == rest.ErrGroupNotFound {
+			if err = client.CreateServerGroup(nodeZone); err == nil {
+				err = client.AddNodeToGroup(nodeZone, hostname, nodeServices)
+			}
 		}
+	}
 
-		time.Sleep(1 * time.Second)
-		log.Println(status.Status)
+	if err == rest.ErrAlreadyClusterMember {
+		log.Println(err)
+		return true, nil
 	}
 
-	return err
+	return false, err
 }
 
 func failoverClusterNode(masterIP string, nodeIP string) error {
-	pclient := &http.Client{}
-	endpointURL := fmt.Sprintf("http://%s:%v/pools/default/rebalanceProgress", masterIP, 8091)
-	log.Println(endpointURL)
-
-	for {
-		rebalanceRequest, err := http.NewRequest("GET", endpointURL, nil)
-		rebalanceRequest.SetBasicAuth("Administrator", "password")
-		rResp, err := pclient.Do(rebalanceRequest)
-		if err != nil {
-			return err
-		}
-
-		body, err := ioutil.ReadAll(rResp.Body)
-		if err != nil {
-			return err
-		}
-
-		if rResp.StatusCode != 200 {
-			log.Println(rResp.Status)
-			log.Println(string(body))
-			log.Println("Invalid status code")
-		}
-
-		type rebalanceStatus struct {
-			Status string `json:"status"`
-		}
-
-		var status rebalanceStatus
-		if err = json.Unmarshal(body, &status); err != nil {
-			return err
-		}
-
-		if status.Status != "running" {
-			log.Printf("rebalance status: %s", status.Status)
-			break
-		}
-
-		time.Sleep(1 * time.Second)
-		log.Println(status.Status)
-	}
-
-	local, err := localOtpNode(masterIP, nodeIP)
-	if err != nil {
+	client := couchbaseClient(masterIP)
+	if err := client.WaitForRebalance(rebalancePollInterval); err != nil {
 		return err
 	}
 
-	endpointURL = fmt.Sprintf("http://%s:%v/controller/startGracefulFailover", masterIP, 8091)
-	log.Println(endpointURL)
-	data := url.Values{
-		"otpNode": {local},
-	}
-
-	preq, err := http.NewRequest("POST", endpointURL, bytes.NewBufferString(data.Encode()))
+	node, err := client.Node(nodeIP)
 	if err != nil {
 		return err
 	}
 
-	preq.SetBasicAuth("Administrator", "password")
-
-	preq.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	presp, err := pclient.Do(preq)
-	if err != nil {
-		return err
+	// the scheduler fails over nodes which announce they are leaving as well
+	if node.ClusterMembership != "active" {
+		log.Printf("%s is already %s\n", node.OTPNode, node.ClusterMembership)
+		return nil
 	}
 
-	if presp.StatusCode != 200 {
-		log.Println(presp.Status)
-		return errors.New("Invalid status code")
+	if err = (provision.SafetyChecks{Client: client, Override: *overrideSafetyChecksFlag, Path: *servicePathFlag}).CheckFailover(*node); err != nil {
+		return err
 	}
 
-	endpointURL = fmt.Sprintf("http://%s:%v/pools/default/rebalanceProgress", masterIP, 8091)
-	log.Println(endpointURL)
-
-	for {
-		rebalanceRequest, err := http.NewRequest("GET", endpointURL, nil)
-		rebalanceRequest.SetBasicAuth("Administrator", "password")
-		rResp, err := pclient.Do(rebalanceRequest)
-		if err != nil {
-			return err
-		}
-
-		body, err := ioutil.ReadAll(rResp.Body)
-		if err != nil {
-			return err
+	otpNode := node.OTPNode
+	log.Printf("gracefully failing over %s\n", otpNode)
+	if err = client.StartGracefulFailover(otpNode); err != nil {
+		if node, nodeErr := client.Node(nodeIP); nodeErr == nil && node.ClusterMembership != "active" {
+			log.Printf("%s was failed over by the scheduler\n", otpNode)
+			return client.WaitForRebalance(rebalancePollInterval)
 		}
 
-		if rResp.StatusCode != 200 {
-			log.Println(rResp.Status)
-			log.Println(string(body))
-			return errors.New("Invalid status code")
-		}
-
-		type rebalanceStatus struct {
-			Status string `json:"status"`
-		}
-
-		var status rebalanceStatus
-		if err = json.Unmarshal(body, &status); err != nil {
-			return err
-		}
-
-		if status.Status != "running" {
-			log.Printf("rebalance status: %s", status.Status)
-			break
-		}
-
-		time.Sleep(1 * time.Second)
-		log.Println(status.Status)
+		return err
 	}
 
-	return err
+	return client.WaitForRebalance(rebalancePollInterval)
 }
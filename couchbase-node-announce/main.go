@@ -1,10 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"math"
 	"net"
 	"os"
 	"os/signal"
@@ -16,18 +16,49 @@ import (
 	"flag"
 
 	couchbasearray "github.com/andrewwebber/couchbase-array"
+	"github.com/andrewwebber/couchbase-array/couchbase/provision"
+	"github.com/andrewwebber/couchbase-array/couchbase/rest"
 )
 
 var servicePathFlag = flag.String("s", "/services/couchbase-array", "etcd directory")
 var heartBeatFlag = flag.Int("h", 3, "heart beat loop in seconds")
 var ttlFlag = flag.Int("ttl", 30, "time to live in seconds")
 var debugFlag = flag.Bool("v", false, "verbose")
-var rebalanceOnExitFlag = flag.Bool("r", false, "rebalance on exit")
+var _ = flag.Bool("r", false, "deprecated, the scheduler rebalances failed over nodes out of the cluster")
 var machineIdentiferFlag = flag.String("ip", "", "machine ip address")
 var whatIfFlag = flag.Bool("t", false, "what if")
 var cliBase = flag.String("cli", "/opt/couchbase/bin/couchbase-cli", "path to couchbase cli")
 var statefulSet = flag.String("statefulset", "", "use stateful")
 var masterNodeAnnouncePathFlag = flag.String("m", "/services/couchbase", "announce etcd path for the master IP")
+var backendFlag = flag.String("backend", "etcd", "discovery backend (etcd, consul, kubernetes)")
+var consulAddressFlag = flag.String("consul", "http://127.0.0.1:8500", "consul agent address")
+var usernameFlag = flag.String("username", "", "couchbase administrator username")
+var passwordFlag = flag.String("password", "", "couchbase administrator password")
+var credentialsFileFlag = flag.String("credentials-file", "", "secret file or directory holding the couchbase username and password")
+var credentialsKeyFlag = flag.String("credentials-key", "", "store key holding the couchbase credentials as JSON")
+var tlsFlag = flag.Bool("tls", false, "use https on the couchbase tls port for the management api")
+var tlsCAFlag = flag.String("tls-ca", "", "CA file couchbase node certificates are verified against")
+var tlsCertFlag = flag.String("tls-cert", "", "client certificate for mutual tls with couchbase")
+var tlsKeyFlag = flag.String("tls-key", "", "client certificate key for mutual tls with couchbase")
+var tlsServerNameFlag = flag.String("tls-server-name", "", "name couchbase node certificates are verified against")
+var clusterConfigFlag = flag.String("cluster-config", "", "JSON file describing how the first node provisions the cluster")
+var servicesFlag = flag.String("services", "", "comma separated couchbase services this node runs (kv, index, n1ql, fts, eventing, analytics)")
+var zoneFlag = flag.String("zone", "", "zone or rack this node runs in, placing it in the server group of the same name")
+var zoneFileFlag = flag.String("zone-file", "", "file whose first line is the zone this node runs in")
+var rebalanceAttemptsFlag = flag.Int("rebalance-attempts", 3, "attempts at a failing rebalance before giving up, zero retries forever")
+var rebalanceBackoffFlag = flag.Duration("rebalance-backoff", 30*time.Second, "wait before retrying a failed rebalance, doubling for every attempt")
+var ejectAfterFlag = flag.Duration("eject-after", 5*time.Minute, "how long a cluster node may go without an announcement before it is ejected")
+var autoFailoverTimeoutFlag = flag.Int("auto-failover-timeout", 31, "seconds a node is unresponsive before couchbase fails it over, zero disables auto failover")
+var autoFailoverMaxCountFlag = flag.Int("auto-failover-max-count", 1, "nodes couchbase fails over before the scheduler has replaced them")
+var autoFailoverServerGroupFlag = flag.Bool("auto-failover-server-group", false, "fail over a whole unresponsive server group")
+var autoFailoverDiskFlag = flag.Int("auto-failover-disk", 0, "seconds a data disk may fail before the node is failed over, zero disables")
+var deltaRecoveryWindowFlag = flag.Duration("delta-recovery-window", 30*time.Minute, "how long after its failover a returning node is still recovered with delta recovery")
+var bucketSpecFlag = flag.String("bucket-spec", "", "JSON file declaring the buckets, defaults to the <service path>/buckets key")
+var deleteBucketsFlag = flag.Bool("delete-buckets", false, "delete buckets which are not declared")
+var overrideSafetyChecksFlag = flag.Bool("override-safety-checks", false, "fail over, eject and rebalance even when the safety checks find it would lose data")
+var cordonFlag = flag.String("cordon", "", "put the node with this IP into maintenance and exit")
+var uncordonFlag = flag.String("uncordon", "", "take the node with this IP out of maintenance and exit")
+var historyFlag = flag.Bool("history", false, "print the recorded node transitions and exit")
 
 func main() {
 	log.SetFlags(log.Llongfile)
@@ -36,6 +67,72 @@ func main() {
 	couchbasearray.TTL = uint64(*ttlFlag)
 	log.Printf("TTL %v\n", couchbasearray.TTL)
 
+	switch *backendFlag {
+	case "etcd":
+	case "consul":
+		log.Printf("Using consul %s\n", *consulAddressFlag)
+		couchbasearray.SetStore(couchbasearray.NewConsulStore(*consulAddressFlag, os.Getenv("CONSUL_HTTP_TOKEN"), nil))
+	case "kubernetes":
+		kubernetesStore, err := couchbasearray.NewInClusterKubernetesStore()
+		if err != nil {
+			log.Fatal(err)
+		}
+		couchbasearray.SetStore(kubernetesStore)
+	default:
+		log.Fatalf("unknown backend %s", *backendFlag)
+	}
+
+	credentials = credentialsSource()
+	if *tlsFlag {
+		config, err := rest.TLSOptions{
+			CAFile:     *tlsCAFlag,
+			CertFile:   *tlsCertFlag,
+			KeyFile:    *tlsKeyFlag,
+			ServerName: *tlsServerNameFlag}.Config()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		couchbaseTLS = rest.NewTLSHTTPClient(config)
+	}
+
+	if *clusterConfigFlag != "" {
+		var err error
+		if clusterConfig, err = provision.LoadConfig(*clusterConfigFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *historyFlag {
+		transitions, err := couchbasearray.GetHistory(*servicePathFlag, "")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, transition := range transitions {
+			fmt.Println(transition)
+		}
+		return
+	}
+
+	if *cordonFlag != "" {
+		if err := couchbasearray.Cordon(*servicePathFlag, *cordonFlag); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("%s cordoned, the scheduler fails it over and holds it out of the cluster\n", *cordonFlag)
+		return
+	}
+
+	if *uncordonFlag != "" {
+		if err := couchbasearray.Uncordon(*servicePathFlag, *uncordonFlag); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("%s uncordoned, the scheduler recovers it into the cluster\n", *uncordonFlag)
+		return
+	}
+
 	machineIdentifier := *machineIdentiferFlag
 	if machineIdentifier == "" {
 		var err error
@@ -46,126 +143,84 @@ func main() {
 	}
 
 	log.Printf("Machine ID: %s\n", machineIdentifier)
+	nodeServices = resolveServices(machineIdentifier)
+	log.Printf("Services: %v\n", nodeServices)
+	var err error
+	if nodeZone, err = resolveZone(); err != nil {
+		log.Fatal(err)
+	}
+
+	if nodeZone != "" {
+		log.Printf("Zone: %s\n", nodeZone)
+	}
 
 	sessionID := uuid.New()
-	var isClusterMember bool
 
+	election := couchbasearray.NewLeaderElection(sessionID, *servicePathFlag, 5)
+	coordinator := provision.NewRebalanceCoordinator(couchbaseClient, *rebalanceAttemptsFlag, *rebalanceBackoffFlag)
+	coordinator.EjectAfter = *ejectAfterFlag
+	coordinator.Override = *overrideSafetyChecksFlag
+	coordinator.Path = *servicePathFlag
+	couchbasearray.ScheduleWhileLeading(election, *servicePathFlag, *heartBeatFlag, *masterNodeAnnouncePathFlag,
+		provision.ServerGroupReconciler{Client: couchbaseClient},
+		provision.AutoFailoverReconciler{Client: couchbaseClient, Policy: autoFailoverPolicy()},
+		&provision.FailoverReconciler{Client: couchbaseClient, Override: *overrideSafetyChecksFlag, Path: *servicePathFlag},
+		provision.RecoveryReconciler{Client: couchbaseClient, Path: *servicePathFlag, DeltaWindow: *deltaRecoveryWindowFlag},
+		coordinator,
+		bucketReconciler())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	electionDone := make(chan bool)
 	go func() {
-		for {
-			announcments, err := couchbasearray.GetClusterAnnouncements(*servicePathFlag)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
+		election.Run(ctx)
+		close(electionDone)
+	}()
 
-			machineState, ok := announcments[sessionID]
-			if !ok {
-				machineState = couchbasearray.NodeState{
-					IPAddress:    machineIdentifier,
-					SessionID:    sessionID,
-					Master:       false,
-					State:        "",
-					DesiredState: ""}
-			}
+	machineState := couchbasearray.NodeState{
+		IPAddress:    machineIdentifier,
+		SessionID:    sessionID,
+		Services:     nodeServices,
+		Zone:         nodeZone,
+		DataIntact:   alreadyClustered(),
+		Master:       false,
+		State:        couchbasearray.SchedulerStateEmpty,
+		DesiredState: couchbasearray.SchedulerStateEmpty}
+
+	leaving := make(chan bool)
+	agentDone := make(chan bool)
+	go func() {
+		defer close(agentDone)
 
+		var announced couchbasearray.NodeState
+		var lastAnnouncement time.Time
+		stateChanges := couchbasearray.WatchChanges(fmt.Sprintf("%s/states/%s", *servicePathFlag, sessionID), couchbasearray.SchedulerDebounce, leaving)
+		for {
+			settled := false
 			currentStates, err := couchbasearray.GetClusterStates(*servicePathFlag)
 
 			master, err := couchbasearray.GetMasterNode(currentStates)
 			if err != nil {
-				err := couchbasearray.AcquireLock(sessionID, *servicePathFlag+"/master", 5)
-				if err == nil {
-					stopScheduler := make(chan bool)
-					go couchbasearray.StartScheduler(*servicePathFlag, *heartBeatFlag, stopScheduler, *masterNodeAnnouncePathFlag)
-					go func() {
-						failoverSet := false
-						for {
-							lockErr := couchbasearray.AcquireLock(sessionID, *servicePathFlag+"/master", 5)
-							if lockErr != nil {
-								log.Println(lockErr)
-								stopScheduler <- true
-								return
-							}
-
-							if !failoverSet {
-								if failOverErr := setAutoFailover(machineIdentifier, 31); err != nil {
-									log.Println(failOverErr)
-								} else {
-									failoverSet = true
-								}
-							}
-
-							time.Sleep(4 * time.Second)
-						}
-					}()
-				}
-
-				if err != nil && err != couchbasearray.ErrLockInUse {
-					log.Println(err)
-					continue
-				}
+				log.Println(err)
 			} else {
 				if state, ok := currentStates[sessionID]; ok {
-					if state.DesiredState != machineState.State {
-						log.Printf("DesiredState: %s - Current State: %s", state.DesiredState, machineState.State)
+					if machineState.State == couchbasearray.SchedulerStateEmpty && state.Maintenance {
+						// the scheduler kept the state of this node through its restart in maintenance
+						log.Printf("Resuming maintenance in %s\n", state.State)
+						machineState.State = state.State
+					}
 
-						switch state.DesiredState {
-						case couchbasearray.SchedulerStateClustered:
-							log.Println("rebalancing")
-
-							if !alreadyClustered() {
-								if master.IPAddress == machineIdentifier {
-									log.Println("Already master no action required")
-								} else {
-									log.Printf("rebalancing with master node %s\n", master.IPAddress)
-									if !*whatIfFlag {
-										if isClusterMember {
-											err = recoverNode(master.IPAddress, machineIdentifier)
-										}
-									}
-								}
-							}
-
-							if err != nil {
-								log.Println(err)
-							} else {
-								err = rebalanceNode(master.IPAddress, machineIdentifier)
-							}
-
-							if err == nil {
-								machineState.State = state.DesiredState
-							} else {
-								log.Println(err)
-							}
-
-						case couchbasearray.SchedulerStateNew:
-							log.Println("adding server to cluster")
-							master, err := couchbasearray.GetMasterNode(currentStates)
-							if err != nil {
-								log.Println(err)
-							} else {
-								//if !alreadyClustered() {
-								if master.IPAddress == machineIdentifier {
-									log.Println("Already master no action required")
-								} else {
-									log.Printf("Adding to master node %s\n", master.IPAddress)
-									if !*whatIfFlag {
-										isClusterMember, err = addNodeToCluster(master.IPAddress, machineIdentifier)
-										if err == nil {
-											ioutil.WriteFile("/opt/couchbase/var/lib/couchbase/_clustered", []byte{}, os.ModePerm)
-										}
-									}
-								}
-								//}
-
-								if err == nil {
-									machineState.State = state.DesiredState
-								} else {
-									log.Println(err)
-								}
-							}
-						default:
-							log.Println(state.DesiredState)
-							log.Fatal("unknown state")
+					settled = state.DesiredState == machineState.State
+					if !settled {
+						log.Printf("DesiredState: %s - Current State: %s", state.DesiredState, machineState.State)
+						if err = couchbasearray.ValidateTransition(machineState.State, state.DesiredState); err != nil {
+							log.Printf("%v from %s to %s\n", err, machineState.State, state.DesiredState)
+						} else if err = converge(state.DesiredState, master, machineIdentifier); err != nil {
+							log.Println(err)
+						} else if state.DesiredState == couchbasearray.SchedulerStateDeleted {
+							log.Println("Session deleted, registering again")
+							machineState.State = couchbasearray.SchedulerStateEmpty
+						} else {
+							machineState.State = state.DesiredState
 						}
 					}
 				} else {
@@ -173,19 +228,64 @@ func main() {
 				}
 			}
 
-			err = couchbasearray.SetClusterAnnouncement(*servicePathFlag, machineState)
-			if err != nil {
-				log.Println(err)
+			if machineState.State != announced.State || time.Since(lastAnnouncement) >= announceInterval() {
+				err = couchbasearray.SetClusterAnnouncement(*servicePathFlag, machineState)
+				if err != nil {
+					log.Println(err)
+				} else {
+					announced = machineState
+					lastAnnouncement = time.Now()
+				}
+			}
+
+			// once settled only wake up for state changes or to refresh the announcement
+			wait := time.Duration(*heartBeatFlag) * time.Second
+			if settled {
+				wait = announceInterval() - time.Since(lastAnnouncement)
 			}
 
-			time.Sleep(time.Duration(*heartBeatFlag) * time.Second)
+			select {
+			case <-stateChanges:
+			case <-time.After(wait):
+			case <-leaving:
+				return
+			}
 		}
 	}()
 
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGKILL)
 	log.Println(<-ch)
+
+	// hand off the master role before this node leaves the cluster
+	cancel()
+	<-electionDone
+	close(leaving)
+	<-agentDone
+
+	// delete the keys bound to this agent's session once it has left, rather than waiting for them to expire
+	defer func() {
+		if err := couchbasearray.CloseStore(); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	if machineState.State == couchbasearray.SchedulerStateRemoved {
+		log.Println("Already failed over, leaving")
+		return
+	}
+
+	if err := couchbasearray.ValidateTransition(machineState.State, couchbasearray.SchedulerStateFailingOver); err != nil {
+		log.Printf("Node never joined the cluster, leaving without failover from %s\n", machineState.State)
+		return
+	}
+
 	log.Println("Failing over")
+	machineState.State = couchbasearray.SchedulerStateFailingOver
+	if err := couchbasearray.SetClusterAnnouncement(*servicePathFlag, machineState); err != nil {
+		log.Println(err)
+	}
+
 	log.Println("waiting for TTL drain")
 	time.Sleep(time.Duration(*ttlFlag*2) * time.Second)
 
@@ -201,18 +301,65 @@ func main() {
 		return
 	}
 
+	// the scheduler rebalances the failed over node out of the cluster
 	err = failoverClusterNode(master.IPAddress, machineIdentifier)
 	if err != nil {
 		log.Fatal(err)
 	}
+}
 
-	if *rebalanceOnExitFlag {
-		time.Sleep(10 * time.Second)
-		err = rebalanceNode(master.IPAddress, machineIdentifier)
-		if err != nil {
-			log.Fatal(err)
+// converge performs the work needed to bring this node to the desired state
+func converge(desired couchbasearray.SchedulerState, master couchbasearray.NodeState, machineIdentifier string) error {
+	var err error
+	switch desired {
+	case couchbasearray.SchedulerStateNew:
+		log.Println("registered with the scheduler")
+	case couchbasearray.SchedulerStateAdding:
+		log.Println("adding server to cluster")
+		if master.IPAddress == machineIdentifier {
+			if !*whatIfFlag {
+				err = initializeCluster(machineIdentifier)
+			}
+		} else if !*whatIfFlag {
+			log.Printf("Adding to master node %s\n", master.IPAddress)
+			var isClusterMember bool
+			isClusterMember, err = addNodeToCluster(master.IPAddress, machineIdentifier)
+			if err == nil && isClusterMember {
+				log.Println("Rejoining the cluster, the scheduler decides how the node is recovered")
+			}
+
+			if err == nil {
+				ioutil.WriteFile("/opt/couchbase/var/lib/couchbase/_clustered", []byte{}, os.ModePerm)
+			}
+		}
+	case couchbasearray.SchedulerStateClustered:
+		log.Println("rebalanced into the cluster")
+	case couchbasearray.SchedulerStateFailingOver:
+		log.Printf("failing over from master node %s\n", master.IPAddress)
+		if !*whatIfFlag {
+			err = failoverClusterNode(master.IPAddress, machineIdentifier)
 		}
+	case couchbasearray.SchedulerStateRemoved:
+		log.Println("failed over, waiting for recovery")
+	case couchbasearray.SchedulerStateRelax:
+		log.Println("relaxing, no action required")
+	case couchbasearray.SchedulerStateDeleted:
+		log.Println("removed by the scheduler")
+	default:
+		err = fmt.Errorf("unknown state %s", desired)
 	}
+
+	return err
+}
+
+// announceInterval is how often an unchanged announcement is refreshed before its TTL expires
+func announceInterval() time.Duration {
+	interval := time.Duration(*ttlFlag) * time.Second / 3
+	if heartBeat := time.Duration(*heartBeatFlag) * time.Second; interval < heartBeat {
+		return heartBeat
+	}
+
+	return interval
 }
 
 func alreadyClustered() bool {
@@ -258,25 +405,3 @@ func getMachineIdentifier() (string, error) {
 
 	return os.Hostname()
 }
-
-type function func() error
-
-func exponential(operation function, maxRetries int) error {
-	var err error
-	var sleepTime int
-	for i := 0; i < maxRetries; i++ {
-		err = operation()
-		if err == nil {
-			return nil
-		}
-		if i == 0 {
-			sleepTime = 1
-		} else {
-			sleepTime = int(math.Exp2(float64(i)) * 100)
-		}
-		time.Sleep(time.Duration(sleepTime) * time.Millisecond)
-		log.Printf("Retry exponential: Attempt %d, sleep %d", i, sleepTime)
-	}
-
-	return err
-}
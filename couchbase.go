@@ -2,6 +2,7 @@ package couchbasearray
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -11,97 +12,320 @@ import (
 	"github.com/coreos/go-etcd/etcd"
 )
 
-var SchedulerStateEmpty = ""
-var SchedulerStateNew = "new"
-var SchedulerStateRelax = "relax"
-var SchedulerStateClustered = "clustered"
-var SchedulerStateDeleted = "deleted"
 var TTL uint64 = 5
 
-var client *etcd.Client
+// ErrStateConflict is returned by SaveClusterStates when a state was changed after it was read
+var ErrStateConflict = errors.New("cluster state changed concurrently")
 
 func init() {
-	client = NewEtcdClient()
+	store = NewStoreFromEnvironment()
 }
 
 func Schedule(path string) (map[string]NodeState, error) {
+	currentStates, _, err := schedule(path)
+	return currentStates, err
+}
+
+// schedule runs Schedule, also returning the transitions it made
+func schedule(path string) (map[string]NodeState, []Transition, error) {
 	announcements, err := GetClusterAnnouncements(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	currentStates, err := GetClusterStates(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	policy, err := GetPlacementPolicy(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cordoned, err := GetCordonedNodes(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	initialized, err := getClusterInitialized(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	currentStates, transitions := scheduleCore(announcements, currentStates, policy, cordoned)
+	if !initialized && clusterInitialized(currentStates) {
+		if err = setClusterInitialized(path); err != nil {
+			return nil, nil, err
+		}
+		initialized = true
+	}
+
+	return selectMaster(currentStates, initialized), transitions, nil
+}
+
+// getClusterInitialized reports whether a node beneath base has ever joined the cluster
+func getClusterInitialized(base string) (bool, error) {
+	_, err := store.Get(base + "/initialized")
+	if err == ErrKeyNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// setClusterInitialized records that a node beneath base has joined the cluster
+func setClusterInitialized(base string) error {
+	_, err := store.Set(base+"/initialized", "true", 0)
+	return err
+}
+
+// clusterInitialized reports whether any of the states has joined the cluster
+func clusterInitialized(currentStates map[string]NodeState) bool {
+	for _, state := range currentStates {
+		if state.State.IsMember() {
+			return true
+		}
 	}
 
-	currentStates = ScheduleCore(announcements, currentStates)
-	return SelectMaster(currentStates), nil
+	return false
 }
 
+// ScheduleCore moves every node towards its next state. Announced states are adopted when
+// they are a valid transition, announcements which have gone are marked deleted and
+// deleted states are dropped on the following pass. New nodes wait for the master to be
+// initialized before they are added and added nodes wait in adding until the rebalance
+// coordinator marks them clustered.
 func ScheduleCore(announcements map[string]NodeState, currentStates map[string]NodeState) map[string]NodeState {
+	currentStates, _ = scheduleCore(announcements, currentStates, PlacementPolicy{}, nil)
+	return currentStates
+}
+
+// scheduleCore runs ScheduleCore, also returning a transition for every state it changed.
+// While a service is below the minimum of policy, nodes which would be added without
+// running it wait for the nodes which do. Cordoned nodes are failed over and held out
+// of the cluster, keeping their state while they restart.
+func scheduleCore(announcements map[string]NodeState, currentStates map[string]NodeState, policy PlacementPolicy, cordoned map[string]Maintenance) (map[string]NodeState, []Transition) {
+	var transitions []Transition
+	record := func(previous NodeState, state NodeState, reason string) {
+		if previous.State != state.State || previous.DesiredState != state.DesiredState {
+			transitions = append(transitions, NewTransition(previous, state, reason))
+		}
+	}
+
+	restarting := resumeMaintenance(announcements, currentStates, cordoned)
+
+	// other nodes only join once the master has initialized the cluster
+	masterReady := false
+	for key, state := range currentStates {
+		if !state.Master {
+			continue
+		}
+
+		if announcement, ok := announcements[key]; ok && announcement.SessionID == state.SessionID && state.State.CanTransition(announcement.State) {
+			state.State = announcement.State
+		}
+
+		masterReady = state.State == SchedulerStateAdding || state.State == SchedulerStateClustered
+	}
+
+	// nodes joining the cluster which run a service below its minimum are added first
+	reported := make(map[string]NodeState)
+	joining := make(map[string]bool)
+	for key, announcement := range announcements {
+		state, ok := currentStates[key]
+		if !ok || state.SessionID != announcement.SessionID {
+			joining[key] = true
+			continue
+		}
+
+		if state.State.CanTransition(announcement.State) && announcement.State != SchedulerStateEmpty {
+			state.State = announcement.State
+		}
+		state.Services = announcement.Services
+		reported[key] = state
+		joining[key] = state.State == SchedulerStateNew || state.State == SchedulerStateRemoved
+	}
+
+	deficits := policy.ServiceDeficits(reported)
+	deficitCovered := false
+	for key := range joining {
+		if joining[key] && announcements[key].RunsAny(deficits) {
+			deficitCovered = true
+		}
+	}
+
 	for key, announcement := range announcements {
-		if state, ok := currentStates[key]; ok {
-			if state.SessionID == announcement.SessionID {
-				if state.DesiredState == SchedulerStateNew && announcement.State == SchedulerStateNew {
-					state.DesiredState = SchedulerStateClustered
-					currentStates[key] = state
-				}
-
-				if state.DesiredState == SchedulerStateClustered && announcement.State == SchedulerStateClustered {
-					state.State = SchedulerStateClustered
-					state.DesiredState = SchedulerStateClustered
-					currentStates[key] = state
-				}
+		state, ok := currentStates[key]
+		if !ok && restarting[key] {
+			continue
+		}
+
+		if !ok {
+			log.Println("Unabled to find state for node ", key)
+			ttl := time.Now().UnixNano()
+			currentStates[key] = NodeState{
+				IPAddress:    announcement.IPAddress,
+				SessionID:    announcement.SessionID,
+				Services:     announcement.Services,
+				Zone:         announcement.Zone,
+				DataIntact:   announcement.DataIntact,
+				State:        SchedulerStateNew,
+				DesiredState: SchedulerStateNew,
+				TTL:          ttl}
+			record(NodeState{}, currentStates[key], "node announced")
+			continue
+		}
+
+		previous := state
+		if state.SessionID != announcement.SessionID || state.State == SchedulerStateDeleted {
+			log.Println("Resetting node")
+			if state.SessionID != announcement.SessionID {
+				state.ModifiedIndex = 0
+			}
+			state.DesiredState = SchedulerStateNew
+			state.State = SchedulerStateNew
+			state.SessionID = announcement.SessionID
+			state.Services = announcement.Services
+			state.Zone = announcement.Zone
+			state.RebalanceProgress = 0
+			state.Error = ""
+			state.Failover = ""
+			state.Recovery = ""
+			state.DataIntact = announcement.DataIntact
+			state.Master = false
+			currentStates[key] = state
+			record(previous, state, "node reset")
+			continue
+		}
+
+		state.Services = announcement.Services
+		state.Zone = announcement.Zone
+		state.DataIntact = announcement.DataIntact
+		changed := false
+		if announcement.State != SchedulerStateEmpty && announcement.State != state.State {
+			if err := ValidateTransition(state.State, announcement.State); err != nil {
+				log.Printf("Ignoring node %s moving from %s to %s: %v\n", key, state.State, announcement.State, err)
 			} else {
-				log.Println("Resetting node")
-				state.DesiredState = SchedulerStateNew
-				state.State = SchedulerStateNew
-				state.SessionID = announcement.SessionID
-				currentStates[key] = state
+				state.State = announcement.State
+				changed = true
 			}
+		}
+
+		if changed || state.DesiredState == state.State || !state.State.CanTransition(state.DesiredState) {
+			state.DesiredState = state.State.Next()
+		}
+
+		if state.DesiredState == SchedulerStateAdding && state.State == SchedulerStateNew && !state.Master && !masterReady {
+			state.DesiredState = SchedulerStateNew
+		}
+
+		// added nodes are marked clustered by the rebalance coordinator
+		if state.State == SchedulerStateAdding && state.DesiredState == SchedulerStateClustered {
+			state.DesiredState = SchedulerStateAdding
+		}
+
+		reason := "scheduled"
+		if state.DesiredState == SchedulerStateAdding && state.State != SchedulerStateAdding && !state.Master && deficitCovered && !announcement.RunsAny(deficits) {
+			state.DesiredState = state.State
+			reason = fmt.Sprintf("waiting for nodes running %v", deficitServices(deficits))
+		}
+
+		_, state.Maintenance = cordoned[state.IPAddress]
+		if state.Maintenance && state.State != SchedulerStateRelax {
+			state.DesiredState = maintenanceState(state.State)
+			reason = "cordoned for maintenance"
+		}
+
+		currentStates[key] = state
+		if changed {
+			record(previous, state, fmt.Sprintf("node reported %s", announcement.State))
 		} else {
-			log.Println("Unabled to find state for node ", key)
-			ttl := time.Now().UnixNano()
-			currentStates[key] = NodeState{announcement.IPAddress, announcement.SessionID, false, SchedulerStateNew, SchedulerStateNew, ttl}
+			record(previous, state, reason)
 		}
 	}
 
-	for key := range currentStates {
+	announced := make(map[string]bool)
+	for _, announcement := range announcements {
+		announced[announcement.IPAddress] = true
+	}
+
+	for key, state := range currentStates {
 		if _, ok := announcements[key]; ok {
 			continue
-		} else {
+		}
+
+		if state.State == SchedulerStateDeleted {
 			delete(currentStates, key)
+			continue
+		}
+
+		// a drained node in maintenance is kept while its host is down
+		if _, ok := cordoned[state.IPAddress]; ok && state.Maintenance && state.State == SchedulerStateRemoved && !announced[state.IPAddress] {
+			continue
 		}
+
+		log.Println("Deleting node ", key)
+		previous := state
+		state.State = SchedulerStateDeleted
+		state.DesiredState = SchedulerStateDeleted
+		state.Master = false
+		currentStates[key] = state
+		record(previous, state, "announcement expired")
 	}
 
-	return currentStates
+	return currentStates, transitions
 }
 
+// SelectMaster keeps the current master until its TTL is reached or it can no longer be
+// master, and otherwise promotes another node which can be. Clustered nodes are preferred
+// over adding nodes, and once the cluster has been initialized a new node is only promoted
+// when it kept the data of an earlier membership, so a blank node never initializes a
+// second cluster.
 func SelectMaster(currentStates map[string]NodeState) map[string]NodeState {
+	return selectMaster(currentStates, clusterInitialized(currentStates))
+}
+
+// selectMaster runs SelectMaster, initialized being whether the cluster has ever had a member
+func selectMaster(currentStates map[string]NodeState, initialized bool) map[string]NodeState {
 	if len(currentStates) == 0 {
 		return currentStates
 	}
 
 	ttl := time.Now().UnixNano()
 	var oldMasterKey string
-	var lastKey string
+	var candidateKey string
+	candidateRank := 0
 	for key, state := range currentStates {
+		rank := masterRank(state, initialized)
 		if state.Master {
-			if ttl > state.TTL {
+			if rank == 0 {
+				oldMasterKey = key
+				log.Print("Master can no longer lead")
+			} else if ttl > state.TTL {
 				oldMasterKey = key
 				log.Print("Master TTL reached")
 			} else {
 				return currentStates
 			}
-		} else {
-			lastKey = key
+		} else if rank > candidateRank || (rank == candidateRank && rank > 0 && key < candidateKey) {
+			candidateKey = key
+			candidateRank = rank
 		}
 	}
 
-	state := currentStates[lastKey]
+	if candidateKey == "" {
+		if oldMasterKey != "" && masterRank(currentStates[oldMasterKey], initialized) == 0 {
+			state := currentStates[oldMasterKey]
+			state.Master = false
+			currentStates[oldMasterKey] = state
+		}
+		return currentStates
+	}
+
+	state := currentStates[candidateKey]
 	state.Master = true
-	currentStates[lastKey] = state
+	currentStates[candidateKey] = state
 
 	if oldMasterKey != "" {
 		state = currentStates[oldMasterKey]
@@ -111,40 +335,115 @@ func SelectMaster(currentStates map[string]NodeState) map[string]NodeState {
 	return currentStates
 }
 
+// masterRank orders the nodes which can be master, zero being a node which cannot
+func masterRank(state NodeState, initialized bool) int {
+	switch {
+	case !state.State.CanBeMaster():
+		return 0
+	case state.State == SchedulerStateClustered:
+		return 3
+	case state.State == SchedulerStateAdding:
+		return 2
+	case !initialized || state.DataIntact:
+		return 1
+	}
+
+	return 0
+}
+
 func GetClusterStates(base string) (map[string]NodeState, error) {
 	values := make(map[string]NodeState)
 	key := fmt.Sprintf("%s/states/", base)
-	response, err := client.Get(key, false, false)
+	nodes, err := store.GetDir(key)
 	if err != nil {
-		if strings.Contains(err.Error(), "Key not found") {
+		if err == ErrKeyNotFound {
 			return values, nil
 		}
 		return nil, err
 	}
 
-	for _, node := range response.Node.Nodes {
+	for _, node := range nodes {
 		var state NodeState
 		err = json.Unmarshal([]byte(node.Value), &state)
 		if err != nil {
 			return nil, err
 		}
 
-		sections := strings.Split(node.Key, "/")
-		nodeKey := sections[len(sections)-1]
-		values[nodeKey] = state
+		state.ModifiedIndex = node.ModifiedIndex
+		values[nodeKey(node.Key)] = state
 	}
 
 	return values, nil
 }
 
+// SaveClusterStates writes states back with compare-and-swap against the index each state
+// was read at, creating states which were never read and deleting states which were
+// dropped from the map. ErrStateConflict is returned if another writer got there first;
+// the saved states are updated with their new index.
 func SaveClusterStates(base string, states map[string]NodeState) error {
-	for _, stateValue := range states {
+	return saveClusterStates(base, states, func(key string, value string, prevIndex uint64) (StoreNode, error) {
+		if prevIndex == 0 {
+			return store.Create(key, value, TTL)
+		}
+
+		return store.CompareAndSwap(key, value, TTL, "", prevIndex)
+	})
+}
+
+// saveClusterStates writes each state with write, which creates the key when prevIndex is zero
+func saveClusterStates(base string, states map[string]NodeState, write func(key string, value string, prevIndex uint64) (StoreNode, error)) error {
+	for id, stateValue := range states {
 		bytes, err := json.Marshal(stateValue)
-		key := fmt.Sprintf("%s/states/%s", base, stateValue.SessionID)
-		_, err = client.Set(key, string(bytes), TTL)
 		if err != nil {
 			return err
 		}
+
+		key := fmt.Sprintf("%s/states/%s", base, stateValue.SessionID)
+		node, err := write(key, string(bytes), stateValue.ModifiedIndex)
+
+		switch err {
+		case nil:
+		case ErrNodeExist, ErrCompareFailed, ErrKeyNotFound:
+			return ErrStateConflict
+		default:
+			return err
+		}
+
+		stateValue.ModifiedIndex = node.ModifiedIndex
+		states[id] = stateValue
+	}
+
+	return deleteDroppedStates(base, states)
+}
+
+// deleteDroppedStates deletes the saved states which are no longer in states. The stores
+// keep the leases of the keys they wrote alive while they run, so the key of a dropped
+// state would otherwise never expire.
+func deleteDroppedStates(base string, states map[string]NodeState) error {
+	nodes, err := store.GetDir(fmt.Sprintf("%s/states/", base))
+	if err == ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	kept := make(map[string]bool)
+	for _, state := range states {
+		kept[state.SessionID] = true
+	}
+
+	for _, node := range nodes {
+		if kept[nodeKey(node.Key)] {
+			continue
+		}
+
+		switch err = store.CompareAndDelete(node.Key, "", node.ModifiedIndex); err {
+		case nil, ErrKeyNotFound:
+		case ErrCompareFailed:
+			return ErrStateConflict
+		default:
+			return err
+		}
 	}
 
 	return nil
@@ -152,11 +451,9 @@ func SaveClusterStates(base string, states map[string]NodeState) error {
 
 func ClearClusterStates(base string) error {
 	key := fmt.Sprintf("%s/states/", base)
-	_, err := client.Delete(key, true)
-	if err != nil {
-		if strings.Contains(err.Error(), "Key not found") {
-			return nil
-		}
+	err := store.Delete(key, true)
+	if err == ErrKeyNotFound {
+		return nil
 	}
 
 	return err
@@ -164,11 +461,9 @@ func ClearClusterStates(base string) error {
 
 func ClearAnnouncments(base string) error {
 	key := fmt.Sprintf("%s/announcements/", base)
-	_, err := client.Delete(key, true)
-	if err != nil {
-		if strings.Contains(err.Error(), "Key not found") {
-			return nil
-		}
+	err := store.Delete(key, true)
+	if err == ErrKeyNotFound {
+		return nil
 	}
 
 	return err
@@ -177,24 +472,22 @@ func ClearAnnouncments(base string) error {
 func GetClusterAnnouncements(path string) (map[string]NodeState, error) {
 	values := make(map[string]NodeState)
 	key := fmt.Sprintf("%s/announcements/", path)
-	response, err := client.Get(key, false, false)
+	nodes, err := store.GetDir(key)
 	if err != nil {
-		if strings.Contains(err.Error(), "Key not found") {
+		if err == ErrKeyNotFound {
 			return values, nil
 		}
 		return nil, err
 	}
 
-	for _, node := range response.Node.Nodes {
+	for _, node := range nodes {
 		var state NodeState
 		err = json.Unmarshal([]byte(node.Value), &state)
 		if err != nil {
 			return nil, err
 		}
 
-		sections := strings.Split(node.Key, "/")
-		nodeKey := sections[len(sections)-1]
-		values[nodeKey] = state
+		values[nodeKey(node.Key)] = state
 	}
 
 	return values, nil
@@ -206,7 +499,7 @@ func SetClusterAnnouncement(base string, state NodeState) error {
 	if err != nil {
 		return err
 	}
-	if _, err := client.Set(path, string(bytes), TTL); err != nil {
+	if _, err := store.Set(path, string(bytes), TTL); err != nil {
 		return err
 	}
 
@@ -214,21 +507,59 @@ func SetClusterAnnouncement(base string, state NodeState) error {
 }
 
 type NodeState struct {
-	IPAddress    string `json:"ipAddress"`
-	SessionID    string `json:"sessionID"`
-	Master       bool   `json:"master"`
-	State        string `json:"state"`
-	DesiredState string `json:"desiredState"`
-	TTL          int64  `json:"ttl"`
+	IPAddress    string         `json:"ipAddress"`
+	SessionID    string         `json:"sessionID"`
+	Services     []string       `json:"services,omitempty"`
+	Zone         string         `json:"zone,omitempty"`
+	Master       bool           `json:"master"`
+	State        SchedulerState `json:"state"`
+	DesiredState SchedulerState `json:"desiredState"`
+	TTL          int64          `json:"ttl"`
+
+	// RebalanceProgress is the percentage of the running rebalance completed on the node
+	RebalanceProgress float64 `json:"rebalanceProgress,omitempty"`
+	// Error is why the scheduler could not move the node, empty when it is healthy
+	Error string `json:"error,omitempty"`
+	// Failover is how the scheduler decided to fail the node over once its announcement expired
+	Failover string `json:"failover,omitempty"`
+	// Recovery is whether the scheduler recovers the failed over node with delta or full recovery
+	Recovery string `json:"recovery,omitempty"`
+	// DataIntact is announced by nodes which kept the data of an earlier membership of the cluster
+	DataIntact bool `json:"dataIntact,omitempty"`
+	// Maintenance is set while the node is cordoned and held out of the cluster
+	Maintenance bool `json:"maintenance,omitempty"`
+
+	// ModifiedIndex is the store index the state was read at, used to detect concurrent writes
+	ModifiedIndex uint64 `json:"-"`
 }
 
 func (n NodeState) String() string {
-	return fmt.Sprintf("IP:%s, ID:%s, IsMaster:%v, State:%s, DesiredState:%s",
+	description := fmt.Sprintf("IP:%s, ID:%s, Services:%v, IsMaster:%v, State:%s, DesiredState:%s",
 		n.IPAddress,
 		n.SessionID,
+		n.ServiceList(),
 		n.Master,
 		n.State,
 		n.DesiredState)
+	if n.Maintenance {
+		description += ", Maintenance"
+	}
+
+	if n.Error != "" {
+		description += ", Error:" + n.Error
+	}
+
+	return description
+}
+
+// NewStoreFromEnvironment creates the Store selected by the ETCDCTL_* environment variables.
+// ETCDCTL_API=3 selects the etcd v3 backend, otherwise the etcd v2 keys API is used.
+func NewStoreFromEnvironment() Store {
+	if os.Getenv("ETCDCTL_API") == "3" {
+		return NewEtcdV3Store(etcdV3Endpoints(), etcdV3HTTPClient())
+	}
+
+	return NewEtcdStore(NewEtcdClient())
 }
 
 var etcdClient *etcd.Client
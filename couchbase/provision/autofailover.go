@@ -0,0 +1,109 @@
+package provision
+
+import (
+	"context"
+	"log"
+
+	couchbasearray "github.com/andrewwebber/couchbase-array"
+	"github.com/andrewwebber/couchbase-array/couchbase/rest"
+)
+
+// AutoFailoverPolicy is how the cluster fails over unresponsive nodes by itself
+type AutoFailoverPolicy struct {
+	Enabled bool `json:"enabled"`
+	// Timeout is how many seconds a node is unresponsive before it is failed over
+	Timeout int `json:"timeout"`
+	// MaxCount is how many nodes are failed over before the quota is reset
+	MaxCount int `json:"maxCount"`
+	// ServerGroup fails over a whole unresponsive server group
+	ServerGroup bool `json:"serverGroup"`
+	// DataDiskIssues fails over a node whose data disk has failed for DataDiskTimePeriod seconds
+	DataDiskIssues     bool `json:"dataDiskIssues"`
+	DataDiskTimePeriod int  `json:"dataDiskTimePeriod"`
+}
+
+func (p AutoFailoverPolicy) settings() rest.AutoFailoverSettings {
+	settings := rest.AutoFailoverSettings{
+		Enabled:             p.Enabled,
+		Timeout:             p.Timeout,
+		MaxCount:            p.MaxCount,
+		FailoverServerGroup: p.ServerGroup,
+	}
+	settings.FailoverOnDataDiskIssues.Enabled = p.DataDiskIssues
+	settings.FailoverOnDataDiskIssues.TimePeriod = p.DataDiskTimePeriod
+	return settings
+}
+
+// matches reports whether the cluster already has the settings of the policy
+func (p AutoFailoverPolicy) matches(settings *rest.AutoFailoverSettings) bool {
+	if !p.Enabled || !settings.Enabled {
+		return p.Enabled == settings.Enabled
+	}
+
+	return settings.Timeout == p.Timeout &&
+		settings.MaxCount == p.MaxCount &&
+		settings.FailoverServerGroup == p.ServerGroup &&
+		settings.FailoverOnDataDiskIssues.Enabled == p.DataDiskIssues &&
+		(!p.DataDiskIssues || settings.FailoverOnDataDiskIssues.TimePeriod == p.DataDiskTimePeriod)
+}
+
+// AutoFailoverReconciler keeps the automatic failover settings of the cluster on Policy.
+// Once the nodes which were failed over automatically have been replaced, the failover
+// quota is reset so the cluster can fail over again.
+type AutoFailoverReconciler struct {
+	Client func(nodeIP string) *rest.Client
+	Policy AutoFailoverPolicy
+}
+
+// Reconcile converges the automatic failover settings through the master node
+func (r AutoFailoverReconciler) Reconcile(ctx context.Context, master couchbasearray.NodeState, states map[string]couchbasearray.NodeState) ([]couchbasearray.Transition, error) {
+	client := r.Client(master.IPAddress).WithContext(ctx)
+	settings, err := client.AutoFailover()
+	if err != nil {
+		return nil, err
+	}
+
+	if !r.Policy.matches(settings) {
+		log.Printf("Setting auto failover %+v\n", r.Policy)
+		if err = client.UpdateAutoFailover(r.Policy.settings()); err != nil {
+			return nil, err
+		}
+	}
+
+	if settings.Count == 0 {
+		return nil, nil
+	}
+
+	replaced, err := failedNodesReplaced(client, states)
+	if err != nil || !replaced {
+		return nil, err
+	}
+
+	log.Printf("Resetting the auto failover count of %d\n", settings.Count)
+	return nil, client.ResetAutoFailoverCount()
+}
+
+// failedNodesReplaced reports whether no node is failed over and every announced node has
+// been rebalanced into the cluster
+func failedNodesReplaced(client *rest.Client, states map[string]couchbasearray.NodeState) (bool, error) {
+	for _, state := range states {
+		switch state.State {
+		case couchbasearray.SchedulerStateClustered, couchbasearray.SchedulerStateRelax, couchbasearray.SchedulerStateDeleted:
+		default:
+			return false, nil
+		}
+	}
+
+	pool, err := client.Pool()
+	if err != nil {
+		return false, err
+	}
+
+	for _, node := range pool.Nodes {
+		if node.ClusterMembership != "active" {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,54 @@
+package provision
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	couchbasearray "github.com/andrewwebber/couchbase-array"
+	"github.com/andrewwebber/couchbase-array/couchbase/rest"
+)
+
+func TestAutoFailoverReconciler(t *testing.T) {
+	fake := &fakeCluster{nodes: []rest.Node{
+		{OTPNode: "ns_1@10.0.0.1", Hostname: "10.0.0.1:8091", ClusterMembership: "active"},
+		{OTPNode: "ns_1@10.0.0.2", Hostname: "10.0.0.2:8091", ClusterMembership: "inactiveFailed"},
+	}}
+	fake.autoFailover.Count = 1
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	reconciler := AutoFailoverReconciler{
+		Client: func(string) *rest.Client { return rest.NewClient(server.URL, "Administrator", "password") },
+		Policy: AutoFailoverPolicy{Enabled: true, Timeout: 31, MaxCount: 2, ServerGroup: true, DataDiskIssues: true, DataDiskTimePeriod: 60},
+	}
+
+	states := map[string]couchbasearray.NodeState{
+		"a": {IPAddress: "10.0.0.1", SessionID: "a", Master: true, State: couchbasearray.SchedulerStateClustered},
+		"c": {IPAddress: "10.0.0.3", SessionID: "c", State: couchbasearray.SchedulerStateAdding},
+	}
+
+	reconcile := func() {
+		if _, err := reconciler.Reconcile(context.Background(), states["a"], states); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reconcile()
+	reconcile()
+	if fake.count("POST /settings/autoFailover") != 1 || fake.autoFailover.Timeout != 31 || !fake.autoFailover.FailoverServerGroup || fake.autoFailover.FailoverOnDataDiskIssues.TimePeriod != 60 {
+		t.Fatalf("Expected the policy to be applied once got %v %+v", fake.calls, fake.autoFailover)
+	}
+
+	if fake.count("POST /settings/autoFailover/resetCount") != 0 {
+		t.Fatal("Expected the count to be kept until the failed node is replaced")
+	}
+
+	fake.nodes = fake.nodes[:1]
+	fake.nodes = append(fake.nodes, rest.Node{OTPNode: "ns_1@10.0.0.3", Hostname: "10.0.0.3:8091", ClusterMembership: "active"})
+	states["c"] = couchbasearray.NodeState{IPAddress: "10.0.0.3", SessionID: "c", State: couchbasearray.SchedulerStateClustered}
+	reconcile()
+	if fake.count("POST /settings/autoFailover/resetCount") != 1 || fake.autoFailover.Count != 0 {
+		t.Fatalf("Expected the count to be reset once the node was replaced got %v", fake.calls)
+	}
+}
@@ -0,0 +1,194 @@
+package provision
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	couchbasearray "github.com/andrewwebber/couchbase-array"
+	"github.com/andrewwebber/couchbase-array/couchbase/rest"
+)
+
+// ErrNoBucketSpec is returned by a BucketSource which has no buckets declared, including
+// an empty or null array. Existing buckets are left alone rather than deleted.
+var ErrNoBucketSpec = errors.New("no bucket spec declared")
+
+// BucketSpec declares a bucket. Type is couchbase, ephemeral or memcached.
+type BucketSpec struct {
+	Name               string `json:"name"`
+	Type               string `json:"type"`
+	RAMQuotaMB         int    `json:"ramQuotaMB"`
+	Replicas           int    `json:"replicas"`
+	EvictionPolicy     string `json:"evictionPolicy"`
+	Flush              bool   `json:"flush"`
+	DurabilityMinLevel string `json:"durabilityMinLevel"`
+}
+
+func (s BucketSpec) bucketType() string {
+	if s.Type == "" {
+		return "couchbase"
+	}
+
+	return s.Type
+}
+
+func (s BucketSpec) settings() rest.BucketSettings {
+	return rest.BucketSettings{
+		Name:               s.Name,
+		BucketType:         s.bucketType(),
+		RAMQuotaMB:         s.RAMQuotaMB,
+		ReplicaNumber:      s.Replicas,
+		EvictionPolicy:     s.EvictionPolicy,
+		FlushEnabled:       s.Flush,
+		DurabilityMinLevel: s.DurabilityMinLevel,
+	}
+}
+
+// matches reports whether bucket already has the declared settings
+func (s BucketSpec) matches(bucket rest.Bucket) bool {
+	if bucket.RAMQuotaMB() != s.RAMQuotaMB || bucket.FlushEnabled() != s.Flush {
+		return false
+	}
+
+	if s.bucketType() == "memcached" {
+		return true
+	}
+
+	return bucket.ReplicaNumber == s.Replicas &&
+		(s.EvictionPolicy == "" || bucket.EvictionPolicy == s.EvictionPolicy) &&
+		(s.DurabilityMinLevel == "" || bucket.DurabilityMinLevel == s.DurabilityMinLevel)
+}
+
+// BucketSource supplies the declared buckets
+type BucketSource interface {
+	BucketSpecs() ([]BucketSpec, error)
+}
+
+// FileBuckets reads a JSON array of bucket specs from a file
+type FileBuckets struct {
+	Path string
+}
+
+// BucketSpecs reads the file, returning ErrNoBucketSpec if it declares no buckets
+func (f FileBuckets) BucketSpecs() ([]BucketSpec, error) {
+	contents, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseBucketSpecs(contents)
+}
+
+// StoreBuckets reads a JSON array of bucket specs from a key in the store
+type StoreBuckets struct {
+	Key string
+}
+
+// BucketSpecs reads the key, returning ErrNoBucketSpec if it does not exist or declares no buckets
+func (s StoreBuckets) BucketSpecs() ([]BucketSpec, error) {
+	node, err := couchbasearray.GetStore().Get(s.Key)
+	if err == couchbasearray.ErrKeyNotFound {
+		return nil, ErrNoBucketSpec
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseBucketSpecs([]byte(node.Value))
+}
+
+// parseBucketSpecs parses a JSON array of bucket specs, returning ErrNoBucketSpec when
+// it is empty so a truncated or cleared spec never reads as "delete every bucket"
+func parseBucketSpecs(data []byte) ([]BucketSpec, error) {
+	var specs []BucketSpec
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, err
+	}
+
+	if len(specs) == 0 {
+		return nil, ErrNoBucketSpec
+	}
+
+	return specs, nil
+}
+
+// ReconcileBuckets creates declared buckets which are missing and updates those whose
+// settings differ. Buckets which are not declared are deleted when deleteUndeclared is set
+// and at least one bucket is declared.
+func ReconcileBuckets(client *rest.Client, specs []BucketSpec, deleteUndeclared bool) error {
+	buckets, err := client.Buckets()
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]rest.Bucket)
+	for _, bucket := range buckets {
+		existing[bucket.Name] = bucket
+	}
+
+	declared := make(map[string]bool)
+	for _, spec := range specs {
+		declared[spec.Name] = true
+		bucket, ok := existing[spec.Name]
+		switch {
+		case !ok:
+			log.Printf("Creating bucket %s\n", spec.Name)
+			err = client.CreateBucket(spec.settings())
+		case bucket.Type() != spec.bucketType():
+			err = fmt.Errorf("bucket %s is %s and cannot be changed to %s", spec.Name, bucket.Type(), spec.bucketType())
+		case !spec.matches(bucket):
+			log.Printf("Updating bucket %s\n", spec.Name)
+			err = client.UpdateBucket(spec.settings())
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if !deleteUndeclared {
+		return nil
+	}
+
+	if len(specs) == 0 {
+		log.Println("Not deleting undeclared buckets as no buckets are declared")
+		return nil
+	}
+
+	for name := range existing {
+		if !declared[name] {
+			log.Printf("Deleting bucket %s\n", name)
+			if err = client.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// BucketReconciler converges the buckets of the cluster on the declared buckets once the
+// master has initialized the cluster
+type BucketReconciler struct {
+	Source BucketSource
+	Client func(nodeIP string) *rest.Client
+	Delete bool
+}
+
+// Reconcile converges the buckets through the master node
+func (r BucketReconciler) Reconcile(ctx context.Context, master couchbasearray.NodeState, states map[string]couchbasearray.NodeState) ([]couchbasearray.Transition, error) {
+	specs, err := r.Source.BucketSpecs()
+	if err == ErrNoBucketSpec {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, ReconcileBuckets(r.Client(master.IPAddress).WithContext(ctx), specs, r.Delete)
+}
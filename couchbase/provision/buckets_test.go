@@ -0,0 +1,72 @@
+package provision
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andrewwebber/couchbase-array/couchbase/rest"
+)
+
+func TestReconcileBuckets(t *testing.T) {
+	fake := &fakeCluster{buckets: []rest.Bucket{{Name: "legacy", BucketType: "memcached"}}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	client := rest.NewClient(server.URL, "Administrator", "password")
+	specs := []BucketSpec{
+		{Name: "default", RAMQuotaMB: 256, Replicas: 1, EvictionPolicy: "valueOnly"},
+		{Name: "sessions", Type: "ephemeral", RAMQuotaMB: 128, Flush: true},
+	}
+
+	if err := ReconcileBuckets(client, specs, false); err != nil {
+		t.Fatal(err)
+	}
+
+	created, _ := fake.bucket("default")
+	sessions, _ := fake.bucket("sessions")
+	if len(fake.calls) != 2 || created.Type() != "couchbase" || !sessions.FlushEnabled() {
+		t.Fatalf("Expected both buckets to be created got %v %v", fake.calls, fake.buckets)
+	}
+
+	if err := ReconcileBuckets(client, specs, false); err != nil || len(fake.calls) != 2 {
+		t.Fatalf("Expected converged buckets to be left alone got %v %v", fake.calls, err)
+	}
+
+	specs[0].RAMQuotaMB = 512
+	if err := ReconcileBuckets(client, specs, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if updated, _ := fake.bucket("default"); fake.calls[2] != "POST /pools/default/buckets/default" || updated.RAMQuotaMB() != 512 {
+		t.Fatalf("Expected default to be updated got %v", fake.calls)
+	}
+
+	if _, ok := fake.bucket("legacy"); ok {
+		t.Fatal("Expected the undeclared bucket to be deleted")
+	}
+
+	specs[1].Type = "couchbase"
+	if err := ReconcileBuckets(client, specs, false); err == nil {
+		t.Fatal("Expected changing the bucket type to fail")
+	}
+
+	if err := ReconcileBuckets(client, nil, true); err != nil || len(fake.buckets) != 2 {
+		t.Fatalf("Expected no declared buckets to delete nothing got %v %v", fake.buckets, err)
+	}
+}
+
+func TestParseBucketSpecs(t *testing.T) {
+	for _, spec := range []string{`[]`, `null`} {
+		if _, err := parseBucketSpecs([]byte(spec)); err != ErrNoBucketSpec {
+			t.Fatalf("Expected %s to be no spec got %v", spec, err)
+		}
+	}
+
+	if _, err := parseBucketSpecs([]byte(`[{"name": "default"`)); err == nil || err == ErrNoBucketSpec {
+		t.Fatalf("Expected a truncated spec to fail got %v", err)
+	}
+
+	if specs, err := parseBucketSpecs([]byte(`[{"name": "default"}]`)); err != nil || len(specs) != 1 {
+		t.Fatalf("Expected a single spec got %v %v", specs, err)
+	}
+}
@@ -0,0 +1,136 @@
+package provision
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	couchbasearray "github.com/andrewwebber/couchbase-array"
+	"github.com/andrewwebber/couchbase-array/couchbase/rest"
+)
+
+const (
+	// FailoverGraceful moves the active data off a healthy node before failing it over
+	FailoverGraceful = "graceful"
+	// FailoverHard fails over an unhealthy node straight away, promoting its replicas
+	FailoverHard = "hard"
+	// FailoverNone leaves the node in the cluster
+	FailoverNone = "none"
+)
+
+// FailoverReconciler fails over cluster nodes whose announcement expired but which are
+// still active. Healthy nodes are failed over gracefully and unhealthy nodes hard, as
+// long as the safety checks find replicas left to take over their data; otherwise the
+// node is left for the rebalance coordinator to eject. The decision is recorded on the
+// state of the node and in its history.
+type FailoverReconciler struct {
+	Client   func(nodeIP string) *rest.Client
+	Override bool
+	// Path is the service path whose placement policy minimums failovers keep
+	Path string
+
+	// held is why each node which has gone was left in the cluster, recorded once
+	held map[string]string
+}
+
+// Reconcile fails over at most one node through the master node
+func (r *FailoverReconciler) Reconcile(ctx context.Context, master couchbasearray.NodeState, states map[string]couchbasearray.NodeState) ([]couchbasearray.Transition, error) {
+	client := r.Client(master.IPAddress).WithContext(ctx)
+	task, err := client.RebalanceTask()
+	if err != nil || task.Running() {
+		return nil, err
+	}
+
+	pool, err := client.Pool()
+	if err != nil {
+		return nil, err
+	}
+
+	if r.held == nil {
+		r.held = make(map[string]string)
+	}
+
+	live := liveNodes(pool.Nodes, states)
+	var transitions []couchbasearray.Transition
+	held := make(map[string]bool)
+	for _, node := range pool.Nodes {
+		if node.ClusterMembership != "active" || node.ThisNode || live[node.OTPNode] {
+			continue
+		}
+
+		decision, reason := decideFailover(node)
+		err = SafetyChecks{Client: client, Override: r.Override, Path: r.Path}.CheckFailover(node)
+		if IsTransient(err) {
+			log.Println(err)
+			return transitions, nil
+		}
+
+		if unsafe, ok := err.(*UnsafeError); ok {
+			decision, reason = FailoverNone, unsafe.Reason
+		} else if err != nil {
+			return transitions, err
+		}
+
+		if decision == FailoverNone {
+			held[node.OTPNode] = true
+			if r.held[node.OTPNode] != reason {
+				r.held[node.OTPNode] = reason
+				log.Printf("Not failing over %s: %s\n", node.OTPNode, reason)
+				transitions = append(transitions, recordFailover(states, node, decision, reason))
+			}
+			continue
+		}
+
+		log.Printf("%s failover of %s: %s\n", decision, node.OTPNode, reason)
+		if decision == FailoverGraceful {
+			err = client.StartGracefulFailover(node.OTPNode)
+		} else {
+			err = client.Failover(node.OTPNode)
+		}
+
+		if err != nil {
+			reason = fmt.Sprintf("%s, failed: %v", reason, err)
+		}
+
+		delete(r.held, node.OTPNode)
+		return append(transitions, recordFailover(states, node, decision, reason)), err
+	}
+
+	for otpNode := range r.held {
+		if !held[otpNode] {
+			delete(r.held, otpNode)
+		}
+	}
+
+	return transitions, nil
+}
+
+// decideFailover decides how to fail over node, which has gone from the cluster
+func decideFailover(node rest.Node) (string, string) {
+	if node.Status == "healthy" {
+		return FailoverGraceful, "node is healthy"
+	}
+
+	return FailoverHard, fmt.Sprintf("node is %s", node.Status)
+}
+
+// recordFailover records the decision on the state of node, returning its transition
+func recordFailover(states map[string]couchbasearray.NodeState, node rest.Node, decision string, reason string) couchbasearray.Transition {
+	for key, state := range states {
+		if _, ok := rest.FindNode([]rest.Node{node}, state.IPAddress); ok {
+			previous := state
+			state.Failover = decision
+			states[key] = state
+			return couchbasearray.NewTransition(previous, state, fmt.Sprintf("%s failover: %s", decision, reason))
+		}
+	}
+
+	// the state of the node has already been dropped
+	state := couchbasearray.NodeState{
+		IPAddress:    node.Host(),
+		State:        couchbasearray.SchedulerStateDeleted,
+		DesiredState: couchbasearray.SchedulerStateDeleted,
+		Failover:     decision,
+	}
+	return couchbasearray.NewTransition(state, state, fmt.Sprintf("%s failover: %s", decision, reason))
+}
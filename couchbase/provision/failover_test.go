@@ -0,0 +1,110 @@
+package provision
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	couchbasearray "github.com/andrewwebber/couchbase-array"
+	"github.com/andrewwebber/couchbase-array/couchbase/rest"
+)
+
+func TestFailoverReconciler(t *testing.T) {
+	fake := &fakeCluster{
+		buckets: []rest.Bucket{{Name: "default", BucketType: "membase", ReplicaNumber: 1,
+			VBucketServerMap: rest.VBucketServerMap{
+				ServerList: []string{"10.0.0.1:11210", "10.0.0.2:11210", "10.0.0.3:11210"},
+				VBucketMap: [][]int{{0, 1}, {1, 2}, {2, 0}},
+			}}},
+		nodes: []rest.Node{
+			{OTPNode: "ns_1@10.0.0.1", Hostname: "10.0.0.1:8091", ClusterMembership: "active", Status: "healthy"},
+			{OTPNode: "ns_1@10.0.0.2", Hostname: "10.0.0.2:8091", ClusterMembership: "active", Status: "unhealthy"},
+			{OTPNode: "ns_1@10.0.0.3", Hostname: "10.0.0.3:8091", ClusterMembership: "active", Status: "healthy"},
+		}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	reconciler := &FailoverReconciler{Client: func(string) *rest.Client {
+		return rest.NewClient(server.URL, "Administrator", "password")
+	}}
+
+	states := map[string]couchbasearray.NodeState{
+		"a": {IPAddress: "10.0.0.1", SessionID: "a", Master: true, State: couchbasearray.SchedulerStateClustered},
+		"b": {IPAddress: "10.0.0.2", SessionID: "b", State: couchbasearray.SchedulerStateDeleted},
+	}
+
+	transitions, err := reconciler.Reconcile(context.Background(), states["a"], states)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.failovers) != 1 || fake.failovers[0] != "/controller/failOver ns_1@10.0.0.2" {
+		t.Fatalf("Expected the unhealthy node to be hard failed over got %v", fake.failovers)
+	}
+
+	if states["b"].Failover != FailoverHard || len(transitions) != 1 || transitions[0].SessionID != "b" {
+		t.Fatalf("Expected the decision to be recorded got %v %v", states["b"], transitions)
+	}
+
+	// the vBuckets promoted to the healthy node have no replica left to take over
+	if transitions, err = reconciler.Reconcile(context.Background(), states["a"], states); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.failovers) != 1 || len(transitions) != 1 || transitions[0].IPAddress != "10.0.0.3" {
+		t.Fatalf("Expected the healthy node to be held got %v %v", fake.failovers, transitions)
+	}
+
+	if transitions, err = reconciler.Reconcile(context.Background(), states["a"], states); err != nil || len(transitions) != 0 {
+		t.Fatalf("Expected the held node to be recorded once got %v %v", transitions, err)
+	}
+
+	fake.buckets[0].VBucketServerMap.VBucketMap = [][]int{{0, 2}, {2, 0}}
+	if _, err = reconciler.Reconcile(context.Background(), states["a"], states); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.failovers) != 2 || fake.failovers[1] != "/controller/startGracefulFailover ns_1@10.0.0.3" {
+		t.Fatalf("Expected the healthy node to be gracefully failed over got %v", fake.failovers)
+	}
+}
+
+func TestFailoverReconcilerHostNames(t *testing.T) {
+	// a lone master is known by its loopback address and StatefulSet pods by their fully
+	// qualified names, which differ from the names they announced
+	fake := &fakeCluster{
+		buckets: []rest.Bucket{{Name: "default", BucketType: "membase", ReplicaNumber: 1,
+			VBucketServerMap: rest.VBucketServerMap{
+				ServerList: []string{"127.0.0.1:11210", "couchbase-1.couchbase.default.svc:11210", "couchbase-2.couchbase.default.svc:11210"},
+				VBucketMap: [][]int{{0, 1}, {1, 2}, {2, 0}},
+			}}},
+		nodes: []rest.Node{
+			{OTPNode: "ns_1@127.0.0.1", Hostname: "127.0.0.1:8091", ClusterMembership: "active", Status: "healthy", ThisNode: true},
+			{OTPNode: "ns_1@couchbase-1.couchbase.default.svc", Hostname: "couchbase-1.couchbase.default.svc:8091", ClusterMembership: "active", Status: "healthy"},
+			{OTPNode: "ns_1@couchbase-2.couchbase.default.svc", Hostname: "couchbase-2.couchbase.default.svc:8091", ClusterMembership: "active", Status: "unhealthy"},
+		}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	reconciler := &FailoverReconciler{Client: func(string) *rest.Client {
+		return rest.NewClient(server.URL, "Administrator", "password")
+	}}
+
+	states := map[string]couchbasearray.NodeState{
+		"a": {IPAddress: "couchbase-0", SessionID: "a", Master: true, State: couchbasearray.SchedulerStateClustered},
+		"b": {IPAddress: "couchbase-1", SessionID: "b", State: couchbasearray.SchedulerStateClustered},
+		"c": {IPAddress: "couchbase-2", SessionID: "c", State: couchbasearray.SchedulerStateDeleted},
+	}
+
+	if _, err := reconciler.Reconcile(context.Background(), states["a"], states); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.failovers) != 1 || fake.failovers[0] != "/controller/failOver ns_1@couchbase-2.couchbase.default.svc" {
+		t.Fatalf("Expected only the node which has gone to be failed over got %v", fake.failovers)
+	}
+
+	if states["c"].Failover != FailoverHard {
+		t.Fatalf("Expected the decision to be recorded got %v", states["c"])
+	}
+}
@@ -0,0 +1,107 @@
+package provision
+
+import (
+	"context"
+	"log"
+	"sort"
+
+	couchbasearray "github.com/andrewwebber/couchbase-array"
+	"github.com/andrewwebber/couchbase-array/couchbase/rest"
+)
+
+// ReconcileServerGroups creates a server group for every zone and moves cluster members
+// into the group of their zone. zones maps the host of a node to its zone; nodes without
+// a zone are left in the group they are in.
+func ReconcileServerGroups(client *rest.Client, zones map[string]string) error {
+	groups, err := client.ServerGroups()
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, zone := range zones {
+		if _, ok := groups.Group(zone); !ok {
+			missing = append(missing, zone)
+			groups.Groups = append(groups.Groups, rest.ServerGroup{Name: zone})
+		}
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		for _, zone := range missing {
+			log.Printf("Creating server group %s\n", zone)
+			if err = client.CreateServerGroup(zone); err != nil {
+				return err
+			}
+		}
+
+		if groups, err = client.ServerGroups(); err != nil {
+			return err
+		}
+	}
+
+	// zones are announced by host, which Couchbase may know by another form of the name
+	var nodes []rest.Node
+	for _, group := range groups.Groups {
+		nodes = append(nodes, group.Nodes...)
+	}
+
+	placement := make(map[string]string)
+	for host, zone := range zones {
+		if node, ok := rest.FindNode(nodes, host); ok {
+			placement[node.OTPNode] = zone
+		}
+	}
+
+	var misplaced []rest.Node
+	for i := range groups.Groups {
+		group := &groups.Groups[i]
+		var members []rest.Node
+		for _, node := range group.Nodes {
+			if zone, ok := placement[node.OTPNode]; ok && zone != group.Name {
+				misplaced = append(misplaced, node)
+			} else {
+				members = append(members, node)
+			}
+		}
+		group.Nodes = members
+	}
+
+	if len(misplaced) == 0 {
+		return nil
+	}
+
+	for _, node := range misplaced {
+		group, ok := groups.Group(placement[node.OTPNode])
+		if !ok {
+			return rest.ErrGroupNotFound
+		}
+
+		log.Printf("Moving %s to server group %s\n", node.OTPNode, group.Name)
+		group.Nodes = append(group.Nodes, node)
+	}
+
+	return client.UpdateServerGroups(groups)
+}
+
+// ServerGroupReconciler places the nodes of the cluster into the server group of the zone
+// they announced once the master has initialized the cluster
+type ServerGroupReconciler struct {
+	Client func(nodeIP string) *rest.Client
+}
+
+// Reconcile places the nodes through the master node
+func (r ServerGroupReconciler) Reconcile(ctx context.Context, master couchbasearray.NodeState, states map[string]couchbasearray.NodeState) ([]couchbasearray.Transition, error) {
+	zones := make(map[string]string)
+	for _, state := range states {
+		if state.Zone != "" && state.State != couchbasearray.SchedulerStateDeleted {
+			zones[state.IPAddress] = state.Zone
+		}
+	}
+
+	if len(zones) == 0 {
+		return nil, nil
+	}
+
+	return nil, ReconcileServerGroups(r.Client(master.IPAddress).WithContext(ctx), zones)
+}
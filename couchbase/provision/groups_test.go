@@ -0,0 +1,43 @@
+package provision
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andrewwebber/couchbase-array/couchbase/rest"
+)
+
+func TestReconcileServerGroups(t *testing.T) {
+	fake := &fakeCluster{groups: rest.ServerGroups{Groups: []rest.ServerGroup{{
+		Name: "Group 1",
+		URI:  "/pools/default/serverGroups/0",
+		Nodes: []rest.Node{
+			{OTPNode: "ns_1@10.0.0.1", Hostname: "10.0.0.1:8091"},
+			{OTPNode: "ns_1@couchbase-2.couchbase.default.svc", Hostname: "couchbase-2.couchbase.default.svc:8091"},
+			{OTPNode: "ns_1@10.0.0.3", Hostname: "10.0.0.3:8091"},
+		}}}}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	client := rest.NewClient(server.URL, "Administrator", "password")
+	// Couchbase knows the second node by the fully qualified form of its announced name
+	zones := map[string]string{"10.0.0.1": "zone-a", "couchbase-2": "zone-b"}
+	if err := ReconcileServerGroups(client, zones); err != nil {
+		t.Fatal(err)
+	}
+
+	for host, zone := range zones {
+		group, ok := fake.groups.Group(zone)
+		if _, found := rest.FindNode(group.Nodes, host); !ok || len(group.Nodes) != 1 || !found {
+			t.Fatalf("Expected %s in %s got %v", host, zone, fake.groups.Groups)
+		}
+	}
+
+	if group, _ := fake.groups.Group("Group 1"); len(group.Nodes) != 1 || group.Nodes[0].Host() != "10.0.0.3" {
+		t.Fatalf("Expected the node without a zone to stay in its group got %v", group)
+	}
+
+	if err := ReconcileServerGroups(client, zones); err != nil || fake.count("PUT /pools/default/serverGroups") != 1 {
+		t.Fatalf("Expected placed nodes to be left alone got %v %v", fake.calls, err)
+	}
+}
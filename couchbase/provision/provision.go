@@ -0,0 +1,130 @@
+// Package provision declaratively configures Couchbase clusters through the REST API
+package provision
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"github.com/andrewwebber/couchbase-array/couchbase/rest"
+)
+
+// Config describes how a cluster is provisioned. Memory quotas are in megabytes.
+type Config struct {
+	ClusterName      string   `json:"clusterName"`
+	Services         []string `json:"services"`
+	DataPath         string   `json:"dataPath"`
+	IndexPath        string   `json:"indexPath"`
+	MemoryQuota      int      `json:"memoryQuota"`
+	IndexMemoryQuota int      `json:"indexMemoryQuota"`
+	FTSMemoryQuota   int      `json:"ftsMemoryQuota"`
+	IndexStorageMode string   `json:"indexStorageMode"`
+}
+
+// DefaultConfig runs the data, index and query services with small quotas
+func DefaultConfig() Config {
+	return Config{
+		Services:         []string{"kv", "index", "n1ql"},
+		MemoryQuota:      512,
+		IndexMemoryQuota: 256,
+		IndexStorageMode: "plasma",
+	}
+}
+
+// LoadConfig reads a JSON config from path over the DefaultConfig
+func LoadConfig(path string) (Config, error) {
+	config := DefaultConfig()
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	err = json.Unmarshal(contents, &config)
+	return config, err
+}
+
+// HasService reports whether the config runs service
+func (c Config) HasService(service string) bool {
+	for _, s := range c.Services {
+		if s == service {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClusterMembersError is returned by InitializeNode when other nodes are already members
+// of the cluster, as provisioning a blank node would start a second cluster
+type ClusterMembersError struct {
+	Members []string
+}
+
+func (e *ClusterMembersError) Error() string {
+	return fmt.Sprintf("refusing to initialize a new cluster while %v are cluster members", e.Members)
+}
+
+// InitializeNode provisions the node behind client as the first node of a cluster unless
+// it is already initialized, renaming it to host, the name it announced, and finally
+// securing it with credentials. It reports whether the node was initialized and refuses
+// to provision while members, the other nodes known to have joined the cluster, is not
+// empty. A node whose services were set up by an earlier attempt which failed later on
+// is provisioned from where the attempt stopped.
+func InitializeNode(client *rest.Client, config Config, credentials rest.Credentials, host string, members []string) (bool, error) {
+	initialized, err := client.Initialized()
+	if err != nil || initialized {
+		return false, err
+	}
+
+	if len(members) > 0 {
+		return false, &ClusterMembersError{Members: members}
+	}
+
+	services, err := client.NodeServices()
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("Initializing cluster on %s with services %v\n", client.BaseURL, config.Services)
+	if len(services) > 0 {
+		// node paths and services can only be set once
+		log.Printf("Services %v are already set up, resuming\n", services)
+	} else {
+		if config.DataPath != "" || config.IndexPath != "" {
+			if err = client.SetNodePaths(config.DataPath, config.IndexPath); err != nil {
+				return false, err
+			}
+		}
+
+		if err = client.SetupServices(config.Services); err != nil {
+			return false, err
+		}
+	}
+
+	err = client.SetPoolSettings(rest.PoolSettings{
+		ClusterName:      config.ClusterName,
+		MemoryQuota:      config.MemoryQuota,
+		IndexMemoryQuota: config.IndexMemoryQuota,
+		FTSMemoryQuota:   config.FTSMemoryQuota})
+	if err != nil {
+		return false, err
+	}
+
+	if config.IndexStorageMode != "" && config.HasService("index") {
+		if err = client.SetIndexStorageMode(config.IndexStorageMode); err != nil {
+			return false, err
+		}
+	}
+
+	// otherwise a lone node is known by its loopback address
+	if err = client.RenameNode(host); err != nil {
+		return false, err
+	}
+
+	if err = client.SetWebSettings(credentials); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,358 @@
+package provision
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/andrewwebber/couchbase-array/couchbase/rest"
+)
+
+// fakeCluster is a minimal Couchbase cluster which records the requests changing it and
+// keeps the settings posted to it. Like Couchbase it rejects services being set up twice,
+// and fails the pool settings while failPool is set. A started rebalance reports its
+// progress once and then completes, or fails with failure. The tasks are served verbatim
+// when set.
+type fakeCluster struct {
+	mutex        sync.Mutex
+	nodes        []rest.Node
+	buckets      []rest.Bucket
+	groups       rest.ServerGroups
+	revision     int
+	autoFailover rest.AutoFailoverSettings
+	settings     map[string]string
+	tasks        string
+	failPool     bool
+	running      bool
+	ejected      string
+	failure      string
+	lastError    string
+	calls        []string
+	rebalances   []string
+	failovers    []string
+}
+
+func (f *fakeCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.settings == nil {
+		f.settings = make(map[string]string)
+	}
+
+	if (r.URL.Path == "/node/controller/setupServices" && f.settings["services"] != "") || (r.Method == "POST" && r.URL.Path == "/pools/default" && f.failPool) {
+		http.Error(w, "rejected", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method != "GET" {
+		r.ParseForm()
+		f.calls = append(f.calls, r.Method+" "+r.URL.Path)
+	}
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/pools":
+		pools := []map[string]string{}
+		if f.settings["username"] != "" {
+			pools = append(pools, map[string]string{"name": "default"})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"pools": pools})
+	case r.Method == "GET" && r.URL.Path == "/nodes/self":
+		var services []string
+		if f.settings["services"] != "" {
+			services = strings.Split(f.settings["services"], ",")
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"services": services})
+	case r.Method == "GET" && r.URL.Path == "/pools/default":
+		json.NewEncoder(w).Encode(rest.Pool{Name: "default", Nodes: f.nodes})
+	case r.URL.Path == "/pools/default/tasks":
+		f.serveTasks(w)
+	case strings.HasPrefix(r.URL.Path, "/pools/default/buckets"):
+		f.serveBuckets(w, r)
+	case r.URL.Path == "/pools/default/serverGroups":
+		f.serveServerGroups(w, r)
+	case r.URL.Path == "/settings/autoFailover":
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(f.autoFailover)
+			return
+		}
+
+		f.autoFailover.Enabled = r.PostFormValue("enabled") == "true"
+		f.autoFailover.Timeout, _ = strconv.Atoi(r.PostFormValue("timeout"))
+		f.autoFailover.MaxCount, _ = strconv.Atoi(r.PostFormValue("maxCount"))
+		f.autoFailover.FailoverServerGroup = r.PostFormValue("failoverServerGroup") == "true"
+		f.autoFailover.FailoverOnDataDiskIssues.Enabled = r.PostFormValue("failoverOnDataDiskIssues[enabled]") == "true"
+		f.autoFailover.FailoverOnDataDiskIssues.TimePeriod, _ = strconv.Atoi(r.PostFormValue("failoverOnDataDiskIssues[timePeriod]"))
+	case r.URL.Path == "/settings/autoFailover/resetCount":
+		f.autoFailover.Count = 0
+	case r.URL.Path == "/controller/rebalance":
+		f.running = true
+		f.lastError = ""
+		f.ejected = r.PostFormValue("ejectedNodes")
+		f.rebalances = append(f.rebalances, r.PostFormValue("knownNodes")+"|"+f.ejected)
+	case r.URL.Path == "/controller/startGracefulFailover" || r.URL.Path == "/controller/failOver":
+		otpNode := r.PostFormValue("otpNode")
+		f.failovers = append(f.failovers, r.URL.Path+" "+otpNode)
+		for i := range f.nodes {
+			if f.nodes[i].OTPNode == otpNode {
+				f.nodes[i].ClusterMembership = "inactiveFailed"
+				f.promoteReplicas(i)
+			}
+		}
+	case r.URL.Path == "/controller/setRecoveryType":
+		for i := range f.nodes {
+			if f.nodes[i].OTPNode == r.PostFormValue("otpNode") {
+				f.nodes[i].RecoveryType = r.PostFormValue("recoveryType")
+			}
+		}
+	default:
+		for key := range r.PostForm {
+			f.settings[key] = r.PostForm.Get(key)
+		}
+	}
+}
+
+// count returns how many times call was made
+func (f *fakeCluster) count(call string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	count := 0
+	for _, c := range f.calls {
+		if c == call {
+			count++
+		}
+	}
+
+	return count
+}
+
+func (f *fakeCluster) serveTasks(w http.ResponseWriter) {
+	if f.tasks != "" {
+		w.Write([]byte(f.tasks))
+		return
+	}
+
+	if !f.running {
+		json.NewEncoder(w).Encode([]map[string]string{{"type": "rebalance", "status": "notRunning", "errorMessage": f.lastError}})
+		return
+	}
+
+	w.Write([]byte(`[{"type":"rebalance","status":"running","progress":50,"perNode":{"ns_1@10.0.0.2":{"progress":25}}}]`))
+	f.running = false
+	f.lastError = f.failure
+	if f.failure != "" {
+		return
+	}
+
+	var nodes []rest.Node
+	for _, node := range f.nodes {
+		if !strings.Contains(f.ejected, node.OTPNode) {
+			node.ClusterMembership = "active"
+			nodes = append(nodes, node)
+		}
+	}
+	f.nodes = nodes
+}
+
+// bucket returns the bucket called name
+func (f *fakeCluster) bucket(name string) (rest.Bucket, bool) {
+	for _, bucket := range f.buckets {
+		if bucket.Name == name {
+			return bucket, true
+		}
+	}
+
+	return rest.Bucket{}, false
+}
+
+func (f *fakeCluster) serveBuckets(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/pools/default/buckets")
+	name = strings.TrimPrefix(name, "/")
+	if r.Method == "GET" {
+		json.NewEncoder(w).Encode(f.buckets)
+		return
+	}
+
+	if name == "" {
+		name = r.PostForm.Get("name")
+	}
+
+	bucket, _ := f.bucket(name)
+	var buckets []rest.Bucket
+	for _, other := range f.buckets {
+		if other.Name != name {
+			buckets = append(buckets, other)
+		}
+	}
+	f.buckets = buckets
+	if r.Method == "DELETE" {
+		return
+	}
+
+	bucket.Name = name
+	if bucketType := r.PostForm.Get("bucketType"); bucketType == "couchbase" {
+		bucket.BucketType = "membase"
+	} else if bucketType != "" {
+		bucket.BucketType = bucketType
+	}
+	ram, _ := strconv.Atoi(r.PostForm.Get("ramQuotaMB"))
+	bucket.Quota.RawRAM = int64(ram) * 1024 * 1024
+	bucket.ReplicaNumber, _ = strconv.Atoi(r.PostForm.Get("replicaNumber"))
+	bucket.EvictionPolicy = r.PostForm.Get("evictionPolicy")
+	bucket.Controllers.Flush = ""
+	if r.PostForm.Get("flushEnabled") == "1" {
+		bucket.Controllers.Flush = "/pools/default/buckets/" + name + "/controller/doFlush"
+	}
+	f.buckets = append(f.buckets, bucket)
+}
+
+func (f *fakeCluster) serveServerGroups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		f.groups.URI = fmt.Sprintf("/pools/default/serverGroups?rev=%d", f.revision)
+		json.NewEncoder(w).Encode(f.groups)
+	case "POST":
+		uri := fmt.Sprintf("/pools/default/serverGroups/%d", len(f.groups.Groups))
+		f.groups.Groups = append(f.groups.Groups, rest.ServerGroup{Name: r.PostFormValue("name"), URI: uri})
+		f.revision++
+	case "PUT":
+		if r.URL.Query().Get("rev") != fmt.Sprint(f.revision) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		var body rest.ServerGroups
+		json.NewDecoder(r.Body).Decode(&body)
+		for i, group := range body.Groups {
+			for j := range group.Nodes {
+				body.Groups[i].Nodes[j].Hostname = group.Nodes[j].OTPNode[5:] + ":8091"
+			}
+		}
+		f.groups.Groups = body.Groups
+		f.revision++
+	}
+}
+
+// promoteReplicas promotes the first replica of every vBucket active on the failed over
+// server to active, leaving it without a replica
+func (f *fakeCluster) promoteReplicas(server int) {
+	for _, bucket := range f.buckets {
+		for _, chain := range bucket.VBucketServerMap.VBucketMap {
+			for i := range chain {
+				if chain[i] == server {
+					chain[i] = -1
+				}
+			}
+
+			if chain[0] == -1 {
+				chain[0], chain[1] = chain[1], -1
+			}
+		}
+	}
+}
+
+func TestInitializeNode(t *testing.T) {
+	node := &fakeCluster{}
+	server := httptest.NewServer(node)
+	defer server.Close()
+
+	config := DefaultConfig()
+	config.ClusterName = "array"
+	config.DataPath = "/data"
+	client := rest.NewClient(server.URL, "", "")
+	credentials := rest.Credentials{Username: "admin", Password: "secret"}
+
+	initialized, err := InitializeNode(client, config, credentials, "10.0.0.1", []string{"10.0.0.2"})
+	if _, ok := err.(*ClusterMembersError); !ok || initialized || len(node.calls) != 0 {
+		t.Fatalf("Expected a second cluster to be refused got %v %v %v", initialized, err, node.calls)
+	}
+
+	initialized, err = InitializeNode(client, config, credentials, "10.0.0.1", nil)
+	if err != nil || !initialized {
+		t.Fatalf("Expected the node to be initialized got %v %v", initialized, err)
+	}
+
+	expected := []string{
+		"POST /nodes/self/controller/settings",
+		"POST /node/controller/setupServices",
+		"POST /pools/default",
+		"POST /settings/indexes",
+		"POST /node/controller/rename",
+		"POST /settings/web",
+	}
+
+	if len(node.calls) != len(expected) {
+		t.Fatalf("Expected calls %v got %v", expected, node.calls)
+	}
+
+	for i := range expected {
+		if node.calls[i] != expected[i] {
+			t.Fatalf("Expected calls %v got %v", expected, node.calls)
+		}
+	}
+
+	for key, value := range map[string]string{
+		"services":    "kv,index,n1ql",
+		"memoryQuota": "512",
+		"clusterName": "array",
+		"storageMode": "plasma",
+		"hostname":    "10.0.0.1",
+		"username":    "admin",
+		"port":        "SAME",
+	} {
+		if node.settings[key] != value {
+			t.Fatalf("Expected %s to be %s got %s", key, value, node.settings[key])
+		}
+	}
+
+	if initialized, err = InitializeNode(client, config, credentials, "10.0.0.1", []string{"10.0.0.2"}); err != nil || initialized {
+		t.Fatalf("Expected an initialized node to be left alone got %v %v", initialized, err)
+	}
+}
+
+func TestInitializeNodeResumes(t *testing.T) {
+	node := &fakeCluster{}
+	server := httptest.NewServer(node)
+	defer server.Close()
+
+	client := rest.NewClient(server.URL, "", "")
+	credentials := rest.Credentials{Username: "admin", Password: "secret"}
+	node.failPool = true
+	if _, err := InitializeNode(client, DefaultConfig(), credentials, "10.0.0.1", nil); err == nil {
+		t.Fatal("Expected the rejected pool settings to fail the initialization")
+	}
+
+	node.failPool = false
+	initialized, err := InitializeNode(client, DefaultConfig(), credentials, "10.0.0.1", nil)
+	if err != nil || !initialized || node.settings["username"] != "admin" {
+		t.Fatalf("Expected the initialization to resume got %v %v %v", initialized, err, node.calls)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	file, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	file.Write([]byte(`{"services": ["kv"], "memoryQuota": 1024}`))
+	file.Close()
+
+	config, err := LoadConfig(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.MemoryQuota != 1024 || config.HasService("index") || config.IndexMemoryQuota != 256 {
+		t.Fatalf("Unexpected config %+v", config)
+	}
+}
@@ -0,0 +1,328 @@
+package provision
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	couchbasearray "github.com/andrewwebber/couchbase-array"
+	"github.com/andrewwebber/couchbase-array/couchbase/rest"
+)
+
+// RebalanceCoordinator rebalances the cluster on behalf of the scheduler. Nodes which have
+// been added or recovered, and failed over nodes which are leaving, are batched into a
+// single rebalance and the added nodes are marked clustered once it has completed. A
+// failed rebalance is retried after Backoff, doubling for every failed attempt, until
+// MaxAttempts have failed, or forever when MaxAttempts is zero. The reason it failed is
+// reported on the states of the added nodes.
+//
+// Cluster nodes which have had no live announcement for EjectAfter are ejected, unless
+// they are unhealthy and have not been failed over yet, or too few data nodes would be
+// left for the replicas of the buckets.
+//
+// Rebalances are held while a node cordoned for maintenance is failed over, as the
+// rebalance would eject it and lose the data it is to be delta recovered with.
+type RebalanceCoordinator struct {
+	Client      func(nodeIP string) *rest.Client
+	MaxAttempts int
+	Backoff     time.Duration
+	EjectAfter  time.Duration
+	// Override makes rebalances and ejections the safety checks refuse
+	Override bool
+	// Path is the service path whose placement policy minimums ejections keep
+	Path string
+
+	// absentSince is when each cluster node was first seen without a live announcement
+	absentSince map[string]time.Time
+
+	// cordoned is the failed over nodes in maintenance rebalances were last held for
+	cordoned string
+
+	// batch is the rebalance last started, empty once it has succeeded
+	batch    string
+	attempts int
+	started  bool
+	retryAt  time.Time
+	failure  string
+}
+
+// NewRebalanceCoordinator creates a RebalanceCoordinator
+func NewRebalanceCoordinator(client func(nodeIP string) *rest.Client, maxAttempts int, backoff time.Duration) *RebalanceCoordinator {
+	return &RebalanceCoordinator{Client: client, MaxAttempts: maxAttempts, Backoff: backoff}
+}
+
+// Reconcile starts a rebalance through the master node when one is pending and no other
+// is running, recording the progress of a running rebalance on the states of its nodes
+func (c *RebalanceCoordinator) Reconcile(ctx context.Context, master couchbasearray.NodeState, states map[string]couchbasearray.NodeState) ([]couchbasearray.Transition, error) {
+	client := c.Client(master.IPAddress).WithContext(ctx)
+	task, err := client.RebalanceTask()
+	if err != nil {
+		return nil, err
+	}
+
+	if task.Running() {
+		c.recordProgress(task, states)
+		return nil, nil
+	}
+
+	if c.started {
+		c.started = false
+		c.finished(task)
+	}
+
+	pool, err := client.Pool()
+	if err != nil {
+		return nil, err
+	}
+
+	var transitions []couchbasearray.Transition
+	var added []string
+	staying := liveNodes(pool.Nodes, states)
+	for key, state := range states {
+		state.RebalanceProgress = 0
+		states[key] = state
+		if state.State != couchbasearray.SchedulerStateAdding {
+			continue
+		}
+
+		node, ok := rest.FindNode(pool.Nodes, state.IPAddress)
+		if !ok {
+			continue
+		}
+
+		if node.ClusterMembership != "active" {
+			added = append(added, node.OTPNode)
+			continue
+		}
+
+		previous := state
+		state.State = couchbasearray.SchedulerStateClustered
+		state.DesiredState = couchbasearray.SchedulerStateClustered
+		state.Error = ""
+		states[key] = state
+		transitions = append(transitions, couchbasearray.NewTransition(previous, state, "rebalanced into the cluster"))
+	}
+
+	var known, ejected []string
+	for _, node := range pool.Nodes {
+		known = append(known, node.OTPNode)
+	}
+
+	safety := SafetyChecks{Client: client, Override: c.Override, Path: c.Path}
+	ejecting := c.absentNodes(pool.Nodes, staying)
+	if len(ejecting) > 0 {
+		err = safety.CheckEject(pool.Nodes, ejecting)
+		if _, ok := err.(*UnsafeError); ok {
+			log.Println(err)
+			ejecting = nil
+		} else if err != nil {
+			return transitions, err
+		}
+	}
+
+	for otpNode := range ejecting {
+		ejected = append(ejected, otpNode)
+	}
+
+	if len(added) == 0 && len(ejected) == 0 {
+		c.batch = ""
+		return transitions, nil
+	}
+
+	if cordoned := cordonedFailovers(pool.Nodes, states); len(cordoned) > 0 {
+		if held := strings.Join(cordoned, ","); held != c.cordoned {
+			c.cordoned = held
+			log.Printf("Holding rebalances while %v are failed over for maintenance\n", cordoned)
+		}
+		return transitions, nil
+	}
+	c.cordoned = ""
+
+	sort.Strings(added)
+	sort.Strings(ejected)
+	batch := strings.Join(added, ",") + "|" + strings.Join(ejected, ",")
+	if batch != c.batch {
+		c.batch = batch
+		c.attempts = 0
+		c.failure = ""
+		c.retryAt = time.Time{}
+	}
+
+	if c.failure != "" {
+		c.reportFailure(states, added)
+		if c.exhausted() || time.Now().Before(c.retryAt) {
+			return transitions, nil
+		}
+	}
+
+	if err = safety.CheckRebalance(pool.Nodes, ejecting); IsTransient(err) {
+		log.Println(err)
+		return transitions, nil
+	} else if err != nil {
+		return transitions, err
+	}
+
+	log.Printf("Rebalancing in %v and out %v, attempt %d\n", added, ejected, c.attempts+1)
+	if err = client.Rebalance(known, ejected); err != nil {
+		return transitions, err
+	}
+
+	c.started = true
+	return transitions, nil
+}
+
+// absentNodes returns the cluster nodes which have had no live announcement for EjectAfter
+// and can be rebalanced out
+func (c *RebalanceCoordinator) absentNodes(nodes []rest.Node, staying map[string]bool) map[string]bool {
+	if c.absentSince == nil {
+		c.absentSince = make(map[string]time.Time)
+	}
+
+	now := time.Now()
+	absent := make(map[string]bool)
+	seen := make(map[string]bool)
+	for _, node := range nodes {
+		if staying[node.OTPNode] {
+			continue
+		}
+
+		seen[node.OTPNode] = true
+		since, ok := c.absentSince[node.OTPNode]
+		if !ok {
+			log.Printf("%s has no live announcement\n", node.OTPNode)
+			since = now
+			c.absentSince[node.OTPNode] = since
+		}
+
+		if now.Sub(since) < c.EjectAfter {
+			continue
+		}
+
+		if node.ClusterMembership == "active" && node.Status != "healthy" {
+			log.Printf("Not ejecting %s until it has been failed over\n", node.OTPNode)
+			continue
+		}
+
+		absent[node.OTPNode] = true
+	}
+
+	for otpNode := range c.absentSince {
+		if !seen[otpNode] {
+			delete(c.absentSince, otpNode)
+		}
+	}
+
+	return absent
+}
+
+// cordonedFailovers returns the failed over nodes whose hosts are in maintenance
+func cordonedFailovers(nodes []rest.Node, states map[string]couchbasearray.NodeState) []string {
+	var cordoned []string
+	for _, state := range states {
+		node, ok := rest.FindNode(nodes, state.IPAddress)
+		if ok && state.Maintenance && node.ClusterMembership == "inactiveFailed" {
+			cordoned = append(cordoned, node.OTPNode)
+		}
+	}
+
+	sort.Strings(cordoned)
+	return cordoned
+}
+
+// liveNodes returns the otpNode names of the cluster nodes which are announcing and not
+// leaving the cluster, whichever form of their announced name Couchbase knows them by
+func liveNodes(nodes []rest.Node, states map[string]couchbasearray.NodeState) map[string]bool {
+	live := make(map[string]bool)
+	for host := range liveHosts(states) {
+		if node, ok := rest.FindNode(nodes, host); ok {
+			live[node.OTPNode] = true
+		}
+	}
+
+	return live
+}
+
+// liveHosts returns the hosts of the nodes which are announcing and not leaving the cluster
+func liveHosts(states map[string]couchbasearray.NodeState) map[string]bool {
+	live := make(map[string]bool)
+	for _, state := range states {
+		if state.State != couchbasearray.SchedulerStateFailingOver && state.State != couchbasearray.SchedulerStateDeleted {
+			live[state.IPAddress] = true
+		}
+	}
+
+	return live
+}
+
+// runsData reports whether the node runs the data service
+func runsData(node rest.Node) bool {
+	for _, service := range node.Services {
+		if service == "kv" {
+			return true
+		}
+	}
+
+	return len(node.Services) == 0
+}
+
+// finished records the outcome of the rebalance this coordinator started
+func (c *RebalanceCoordinator) finished(task *rest.Task) {
+	if task.ErrorMessage == "" {
+		c.attempts = 0
+		c.failure = ""
+		return
+	}
+
+	c.attempts++
+	c.failure = task.ErrorMessage
+	c.retryAt = time.Now().Add(c.Backoff << uint(c.attempts-1))
+	log.Printf("Rebalance attempt %d of %d failed: %s\n", c.attempts, c.MaxAttempts, task.ErrorMessage)
+}
+
+// exhausted reports whether the rebalance is no longer retried
+func (c *RebalanceCoordinator) exhausted() bool {
+	return c.MaxAttempts > 0 && c.attempts >= c.MaxAttempts
+}
+
+// reportFailure records why the rebalance of the added nodes failed on their states
+func (c *RebalanceCoordinator) reportFailure(states map[string]couchbasearray.NodeState, added []string) {
+	reason := fmt.Sprintf("rebalance attempt %d of %d failed, retrying: %s", c.attempts, c.MaxAttempts, c.failure)
+	if c.exhausted() {
+		reason = fmt.Sprintf("rebalance failed after %d attempts: %s", c.attempts, c.failure)
+	}
+
+	var pending []rest.Node
+	for _, otpNode := range added {
+		pending = append(pending, rest.Node{OTPNode: otpNode})
+	}
+
+	for key, state := range states {
+		if _, ok := rest.FindNode(pending, state.IPAddress); ok {
+			state.Error = reason
+			states[key] = state
+		}
+	}
+}
+
+// recordProgress records the progress of the running rebalance on the states of its nodes
+func (c *RebalanceCoordinator) recordProgress(task *rest.Task, states map[string]couchbasearray.NodeState) {
+	progress := task.NodeProgress()
+	var running []rest.Node
+	var nodes []string
+	for otpNode, percent := range progress {
+		running = append(running, rest.Node{OTPNode: otpNode})
+		nodes = append(nodes, fmt.Sprintf("%s %.0f%%", otpNode, percent))
+	}
+	sort.Strings(nodes)
+	log.Printf("Rebalance %.0f%% complete (%s)\n", task.Progress, strings.Join(nodes, ", "))
+
+	for key, state := range states {
+		if node, ok := rest.FindNode(running, state.IPAddress); ok {
+			state.RebalanceProgress = progress[node.OTPNode]
+			states[key] = state
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package provision
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	couchbasearray "github.com/andrewwebber/couchbase-array"
+	"github.com/andrewwebber/couchbase-array/couchbase/rest"
+)
+
+func TestRebalanceCoordinator(t *testing.T) {
+	fake := &fakeCluster{nodes: []rest.Node{
+		{OTPNode: "ns_1@10.0.0.1", Hostname: "10.0.0.1:8091", ClusterMembership: "active"},
+		{OTPNode: "ns_1@10.0.0.2", Hostname: "10.0.0.2:8091", ClusterMembership: "inactiveAdded"},
+		{OTPNode: "ns_1@couchbase-3.couchbase.default.svc", Hostname: "couchbase-3.couchbase.default.svc:8091", ClusterMembership: "inactiveAdded"},
+		{OTPNode: "ns_1@10.0.0.4", Hostname: "10.0.0.4:8091", ClusterMembership: "inactiveFailed"},
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	coordinator := NewRebalanceCoordinator(func(string) *rest.Client {
+		return rest.NewClient(server.URL, "Administrator", "password")
+	}, 3, time.Millisecond)
+
+	states := map[string]couchbasearray.NodeState{
+		"a": {IPAddress: "10.0.0.1", SessionID: "a", Master: true, State: couchbasearray.SchedulerStateClustered},
+		"b": {IPAddress: "10.0.0.2", SessionID: "b", State: couchbasearray.SchedulerStateAdding, DesiredState: couchbasearray.SchedulerStateAdding},
+		// Couchbase knows the node by the fully qualified form of its announced name
+		"c": {IPAddress: "couchbase-3", SessionID: "c", State: couchbasearray.SchedulerStateAdding, DesiredState: couchbasearray.SchedulerStateAdding},
+		"d": {IPAddress: "10.0.0.4", SessionID: "d", State: couchbasearray.SchedulerStateDeleted, DesiredState: couchbasearray.SchedulerStateDeleted},
+	}
+
+	transitions, err := coordinator.Reconcile(context.Background(), states["a"], states)
+	if err != nil || len(transitions) != 0 {
+		t.Fatalf("Expected a rebalance to be started got %v %v", transitions, err)
+	}
+
+	expected := "ns_1@10.0.0.1,ns_1@10.0.0.2,ns_1@couchbase-3.couchbase.default.svc,ns_1@10.0.0.4|ns_1@10.0.0.4"
+	if len(fake.rebalances) != 1 || fake.rebalances[0] != expected {
+		t.Fatalf("Expected a single batched rebalance got %v", fake.rebalances)
+	}
+
+	// the rebalance is still running
+	if transitions, err = coordinator.Reconcile(context.Background(), states["a"], states); err != nil || len(transitions) != 0 {
+		t.Fatalf("Expected to wait for the rebalance got %v %v", transitions, err)
+	}
+
+	if states["b"].RebalanceProgress != 25 {
+		t.Fatalf("Expected the node progress to be recorded got %v", states["b"])
+	}
+
+	if transitions, err = coordinator.Reconcile(context.Background(), states["a"], states); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(transitions) != 2 || states["b"].State != couchbasearray.SchedulerStateClustered || states["c"].DesiredState != couchbasearray.SchedulerStateClustered {
+		t.Fatalf("Expected the added nodes to be marked clustered got %v %v", transitions, states)
+	}
+
+	if len(fake.rebalances) != 1 || states["b"].RebalanceProgress != 0 {
+		t.Fatalf("Expected no further rebalance got %v %v", fake.rebalances, states["b"])
+	}
+}
+
+func TestRebalanceCoordinatorRetries(t *testing.T) {
+	fake := &fakeCluster{failure: "Rebalance failed. See logs for detailed reason.", nodes: []rest.Node{
+		{OTPNode: "ns_1@10.0.0.1", Hostname: "10.0.0.1:8091", ClusterMembership: "active"},
+		{OTPNode: "ns_1@couchbase-2.couchbase.default.svc", Hostname: "couchbase-2.couchbase.default.svc:8091", ClusterMembership: "inactiveAdded"},
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	coordinator := NewRebalanceCoordinator(func(string) *rest.Client {
+		return rest.NewClient(server.URL, "Administrator", "password")
+	}, 2, time.Hour)
+
+	states := map[string]couchbasearray.NodeState{
+		"a": {IPAddress: "10.0.0.1", SessionID: "a", Master: true, State: couchbasearray.SchedulerStateClustered},
+		// Couchbase knows the node by the fully qualified form of its announced name
+		"b": {IPAddress: "couchbase-2", SessionID: "b", State: couchbasearray.SchedulerStateAdding, DesiredState: couchbasearray.SchedulerStateAdding},
+	}
+
+	reconcile := func() {
+		for i := 0; i < 2; i++ {
+			if _, err := coordinator.Reconcile(context.Background(), states["a"], states); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	reconcile()
+	reconcile()
+	if len(fake.rebalances) != 1 || !strings.Contains(states["b"].Error, "attempt 1 of 2") {
+		t.Fatalf("Expected the retry to back off got %v %v", fake.rebalances, states["b"])
+	}
+
+	coordinator.retryAt = time.Time{}
+	reconcile()
+	reconcile()
+	if len(fake.rebalances) != 2 || !strings.Contains(states["b"].Error, "failed after 2 attempts") {
+		t.Fatalf("Expected a terminal error got %v %v", fake.rebalances, states["b"])
+	}
+
+	if states["b"].State != couchbasearray.SchedulerStateAdding {
+		t.Fatalf("Expected the node to stay adding got %v", states["b"])
+	}
+}
+
+func TestRebalanceCoordinatorEjects(t *testing.T) {
+	fake := &fakeCluster{
+		buckets: []rest.Bucket{{Name: "default", BucketType: "membase", ReplicaNumber: 1}},
+		nodes: []rest.Node{
+			{OTPNode: "ns_1@10.0.0.1", Hostname: "10.0.0.1:8091", ClusterMembership: "active", Status: "healthy"},
+			{OTPNode: "ns_1@couchbase-2.couchbase.default.svc", Hostname: "couchbase-2.couchbase.default.svc:8091", ClusterMembership: "active", Status: "healthy"},
+			{OTPNode: "ns_1@10.0.0.3", Hostname: "10.0.0.3:8091", ClusterMembership: "inactiveFailed", Status: "unhealthy"},
+			{OTPNode: "ns_1@10.0.0.4", Hostname: "10.0.0.4:8091", ClusterMembership: "active", Status: "unhealthy"},
+		}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	coordinator := NewRebalanceCoordinator(func(string) *rest.Client {
+		return rest.NewClient(server.URL, "Administrator", "password")
+	}, 3, time.Millisecond)
+	coordinator.EjectAfter = time.Hour
+
+	states := map[string]couchbasearray.NodeState{
+		"a": {IPAddress: "10.0.0.1", SessionID: "a", Master: true, State: couchbasearray.SchedulerStateClustered},
+		// Couchbase knows the node by the fully qualified form of its announced name
+		"b": {IPAddress: "couchbase-2", SessionID: "b", State: couchbasearray.SchedulerStateClustered},
+	}
+
+	if _, err := coordinator.Reconcile(context.Background(), states["a"], states); err != nil || len(fake.rebalances) != 0 {
+		t.Fatalf("Expected absent nodes to be kept for the grace period got %v %v", fake.rebalances, err)
+	}
+
+	for otpNode := range coordinator.absentSince {
+		coordinator.absentSince[otpNode] = time.Now().Add(-2 * time.Hour)
+	}
+
+	if _, err := coordinator.Reconcile(context.Background(), states["a"], states); err != nil || len(fake.rebalances) != 0 {
+		t.Fatalf("Expected the rebalance to wait for the unhealthy node got %v %v", fake.rebalances, err)
+	}
+
+	fake.nodes[3].ClusterMembership = "inactiveFailed"
+	if _, err := coordinator.Reconcile(context.Background(), states["a"], states); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.rebalances) != 1 || !strings.HasSuffix(fake.rebalances[0], "|ns_1@10.0.0.3,ns_1@10.0.0.4") {
+		t.Fatalf("Expected the failed over nodes to be ejected got %v", fake.rebalances)
+	}
+
+	// ejecting the healthy node would leave a single data node for a replica
+	delete(states, "b")
+	fake.running = false
+	fake.nodes = fake.nodes[:2]
+	coordinator.absentSince["ns_1@couchbase-2.couchbase.default.svc"] = time.Now().Add(-2 * time.Hour)
+	if _, err := coordinator.Reconcile(context.Background(), states["a"], states); err != nil || len(fake.rebalances) != 1 {
+		t.Fatalf("Expected the replica count to be protected got %v %v", fake.rebalances, err)
+	}
+
+	fake.buckets[0].ReplicaNumber = 0
+	if _, err := coordinator.Reconcile(context.Background(), states["a"], states); err != nil || len(fake.rebalances) != 2 {
+		t.Fatalf("Expected the absent node to be ejected got %v %v", fake.rebalances, err)
+	}
+}
+
+func TestRebalanceCoordinatorHoldsForMaintenance(t *testing.T) {
+	fake := &fakeCluster{nodes: []rest.Node{
+		{OTPNode: "ns_1@10.0.0.1", Hostname: "10.0.0.1:8091", ClusterMembership: "active"},
+		{OTPNode: "ns_1@couchbase-2.couchbase.default.svc", Hostname: "couchbase-2.couchbase.default.svc:8091", ClusterMembership: "inactiveFailed"},
+		{OTPNode: "ns_1@10.0.0.3", Hostname: "10.0.0.3:8091", ClusterMembership: "inactiveAdded"},
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	coordinator := NewRebalanceCoordinator(func(string) *rest.Client {
+		return rest.NewClient(server.URL, "Administrator", "password")
+	}, 3, time.Millisecond)
+
+	states := map[string]couchbasearray.NodeState{
+		"a": {IPAddress: "10.0.0.1", SessionID: "a", Master: true, State: couchbasearray.SchedulerStateClustered},
+		// Couchbase knows the node by the fully qualified form of its announced name
+		"b": {IPAddress: "couchbase-2", SessionID: "b", State: couchbasearray.SchedulerStateRemoved, Maintenance: true},
+		"c": {IPAddress: "10.0.0.3", SessionID: "c", State: couchbasearray.SchedulerStateAdding},
+	}
+
+	if _, err := coordinator.Reconcile(context.Background(), states["a"], states); err != nil || len(fake.rebalances) != 0 {
+		t.Fatalf("Expected the rebalance to be held for the cordoned node got %v %v", fake.rebalances, err)
+	}
+
+	b := states["b"]
+	b.Maintenance = false
+	states["b"] = b
+	if _, err := coordinator.Reconcile(context.Background(), states["a"], states); err != nil || len(fake.rebalances) != 1 {
+		t.Fatalf("Expected the rebalance once the node was uncordoned got %v %v", fake.rebalances, err)
+	}
+}
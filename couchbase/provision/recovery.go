@@ -0,0 +1,185 @@
+package provision
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	couchbasearray "github.com/andrewwebber/couchbase-array"
+	"github.com/andrewwebber/couchbase-array/couchbase/rest"
+)
+
+const (
+	// RecoveryDelta resynchronizes only the mutations a returning node missed
+	RecoveryDelta = "delta"
+	// RecoveryFull discards the data of a returning node and rebuilds it
+	RecoveryFull = "full"
+)
+
+// failoverRecord is when a node was first seen failed over and the buckets it held.
+// Maintenance is set for nodes failed over because they were cordoned.
+type failoverRecord struct {
+	FailedAt    int64  `json:"failedAt"`
+	Buckets     string `json:"buckets"`
+	Maintenance bool   `json:"maintenance,omitempty"`
+}
+
+// RecoveryReconciler decides how failed over nodes which announce again are recovered.
+// Delta recovery is chosen when the node kept its data, was failed over less than
+// DeltaWindow ago, or for maintenance, and the buckets have not changed since;
+// otherwise the node is recovered in full. Nodes in maintenance are left alone until
+// they are uncordoned. The decision is set on the cluster, for the rebalance coordinator
+// to act on, and recorded in the Recovery field of the state of the node.
+type RecoveryReconciler struct {
+	Client      func(nodeIP string) *rest.Client
+	Path        string
+	DeltaWindow time.Duration
+}
+
+// Reconcile records newly failed over nodes and sets the recovery of returning nodes
+func (r RecoveryReconciler) Reconcile(ctx context.Context, master couchbasearray.NodeState, states map[string]couchbasearray.NodeState) ([]couchbasearray.Transition, error) {
+	client := r.Client(master.IPAddress).WithContext(ctx)
+	pool, err := client.Pool()
+	if err != nil {
+		return nil, err
+	}
+
+	buckets, err := client.Buckets()
+	if err != nil {
+		return nil, err
+	}
+
+	maintenance := make(map[string]bool)
+	for _, state := range states {
+		if node, ok := rest.FindNode(pool.Nodes, state.IPAddress); ok && state.Maintenance {
+			maintenance[node.OTPNode] = true
+		}
+	}
+
+	signature := bucketSignature(buckets)
+	records, err := r.records(pool.Nodes, signature, maintenance)
+	if err != nil {
+		return nil, err
+	}
+
+	var failed []rest.Node
+	for _, node := range pool.Nodes {
+		if node.ClusterMembership == "inactiveFailed" {
+			failed = append(failed, node)
+		}
+	}
+
+	var transitions []couchbasearray.Transition
+	for key, state := range states {
+		node, ok := rest.FindNode(failed, state.IPAddress)
+		if !ok || state.Maintenance || state.State == couchbasearray.SchedulerStateFailingOver || state.State == couchbasearray.SchedulerStateDeleted {
+			continue
+		}
+
+		recovery, reason := decideRecovery(state, records[node.OTPNode], signature, r.DeltaWindow)
+		if node.RecoveryType != recovery {
+			log.Printf("%s recovery of %s: %s\n", recovery, node.OTPNode, reason)
+			if err = client.SetRecoveryType(node.OTPNode, recovery); err != nil {
+				return transitions, err
+			}
+		}
+
+		if state.Recovery != recovery {
+			previous := state
+			state.Recovery = recovery
+			states[key] = state
+			transitions = append(transitions, couchbasearray.NewTransition(previous, state, fmt.Sprintf("%s recovery: %s", recovery, reason)))
+		}
+	}
+
+	return transitions, nil
+}
+
+// decideRecovery decides how the failed over node of state is recovered
+func decideRecovery(state couchbasearray.NodeState, record failoverRecord, signature string, window time.Duration) (string, string) {
+	if !state.DataIntact {
+		return RecoveryFull, "the data volume of the node was lost"
+	}
+
+	if gone := time.Since(time.Unix(0, record.FailedAt)); gone > window && !record.Maintenance {
+		return RecoveryFull, fmt.Sprintf("the node was failed over %s ago", gone.Truncate(time.Second))
+	}
+
+	if record.Buckets != signature {
+		return RecoveryFull, "the buckets changed since the node was failed over"
+	}
+
+	if record.Maintenance {
+		return RecoveryDelta, "the node returned from maintenance with its data and the buckets are unchanged"
+	}
+
+	return RecoveryDelta, "the node kept its data and the buckets are unchanged"
+}
+
+// records returns when each failed over node was first seen failed over, recording the
+// nodes seen for the first time and forgetting those which are no longer failed over.
+// Nodes in maintenance, keyed by otpNode, are recorded as failed over for maintenance.
+func (r RecoveryReconciler) records(nodes []rest.Node, signature string, maintenance map[string]bool) (map[string]failoverRecord, error) {
+	store := couchbasearray.GetStore()
+	existing, err := store.GetDir(r.Path + "/failovers/")
+	if err != nil && err != couchbasearray.ErrKeyNotFound {
+		return nil, err
+	}
+
+	records := make(map[string]failoverRecord)
+	for _, node := range existing {
+		var record failoverRecord
+		if err = json.Unmarshal([]byte(node.Value), &record); err != nil {
+			return nil, err
+		}
+		records[node.Key[strings.LastIndex(node.Key, "/")+1:]] = record
+	}
+
+	failed := make(map[string]bool)
+	for _, node := range nodes {
+		if node.ClusterMembership != "inactiveFailed" {
+			continue
+		}
+
+		failed[node.OTPNode] = true
+		if _, ok := records[node.OTPNode]; ok {
+			continue
+		}
+
+		record := failoverRecord{FailedAt: time.Now().UnixNano(), Buckets: signature, Maintenance: maintenance[node.OTPNode]}
+		bytes, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = store.Set(r.Path+"/failovers/"+node.OTPNode, string(bytes), 0); err != nil {
+			return nil, err
+		}
+		records[node.OTPNode] = record
+	}
+
+	for otpNode := range records {
+		if !failed[otpNode] {
+			if err = store.Delete(r.Path+"/failovers/"+otpNode, false); err != nil && err != couchbasearray.ErrKeyNotFound {
+				return nil, err
+			}
+			delete(records, otpNode)
+		}
+	}
+
+	return records, nil
+}
+
+// bucketSignature describes the buckets whose change invalidates the data of a failed over node
+func bucketSignature(buckets []rest.Bucket) string {
+	var descriptions []string
+	for _, bucket := range buckets {
+		descriptions = append(descriptions, fmt.Sprintf("%s:%s:%d", bucket.Name, bucket.Type(), bucket.ReplicaNumber))
+	}
+	sort.Strings(descriptions)
+	return strings.Join(descriptions, ",")
+}
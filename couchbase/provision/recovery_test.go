@@ -0,0 +1,112 @@
+package provision
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	couchbasearray "github.com/andrewwebber/couchbase-array"
+	"github.com/andrewwebber/couchbase-array/couchbase/rest"
+)
+
+func TestRecoveryReconciler(t *testing.T) {
+	defer couchbasearray.SetStore(couchbasearray.GetStore())
+	couchbasearray.SetStore(couchbasearray.NewMemoryStore())
+	path := "/services/couchbase-array-recovery"
+
+	fake := &fakeCluster{
+		buckets: []rest.Bucket{{Name: "default", BucketType: "membase", ReplicaNumber: 1}},
+		nodes: []rest.Node{
+			{OTPNode: "ns_1@10.0.0.1", Hostname: "10.0.0.1:8091", ClusterMembership: "active"},
+			{OTPNode: "ns_1@10.0.0.2", Hostname: "10.0.0.2:8091", ClusterMembership: "inactiveFailed", RecoveryType: "none"},
+			{OTPNode: "ns_1@couchbase-2.couchbase.default.svc", Hostname: "couchbase-2.couchbase.default.svc:8091", ClusterMembership: "inactiveFailed", RecoveryType: "none"},
+		}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	reconciler := RecoveryReconciler{
+		Client:      func(string) *rest.Client { return rest.NewClient(server.URL, "Administrator", "password") },
+		Path:        path,
+		DeltaWindow: time.Hour,
+	}
+
+	states := map[string]couchbasearray.NodeState{
+		"a": {IPAddress: "10.0.0.1", SessionID: "a", Master: true, State: couchbasearray.SchedulerStateClustered},
+		"b": {IPAddress: "10.0.0.2", SessionID: "b", State: couchbasearray.SchedulerStateNew, DataIntact: true},
+		// Couchbase knows the node by the fully qualified form of its announced name
+		"c": {IPAddress: "couchbase-2", SessionID: "c", State: couchbasearray.SchedulerStateNew},
+	}
+
+	transitions, err := reconciler.Reconcile(context.Background(), states["a"], states)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if states["b"].Recovery != RecoveryDelta || fake.nodes[1].RecoveryType != RecoveryDelta {
+		t.Fatalf("Expected delta recovery for the node which kept its data got %v %v", states["b"], fake.nodes[1])
+	}
+
+	if states["c"].Recovery != RecoveryFull || fake.nodes[2].RecoveryType != RecoveryFull || len(transitions) != 2 {
+		t.Fatalf("Expected full recovery for the node which lost its data got %v %v", states["c"], transitions)
+	}
+
+	fake.buckets = append(fake.buckets, rest.Bucket{Name: "sessions", BucketType: "ephemeral"})
+	if transitions, err = reconciler.Reconcile(context.Background(), states["a"], states); err != nil {
+		t.Fatal(err)
+	}
+
+	if states["b"].Recovery != RecoveryFull || len(transitions) != 1 {
+		t.Fatalf("Expected full recovery once the buckets changed got %v %v", states["b"], transitions)
+	}
+
+	fake.nodes = fake.nodes[:1]
+	if _, err = reconciler.Reconcile(context.Background(), states["a"], states); err != nil {
+		t.Fatal(err)
+	}
+
+	if records, err := couchbasearray.GetStore().GetDir(path + "/failovers/"); err == nil && len(records) != 0 {
+		t.Fatalf("Expected the failover records to be forgotten got %v", records)
+	}
+}
+
+func TestRecoveryReconcilerMaintenance(t *testing.T) {
+	defer couchbasearray.SetStore(couchbasearray.GetStore())
+	couchbasearray.SetStore(couchbasearray.NewMemoryStore())
+
+	fake := &fakeCluster{
+		buckets: []rest.Bucket{{Name: "default", BucketType: "membase", ReplicaNumber: 1}},
+		nodes: []rest.Node{
+			{OTPNode: "ns_1@10.0.0.1", Hostname: "10.0.0.1:8091", ClusterMembership: "active"},
+			{OTPNode: "ns_1@couchbase-1.couchbase.default.svc", Hostname: "couchbase-1.couchbase.default.svc:8091", ClusterMembership: "inactiveFailed", RecoveryType: "none"},
+		}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	reconciler := RecoveryReconciler{
+		Client: func(string) *rest.Client { return rest.NewClient(server.URL, "Administrator", "password") },
+		Path:   "/services/couchbase-array-recovery",
+	}
+
+	states := map[string]couchbasearray.NodeState{
+		"a": {IPAddress: "10.0.0.1", SessionID: "a", Master: true, State: couchbasearray.SchedulerStateClustered},
+		"b": {IPAddress: "couchbase-1", SessionID: "b", State: couchbasearray.SchedulerStateRemoved, DataIntact: true, Maintenance: true},
+	}
+
+	if transitions, err := reconciler.Reconcile(context.Background(), states["a"], states); err != nil || len(transitions) != 0 || fake.nodes[1].RecoveryType != "none" {
+		t.Fatalf("Expected the node in maintenance to be left alone got %v %v %v", transitions, fake.nodes[1], err)
+	}
+
+	// uncordoned long after the delta recovery window
+	b := states["b"]
+	b.State = couchbasearray.SchedulerStateAdding
+	b.Maintenance = false
+	states["b"] = b
+	if _, err := reconciler.Reconcile(context.Background(), states["a"], states); err != nil {
+		t.Fatal(err)
+	}
+
+	if states["b"].Recovery != RecoveryDelta || fake.nodes[1].RecoveryType != RecoveryDelta {
+		t.Fatalf("Expected delta recovery for the node returning from maintenance got %v %v", states["b"], fake.nodes[1])
+	}
+}
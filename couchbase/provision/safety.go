@@ -0,0 +1,237 @@
+package provision
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	couchbasearray "github.com/andrewwebber/couchbase-array"
+	"github.com/andrewwebber/couchbase-array/couchbase/rest"
+)
+
+// UnsafeError is returned by a safety check which refuses a cluster operation. A
+// transient refusal is lifted once the tasks or nodes in the way have settled, while
+// any other would lose data.
+type UnsafeError struct {
+	Operation string
+	Reason    string
+	Transient bool
+}
+
+func (e *UnsafeError) Error() string {
+	if e.Transient {
+		return fmt.Sprintf("delaying %s: %s", e.Operation, e.Reason)
+	}
+
+	return fmt.Sprintf("refusing %s: %s", e.Operation, e.Reason)
+}
+
+// IsTransient reports whether err is a refusal which is lifted once the cluster settles
+func IsTransient(err error) bool {
+	unsafe, ok := err.(*UnsafeError)
+	return ok && unsafe.Transient
+}
+
+// SafetyChecks checks destructive cluster operations against the buckets, tasks and
+// nodes of the cluster before they are made. When Path is set, failovers and ejections
+// are also refused below the service minimums of the placement policy beneath it. With
+// Override a refused operation is only logged and allowed.
+type SafetyChecks struct {
+	Client   *rest.Client
+	Override bool
+	Path     string
+}
+
+// CheckFailover refuses to fail over node while a rebalance is running, while it holds
+// the active copy of a vBucket without a replica on another active node, or when it
+// would leave a service below its minimum
+func (s SafetyChecks) CheckFailover(node rest.Node) error {
+	operation := "failover of " + node.OTPNode
+	if err := s.checkRebalanceRunning(operation); err != nil {
+		return err
+	}
+
+	pool, err := s.Client.Pool()
+	if err != nil {
+		return err
+	}
+
+	active := make(map[string]bool)
+	for _, other := range pool.Nodes {
+		if other.ClusterMembership == "active" && other.OTPNode != node.OTPNode {
+			active[other.Host()] = true
+		}
+	}
+
+	buckets, err := s.Client.Buckets()
+	if err != nil {
+		return err
+	}
+
+	for _, bucket := range buckets {
+		if lost := vBucketsLost(bucket.VBucketServerMap, node.Host(), active); lost > 0 {
+			return s.refuse(&UnsafeError{Operation: operation, Reason: fmt.Sprintf("%d active vBuckets of bucket %s have no replica on another active node", lost, bucket.Name)})
+		}
+	}
+
+	return s.checkServiceMinimums(operation, pool.Nodes, map[string]bool{node.OTPNode: true})
+}
+
+// CheckEject refuses to eject nodes when too few data nodes would be left to hold the
+// replicas of every bucket, or a service would be left below its minimum. Failed over
+// nodes are kept while they are not, so they can still be recovered.
+func (s SafetyChecks) CheckEject(nodes []rest.Node, ejecting map[string]bool) error {
+	buckets, err := s.Client.Buckets()
+	if err != nil {
+		return err
+	}
+
+	replicas := 0
+	for _, bucket := range buckets {
+		if bucket.Type() != "memcached" && bucket.ReplicaNumber > replicas {
+			replicas = bucket.ReplicaNumber
+		}
+	}
+
+	remaining := 0
+	for _, node := range nodes {
+		if !ejecting[node.OTPNode] && node.ClusterMembership != "inactiveFailed" && runsData(node) {
+			remaining++
+		}
+	}
+
+	if remaining < replicas+1 {
+		return s.refuse(&UnsafeError{Operation: fmt.Sprintf("ejecting %d nodes", len(ejecting)), Reason: fmt.Sprintf("%d data nodes would be left for %d replicas", remaining, replicas)})
+	}
+
+	return s.checkServiceMinimums(fmt.Sprintf("ejecting %d nodes", len(ejecting)), nodes, ejecting)
+}
+
+// CheckRebalance delays a rebalance while another is running, cross datacenter
+// replication has changes left to replicate, indexes are building or a node which stays
+// in the cluster is unhealthy
+func (s SafetyChecks) CheckRebalance(nodes []rest.Node, ejecting map[string]bool) error {
+	operation := "rebalance"
+	tasks, err := s.Client.Tasks()
+	if err != nil {
+		return err
+	}
+
+	for _, task := range tasks {
+		var reason string
+		switch {
+		case task.Type == "rebalance" && task.Running():
+			reason = "a rebalance is running"
+		case task.Type == "xdcr" && task.ChangesLeft > 0:
+			reason = fmt.Sprintf("cross datacenter replication of bucket %s has %d changes left", task.Source, task.ChangesLeft)
+		case task.Type == "global_indexes" && task.Running() && task.Progress < 100:
+			reason = fmt.Sprintf("index %s of bucket %s is building", task.Index, task.Bucket)
+		}
+
+		if reason != "" {
+			return s.refuse(&UnsafeError{Operation: operation, Reason: reason, Transient: true})
+		}
+	}
+
+	for _, node := range nodes {
+		if ejecting[node.OTPNode] || node.ClusterMembership == "inactiveFailed" {
+			continue
+		}
+
+		if node.Status != "" && node.Status != "healthy" {
+			return s.refuse(&UnsafeError{Operation: operation, Reason: fmt.Sprintf("%s is %s", node.OTPNode, node.Status), Transient: true})
+		}
+	}
+
+	return nil
+}
+
+// checkRebalanceRunning delays operation while a rebalance is running
+func (s SafetyChecks) checkRebalanceRunning(operation string) error {
+	task, err := s.Client.RebalanceTask()
+	if err != nil {
+		return err
+	}
+
+	if task.Running() {
+		return s.refuse(&UnsafeError{Operation: operation, Reason: "a rebalance is running", Transient: true})
+	}
+
+	return nil
+}
+
+// checkServiceMinimums refuses operation when the active nodes leaving would take a service
+// below the minimum of the placement policy beneath Path
+func (s SafetyChecks) checkServiceMinimums(operation string, nodes []rest.Node, leaving map[string]bool) error {
+	if s.Path == "" {
+		return nil
+	}
+
+	policy, err := couchbasearray.GetPlacementPolicy(s.Path)
+	if err != nil {
+		return err
+	}
+
+	remaining := make(map[string]int)
+	removed := make(map[string]bool)
+	for _, node := range nodes {
+		if node.ClusterMembership != "active" {
+			continue
+		}
+
+		for _, service := range node.Services {
+			if leaving[node.OTPNode] {
+				removed[service] = true
+			} else {
+				remaining[service]++
+			}
+		}
+	}
+
+	var services []string
+	for service := range policy.Minimum {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	for _, service := range services {
+		if minimum := policy.Minimum[service]; removed[service] && remaining[service] < minimum {
+			return s.refuse(&UnsafeError{Operation: operation, Reason: fmt.Sprintf("%d nodes would be left running %s, below its minimum of %d", remaining[service], service, minimum)})
+		}
+	}
+
+	return nil
+}
+
+// refuse returns err unless the checks are overridden
+func (s SafetyChecks) refuse(err *UnsafeError) error {
+	if s.Override {
+		log.Printf("Overriding safety check: %v\n", err)
+		return nil
+	}
+
+	return err
+}
+
+// vBucketsLost counts the vBuckets whose active copy is on host without a replica on an active node
+func vBucketsLost(vBuckets rest.VBucketServerMap, host string, active map[string]bool) int {
+	lost := 0
+	for _, chain := range vBuckets.VBucketMap {
+		if len(chain) == 0 || vBuckets.Host(chain[0]) != host {
+			continue
+		}
+
+		replicated := false
+		for _, replica := range chain[1:] {
+			if active[vBuckets.Host(replica)] {
+				replicated = true
+			}
+		}
+
+		if !replicated {
+			lost++
+		}
+	}
+
+	return lost
+}
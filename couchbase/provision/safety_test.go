@@ -0,0 +1,91 @@
+package provision
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	couchbasearray "github.com/andrewwebber/couchbase-array"
+	"github.com/andrewwebber/couchbase-array/couchbase/rest"
+)
+
+func TestSafetyChecks(t *testing.T) {
+	nodes := []rest.Node{
+		{OTPNode: "ns_1@10.0.0.1", Hostname: "10.0.0.1:8091", ClusterMembership: "active", Status: "healthy"},
+		{OTPNode: "ns_1@10.0.0.2", Hostname: "10.0.0.2:8091", ClusterMembership: "active", Status: "healthy"},
+	}
+	buckets := []rest.Bucket{{Name: "default", BucketType: "membase", ReplicaNumber: 1,
+		VBucketServerMap: rest.VBucketServerMap{
+			ServerList: []string{"10.0.0.1:11210", "10.0.0.2:11210"},
+			VBucketMap: [][]int{{0, 1}, {1, -1}},
+		}}}
+
+	fake := &fakeCluster{nodes: nodes, buckets: buckets}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	checks := SafetyChecks{Client: rest.NewClient(server.URL, "Administrator", "password")}
+	if err := checks.CheckFailover(nodes[0]); err != nil {
+		t.Fatalf("Expected the replicated node to be failed over got %v", err)
+	}
+
+	err := checks.CheckFailover(nodes[1])
+	if _, ok := err.(*UnsafeError); !ok || IsTransient(err) {
+		t.Fatalf("Expected the failover losing a vBucket to be refused got %v", err)
+	}
+
+	if err = checks.CheckEject(nodes, map[string]bool{"ns_1@10.0.0.2": true}); err == nil {
+		t.Fatal("Expected ejecting down to a single data node to be refused")
+	}
+
+	fake.tasks = `[{"type":"xdcr","status":"running","source":"default","changesLeft":42}]`
+	if err = checks.CheckRebalance(nodes, nil); !IsTransient(err) {
+		t.Fatalf("Expected the rebalance to wait for replication got %v", err)
+	}
+
+	fake.tasks = `[{"type":"global_indexes","status":"running","bucket":"default","index":"by_name","progress":30}]`
+	if err = checks.CheckRebalance(nodes, nil); !IsTransient(err) {
+		t.Fatalf("Expected the rebalance to wait for the index build got %v", err)
+	}
+
+	checks.Override = true
+	if err = checks.CheckFailover(nodes[1]); err != nil {
+		t.Fatalf("Expected the override to allow the failover got %v", err)
+	}
+
+	if err = checks.CheckRebalance(nodes, nil); err != nil {
+		t.Fatalf("Expected the override to allow the rebalance got %v", err)
+	}
+}
+
+func TestSafetyChecksServiceMinimums(t *testing.T) {
+	defer couchbasearray.SetStore(couchbasearray.GetStore())
+	couchbasearray.SetStore(couchbasearray.NewMemoryStore())
+
+	path := "/TestSafetyChecksServiceMinimums"
+	if err := couchbasearray.SetPlacementPolicy(path, couchbasearray.PlacementPolicy{Minimum: map[string]int{"index": 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := []rest.Node{
+		{OTPNode: "ns_1@10.0.0.1", Hostname: "10.0.0.1:8091", ClusterMembership: "active", Status: "healthy", Services: []string{"kv", "index"}},
+		{OTPNode: "ns_1@10.0.0.2", Hostname: "10.0.0.2:8091", ClusterMembership: "active", Status: "healthy", Services: []string{"kv", "index"}},
+		{OTPNode: "ns_1@10.0.0.3", Hostname: "10.0.0.3:8091", ClusterMembership: "active", Status: "healthy", Services: []string{"kv"}},
+	}
+
+	server := httptest.NewServer(&fakeCluster{nodes: nodes})
+	defer server.Close()
+
+	checks := SafetyChecks{Client: rest.NewClient(server.URL, "Administrator", "password"), Path: path}
+	if err := checks.CheckFailover(nodes[2]); err != nil {
+		t.Fatalf("Expected the failover of a node without index to be allowed got %v", err)
+	}
+
+	err := checks.CheckFailover(nodes[0])
+	if _, ok := err.(*UnsafeError); !ok || IsTransient(err) {
+		t.Fatalf("Expected the failover below the index minimum to be refused got %v", err)
+	}
+
+	if err = checks.CheckEject(nodes, map[string]bool{"ns_1@10.0.0.2": true}); err == nil {
+		t.Fatal("Expected the ejection below the index minimum to be refused")
+	}
+}
@@ -0,0 +1,56 @@
+package rest
+
+import (
+	"net/url"
+	"strconv"
+)
+
+// AutoFailoverSettings are the automatic failover settings of the cluster returned by
+// /settings/autoFailover. Count is how many nodes have been failed over automatically
+// since the quota was last reset.
+type AutoFailoverSettings struct {
+	Enabled                  bool `json:"enabled"`
+	Timeout                  int  `json:"timeout"`
+	MaxCount                 int  `json:"maxCount"`
+	Count                    int  `json:"count"`
+	FailoverServerGroup      bool `json:"failoverServerGroup"`
+	FailoverOnDataDiskIssues struct {
+		Enabled    bool `json:"enabled"`
+		TimePeriod int  `json:"timePeriod"`
+	} `json:"failoverOnDataDiskIssues"`
+}
+
+// AutoFailover returns the automatic failover settings
+func (c *Client) AutoFailover() (*AutoFailoverSettings, error) {
+	var settings AutoFailoverSettings
+	if err := c.get("/settings/autoFailover", &settings); err != nil {
+		return nil, err
+	}
+
+	return &settings, nil
+}
+
+// UpdateAutoFailover sets the automatic failover settings. Count is ignored.
+func (c *Client) UpdateAutoFailover(settings AutoFailoverSettings) error {
+	values := url.Values{
+		"enabled": {strconv.FormatBool(settings.Enabled)},
+	}
+
+	if settings.Enabled {
+		values.Set("timeout", strconv.Itoa(settings.Timeout))
+		values.Set("maxCount", strconv.Itoa(settings.MaxCount))
+		values.Set("failoverServerGroup", strconv.FormatBool(settings.FailoverServerGroup))
+		values.Set("failoverOnDataDiskIssues[enabled]", strconv.FormatBool(settings.FailoverOnDataDiskIssues.Enabled))
+		if settings.FailoverOnDataDiskIssues.Enabled {
+			values.Set("failoverOnDataDiskIssues[timePeriod]", strconv.Itoa(settings.FailoverOnDataDiskIssues.TimePeriod))
+		}
+	}
+
+	return c.post("/settings/autoFailover", values)
+}
+
+// ResetAutoFailoverCount resets the count of automatically failed over nodes, allowing
+// the cluster to fail over another MaxCount nodes
+func (c *Client) ResetAutoFailoverCount() error {
+	return c.post("/settings/autoFailover/resetCount", url.Values{})
+}
@@ -0,0 +1,127 @@
+package rest
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// Bucket is a bucket as returned by /pools/default/buckets
+type Bucket struct {
+	Name               string `json:"name"`
+	BucketType         string `json:"bucketType"`
+	ReplicaNumber      int    `json:"replicaNumber"`
+	EvictionPolicy     string `json:"evictionPolicy"`
+	DurabilityMinLevel string `json:"durabilityMinLevel"`
+	Quota              struct {
+		RAM    int64 `json:"ram"`
+		RawRAM int64 `json:"rawRAM"`
+	} `json:"quota"`
+	Controllers struct {
+		Flush string `json:"flush"`
+	} `json:"controllers"`
+	VBucketServerMap VBucketServerMap `json:"vBucketServerMap"`
+}
+
+// VBucketServerMap places the vBuckets of a bucket on the nodes of the cluster. Every
+// entry of VBucketMap lists the index into ServerList of the node holding the active copy
+// of a vBucket followed by those holding its replicas, with -1 for a missing copy.
+type VBucketServerMap struct {
+	ServerList []string `json:"serverList"`
+	VBucketMap [][]int  `json:"vBucketMap"`
+}
+
+// Host returns the host of the node at index of the server list, empty for a missing copy
+func (m VBucketServerMap) Host(index int) string {
+	if index < 0 || index >= len(m.ServerList) {
+		return ""
+	}
+
+	server := m.ServerList[index]
+	if host, _, err := net.SplitHostPort(server); err == nil {
+		return host
+	}
+
+	return server
+}
+
+// Type returns the bucket type as it is given when creating a bucket
+func (b Bucket) Type() string {
+	if b.BucketType == "membase" {
+		return "couchbase"
+	}
+
+	return b.BucketType
+}
+
+// RAMQuotaMB returns the per node memory quota of the bucket in megabytes
+func (b Bucket) RAMQuotaMB() int {
+	return int(b.Quota.RawRAM / 1024 / 1024)
+}
+
+// FlushEnabled reports whether the bucket can be flushed
+func (b Bucket) FlushEnabled() bool {
+	return b.Controllers.Flush != ""
+}
+
+// BucketSettings are the settings a bucket is created or updated with. Empty strings
+// leave the server default in place.
+type BucketSettings struct {
+	Name               string
+	BucketType         string
+	RAMQuotaMB         int
+	ReplicaNumber      int
+	EvictionPolicy     string
+	FlushEnabled       bool
+	DurabilityMinLevel string
+}
+
+func (s BucketSettings) values() url.Values {
+	data := url.Values{"ramQuotaMB": {strconv.Itoa(s.RAMQuotaMB)}}
+	if s.FlushEnabled {
+		data.Set("flushEnabled", "1")
+	} else {
+		data.Set("flushEnabled", "0")
+	}
+
+	if s.BucketType != "memcached" {
+		data.Set("replicaNumber", strconv.Itoa(s.ReplicaNumber))
+		if s.EvictionPolicy != "" {
+			data.Set("evictionPolicy", s.EvictionPolicy)
+		}
+
+		if s.DurabilityMinLevel != "" {
+			data.Set("durabilityMinLevel", s.DurabilityMinLevel)
+		}
+	}
+
+	return data
+}
+
+// Buckets returns the buckets of the cluster
+func (c *Client) Buckets() ([]Bucket, error) {
+	var buckets []Bucket
+	if err := c.get("/pools/default/buckets", &buckets); err != nil {
+		return nil, err
+	}
+
+	return buckets, nil
+}
+
+// CreateBucket creates a bucket
+func (c *Client) CreateBucket(settings BucketSettings) error {
+	data := settings.values()
+	data.Set("name", settings.Name)
+	data.Set("bucketType", settings.BucketType)
+	return c.post("/pools/default/buckets", data)
+}
+
+// UpdateBucket changes the settings of an existing bucket. The bucket type cannot be changed.
+func (c *Client) UpdateBucket(settings BucketSettings) error {
+	return c.post("/pools/default/buckets/"+url.PathEscape(settings.Name), settings.values())
+}
+
+// DeleteBucket deletes a bucket and all of its data
+func (c *Client) DeleteBucket(name string) error {
+	return c.delete("/pools/default/buckets/" + url.PathEscape(name))
+}
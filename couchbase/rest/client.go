@@ -0,0 +1,499 @@
+// Package rest is a client for the Couchbase Server administration REST API
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPort is the port of the Couchbase administration REST API
+const DefaultPort = 8091
+
+// ErrAlreadyClusterMember is returned by AddNode when the node is already part of the cluster
+var ErrAlreadyClusterMember = errors.New("node is already part of the cluster")
+
+// ErrNodeNotFound is returned when no cluster node matches a host
+var ErrNodeNotFound = errors.New("node not found in cluster")
+
+// ErrGroupNotFound is returned when the cluster has no server group with a name
+var ErrGroupNotFound = errors.New("server group not found in cluster")
+
+// Error is returned when the REST API answers with an unexpected status code
+type Error struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.URL, e.StatusCode, strings.TrimSpace(e.Body))
+}
+
+// Client calls the REST API of one Couchbase node
+type Client struct {
+	BaseURL     string
+	Credentials CredentialsSource
+	HTTPClient  *http.Client
+
+	ctx context.Context
+}
+
+// WithContext returns a copy of the client whose requests are cancelled with ctx
+func (c *Client) WithContext(ctx context.Context) *Client {
+	client := *c
+	client.ctx = ctx
+	return &client
+}
+
+// NewClient creates a client for the node at address, which may be a host, a host and
+// port or a URL. The DefaultPort is used when no port is given.
+func NewClient(address string, username string, password string) *Client {
+	return NewClientWithCredentials(address, StaticCredentials{Username: username, Password: password})
+}
+
+// NewClientWithCredentials creates a client for the node at address which reads the
+// credentials from source for every request
+func NewClientWithCredentials(address string, source CredentialsSource) *Client {
+	return &Client{
+		BaseURL:     baseURL(address, "http"),
+		Credentials: source,
+		HTTPClient:  &http.Client{Timeout: time.Minute},
+	}
+}
+
+// baseURL normalises address to a URL, using scheme when address has none and the
+// default port of the scheme when address has no port
+func baseURL(address string, scheme string) string {
+	if i := strings.Index(address, "://"); i >= 0 {
+		scheme, address = address[:i], address[i+3:]
+	}
+
+	port := DefaultPort
+	if scheme == "https" {
+		port = DefaultTLSPort
+	}
+
+	address = strings.TrimSuffix(address, "/")
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), strconv.Itoa(port))
+	}
+
+	return scheme + "://" + address
+}
+
+// Pool is the cluster overview returned by /pools/default
+type Pool struct {
+	Name            string `json:"name"`
+	ClusterName     string `json:"clusterName"`
+	Nodes           []Node `json:"nodes"`
+	RebalanceStatus string `json:"rebalanceStatus"`
+	Balanced        bool   `json:"balanced"`
+	ServerGroupsURI string `json:"serverGroupsUri"`
+}
+
+// Node is a member of the cluster
+type Node struct {
+	OTPNode           string   `json:"otpNode"`
+	Hostname          string   `json:"hostname"`
+	ClusterMembership string   `json:"clusterMembership"`
+	RecoveryType      string   `json:"recoveryType"`
+	Status            string   `json:"status"`
+	ThisNode          bool     `json:"thisNode"`
+	Services          []string `json:"services"`
+	Version           string   `json:"version"`
+}
+
+// Host returns the host the node is reachable at, without the port
+func (n Node) Host() string {
+	if host, _, err := net.SplitHostPort(n.Hostname); err == nil {
+		return host
+	}
+
+	return n.Hostname
+}
+
+// otpHost returns the host of an otpNode name such as ns_1@10.0.0.1
+func otpHost(otpNode string) string {
+	return otpNode[strings.LastIndex(otpNode, "@")+1:]
+}
+
+// RebalanceProgress is the rebalance state returned by /pools/default/rebalanceProgress
+type RebalanceProgress struct {
+	Status       string             `json:"status"`
+	ErrorMessage string             `json:"errorMessage"`
+	Nodes        map[string]float64 `json:"-"`
+}
+
+// Running reports whether a rebalance is in progress
+func (p RebalanceProgress) Running() bool {
+	return p.Status == "running"
+}
+
+// UnmarshalJSON reads the status along with the per node progress keyed by otpNode
+func (p *RebalanceProgress) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	p.Nodes = make(map[string]float64)
+	for key, value := range fields {
+		var err error
+		switch key {
+		case "status":
+			err = json.Unmarshal(value, &p.Status)
+		case "errorMessage":
+			err = json.Unmarshal(value, &p.ErrorMessage)
+		default:
+			var node struct {
+				Progress float64 `json:"progress"`
+			}
+			if json.Unmarshal(value, &node) == nil {
+				p.Nodes[key] = node.Progress
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Task is an entry of /pools/default/tasks
+type Task struct {
+	Type                     string  `json:"type"`
+	Subtype                  string  `json:"subtype"`
+	Status                   string  `json:"status"`
+	StatusID                 string  `json:"statusId"`
+	Progress                 float64 `json:"progress"`
+	ErrorMessage             string  `json:"errorMessage"`
+	StatusIsStale            bool    `json:"statusIsStale"`
+	RecommendedRefreshPeriod float64 `json:"recommendedRefreshPeriod"`
+	LastReportURI            string  `json:"lastReportURI"`
+	Bucket                   string  `json:"bucket"`
+	Source                   string  `json:"source"`
+	Index                    string  `json:"index"`
+	ChangesLeft              int64   `json:"changesLeft"`
+	PerNode                  map[string]struct {
+		Progress float64 `json:"progress"`
+	} `json:"perNode"`
+}
+
+// Running reports whether the task is running
+func (t Task) Running() bool {
+	return t.Status == "running"
+}
+
+// NodeProgress returns the progress percentage of every node taking part in the task
+func (t Task) NodeProgress() map[string]float64 {
+	progress := make(map[string]float64)
+	for otpNode, node := range t.PerNode {
+		progress[otpNode] = node.Progress
+	}
+
+	return progress
+}
+
+// Pool returns the overview of the default pool
+func (c *Client) Pool() (*Pool, error) {
+	var pool Pool
+	if err := c.get("/pools/default", &pool); err != nil {
+		return nil, err
+	}
+
+	return &pool, nil
+}
+
+// Nodes returns the members of the cluster
+func (c *Client) Nodes() ([]Node, error) {
+	pool, err := c.Pool()
+	if err != nil {
+		return nil, err
+	}
+
+	return pool.Nodes, nil
+}
+
+// OTPNodes returns the otpNode names of every member of the cluster
+func (c *Client) OTPNodes() ([]string, error) {
+	nodes, err := c.Nodes()
+	if err != nil {
+		return nil, err
+	}
+
+	otpNodes := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		otpNodes = append(otpNodes, node.OTPNode)
+	}
+
+	return otpNodes, nil
+}
+
+// Node returns the member of the cluster reachable at host, matched as FindNode does
+func (c *Client) Node(host string) (*Node, error) {
+	nodes, err := c.Nodes()
+	if err != nil {
+		return nil, err
+	}
+
+	if node, ok := FindNode(nodes, host); ok {
+		return node, nil
+	}
+
+	return nil, ErrNodeNotFound
+}
+
+// FindNode returns the node of nodes reachable at host. A host name also matches a node
+// known by a longer or shorter form of the same name, such as the pod name of a
+// StatefulSet and its fully qualified service name, unless a node matches exactly.
+func FindNode(nodes []Node, host string) (*Node, bool) {
+	for i := range nodes {
+		if nodes[i].Host() == host || otpHost(nodes[i].OTPNode) == host {
+			return &nodes[i], true
+		}
+	}
+
+	for i := range nodes {
+		if sameHostName(nodes[i].Host(), host) || sameHostName(otpHost(nodes[i].OTPNode), host) {
+			return &nodes[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// sameHostName reports whether a and b are forms of the same DNS name, one being the
+// other followed by further domain labels. IP addresses only match exactly.
+func sameHostName(a string, b string) bool {
+	if a == "" || b == "" || net.ParseIP(a) != nil || net.ParseIP(b) != nil {
+		return false
+	}
+
+	a, b = strings.ToLower(strings.TrimSuffix(a, ".")), strings.ToLower(strings.TrimSuffix(b, "."))
+	return a == b || strings.HasPrefix(a, b+".") || strings.HasPrefix(b, a+".")
+}
+
+// OTPNode returns the otpNode name of the member of the cluster reachable at host
+func (c *Client) OTPNode(host string) (string, error) {
+	node, err := c.Node(host)
+	if err != nil {
+		return "", err
+	}
+
+	return node.OTPNode, nil
+}
+
+// Tasks returns the tasks running in the cluster
+func (c *Client) Tasks() ([]Task, error) {
+	var tasks []Task
+	if err := c.get("/pools/default/tasks", &tasks); err != nil {
+		return nil, err
+	}
+
+	return tasks, nil
+}
+
+// RebalanceTask returns the rebalance task. Once a rebalance has stopped its ErrorMessage
+// holds the reason it failed or was stopped, which is empty when it succeeded.
+func (c *Client) RebalanceTask() (*Task, error) {
+	tasks, err := c.Tasks()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, task := range tasks {
+		if task.Type == "rebalance" {
+			return &task, nil
+		}
+	}
+
+	return &Task{Type: "rebalance", Status: "notRunning"}, nil
+}
+
+// RebalanceProgress returns the progress of the current rebalance
+func (c *Client) RebalanceProgress() (*RebalanceProgress, error) {
+	var progress RebalanceProgress
+	if err := c.get("/pools/default/rebalanceProgress", &progress); err != nil {
+		return nil, err
+	}
+
+	return &progress, nil
+}
+
+// WaitForRebalance polls every interval until no rebalance is running
+func (c *Client) WaitForRebalance(interval time.Duration) error {
+	for {
+		progress, err := c.RebalanceProgress()
+		if err != nil {
+			return err
+		}
+
+		if !progress.Running() {
+			return nil
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// SetAutoFailover enables automatic failover after timeoutInSeconds
+func (c *Client) SetAutoFailover(timeoutInSeconds int) error {
+	return c.post("/settings/autoFailover", url.Values{
+		"enabled": {"true"},
+		"timeout": {strconv.Itoa(timeoutInSeconds)}})
+}
+
+// AddNode adds the node at hostname to the cluster running services, authenticating
+// to the joining node with the cluster credentials. It returns ErrAlreadyClusterMember
+// if the node is already part of the cluster.
+func (c *Client) AddNode(hostname string, services []string) error {
+	return c.addNode("/controller/addNode", hostname, services)
+}
+
+// addNode adds a node through the add node endpoint at path
+func (c *Client) addNode(path string, hostname string, services []string) error {
+	if c.Credentials == nil {
+		return ErrNoCredentials
+	}
+
+	credentials, err := c.Credentials.Credentials()
+	if err != nil {
+		return err
+	}
+
+	err = c.post(path, url.Values{
+		"hostname": {hostname},
+		"user":     {credentials.Username},
+		"password": {credentials.Password},
+		"services": {strings.Join(services, ",")}})
+	if restErr, ok := err.(*Error); ok && strings.Contains(restErr.Body, "Node is already part of cluster") {
+		return ErrAlreadyClusterMember
+	}
+
+	return err
+}
+
+// SetRecoveryType marks a failed over node for delta or full recovery
+func (c *Client) SetRecoveryType(otpNode string, recoveryType string) error {
+	return c.post("/controller/setRecoveryType", url.Values{
+		"otpNode":      {otpNode},
+		"recoveryType": {recoveryType}})
+}
+
+// Rebalance starts a rebalance of knownNodes, ejecting ejectedNodes
+func (c *Client) Rebalance(knownNodes []string, ejectedNodes []string) error {
+	return c.post("/controller/rebalance", url.Values{
+		"knownNodes":   {strings.Join(knownNodes, ",")},
+		"ejectedNodes": {strings.Join(ejectedNodes, ",")}})
+}
+
+// StartGracefulFailover starts moving the active vBuckets away from otpNode before failing it over
+func (c *Client) StartGracefulFailover(otpNode string) error {
+	return c.post("/controller/startGracefulFailover", url.Values{"otpNode": {otpNode}})
+}
+
+// Failover immediately fails over otpNode
+func (c *Client) Failover(otpNode string) error {
+	return c.post("/controller/failOver", url.Values{"otpNode": {otpNode}})
+}
+
+func (c *Client) get(path string, result interface{}) error {
+	req, err := http.NewRequest("GET", c.BaseURL+path, nil)
+	if err != nil {
+		return err
+	}
+
+	body, err := c.do(req)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(body, result)
+}
+
+func (c *Client) post(path string, data url.Values) error {
+	req, err := http.NewRequest("POST", c.BaseURL+path, bytes.NewBufferString(data.Encode()))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, err = c.do(req)
+	return err
+}
+
+func (c *Client) putJSON(path string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", c.BaseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	_, err = c.do(req)
+	return err
+}
+
+func (c *Client) delete(path string) error {
+	req, err := http.NewRequest("DELETE", c.BaseURL+path, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.do(req)
+	return err
+}
+
+func (c *Client) do(req *http.Request) ([]byte, error) {
+	if c.Credentials != nil {
+		credentials, err := c.Credentials.Credentials()
+		if err != nil {
+			return nil, err
+		}
+
+		req.SetBasicAuth(credentials.Username, credentials.Password)
+	}
+
+	if c.ctx != nil {
+		req = req.WithContext(c.ctx)
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &Error{Method: req.Method, URL: req.URL.String(), StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	return body, nil
+}
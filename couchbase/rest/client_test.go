@@ -0,0 +1,232 @@
+package rest
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCouchbase is a minimal Couchbase administration API
+type fakeCouchbase struct {
+	mutex     sync.Mutex
+	nodes     []Node
+	rebalance []string
+	requests  map[string][]string
+}
+
+func newFakeCouchbase(hosts ...string) (*fakeCouchbase, *httptest.Server) {
+	fake := &fakeCouchbase{requests: make(map[string][]string)}
+	for _, host := range hosts {
+		fake.nodes = append(fake.nodes, Node{
+			OTPNode:           "ns_1@" + host,
+			Hostname:          host + ":8091",
+			ClusterMembership: "active",
+			Status:            "healthy",
+			Services:          []string{"kv"}})
+	}
+
+	return fake, httptest.NewServer(fake)
+}
+
+// newTLSServer creates an unstarted HTTPS server for fake
+func newTLSServer(fake *fakeCouchbase) *httptest.Server {
+	server := httptest.NewUnstartedServer(fake)
+	server.TLS = &tls.Config{}
+	return server
+}
+
+func (f *fakeCouchbase) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if username, password, ok := r.BasicAuth(); !ok || username != "Administrator" || password != "password" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	r.ParseForm()
+	for key, values := range r.PostForm {
+		f.requests[r.URL.Path+"#"+key] = values
+	}
+
+	switch r.URL.Path {
+	case "/pools/default":
+		json.NewEncoder(w).Encode(Pool{Name: "default", Nodes: f.nodes, RebalanceStatus: "none"})
+	case "/pools/default/tasks":
+		if len(f.rebalance) == 0 {
+			w.Write([]byte(`[{"type":"rebalance","status":"notRunning","errorMessage":"Rebalance stopped by user."}]`))
+			return
+		}
+		w.Write([]byte(`[{"type":"rebalance","status":"running","progress":50,"perNode":{"ns_1@10.0.0.1":{"progress":40}}}]`))
+	case "/pools/default/rebalanceProgress":
+		if len(f.rebalance) == 0 {
+			w.Write([]byte(`{"status":"none"}`))
+			return
+		}
+		w.Write([]byte(`{"status":"running","ns_1@10.0.0.1":{"progress":0.5}}`))
+		f.rebalance = f.rebalance[1:]
+	case "/controller/addNode":
+		hostname := r.PostFormValue("hostname")
+		for _, node := range f.nodes {
+			if node.Host() == hostname {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`["Prepare join failed. Node is already part of cluster."]`))
+				return
+			}
+		}
+		f.nodes = append(f.nodes, Node{OTPNode: "ns_1@" + hostname, Hostname: hostname + ":8091", ClusterMembership: "inactiveAdded"})
+	case "/controller/rebalance":
+		f.rebalance = []string{"running", "running"}
+	case "/controller/setRecoveryType", "/controller/startGracefulFailover", "/controller/failOver", "/settings/autoFailover":
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	for address, expected := range map[string]string{
+		"10.0.0.1":                   "http://10.0.0.1:8091",
+		"10.0.0.1:18091":             "http://10.0.0.1:18091",
+		"https://couchbase-0:18091/": "https://couchbase-0:18091",
+		"fe80::1":                    "http://[fe80::1]:8091",
+	} {
+		if actual := baseURL(address, "http"); actual != expected {
+			t.Fatalf("Expected %s for %s got %s", expected, address, actual)
+		}
+	}
+}
+
+func TestClientNodes(t *testing.T) {
+	_, server := newFakeCouchbase("10.0.0.1", "10.0.0.2")
+	defer server.Close()
+
+	client := NewClient(server.URL, "Administrator", "password")
+	otpNodes, err := client.OTPNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(otpNodes, ",") != "ns_1@10.0.0.1,ns_1@10.0.0.2" {
+		t.Fatalf("Unexpected otp nodes %v", otpNodes)
+	}
+
+	otpNode, err := client.OTPNode("10.0.0.2")
+	if err != nil || otpNode != "ns_1@10.0.0.2" {
+		t.Fatalf("Expected ns_1@10.0.0.2 got %s %v", otpNode, err)
+	}
+
+	if _, err = client.OTPNode("10.0.0.20"); err != ErrNodeNotFound {
+		t.Fatalf("Expected ErrNodeNotFound got %v", err)
+	}
+}
+
+func TestClientNodeHostNames(t *testing.T) {
+	_, server := newFakeCouchbase("couchbase-0.couchbase.default.svc.cluster.local", "couchbase-1.couchbase.default.svc.cluster.local")
+	defer server.Close()
+
+	client := NewClient(server.URL, "Administrator", "password")
+	for host, expected := range map[string]string{
+		"couchbase-1":                   "ns_1@couchbase-1.couchbase.default.svc.cluster.local",
+		"couchbase-1.couchbase":         "ns_1@couchbase-1.couchbase.default.svc.cluster.local",
+		"COUCHBASE-0.couchbase.default": "ns_1@couchbase-0.couchbase.default.svc.cluster.local",
+	} {
+		if otpNode, err := client.OTPNode(host); err != nil || otpNode != expected {
+			t.Fatalf("Expected %s for %s got %s %v", expected, host, otpNode, err)
+		}
+	}
+
+	if _, err := client.OTPNode("couchbase-10"); err != ErrNodeNotFound {
+		t.Fatalf("Expected ErrNodeNotFound got %v", err)
+	}
+
+	// progress reports only know nodes by their otpNode name
+	nodes := []Node{{OTPNode: "ns_1@couchbase-0.couchbase.default.svc.cluster.local"}, {OTPNode: "ns_1@10.0.0.1"}}
+	if node, ok := FindNode(nodes, "couchbase-0"); !ok || node != &nodes[0] {
+		t.Fatalf("Expected the node to be found by its otpNode name got %v", node)
+	}
+
+	if _, ok := FindNode(nodes, "10.0.0"); ok {
+		t.Fatal("Expected IP addresses to match only exactly")
+	}
+}
+
+func TestClientAddNodeAndRebalance(t *testing.T) {
+	fake, server := newFakeCouchbase("10.0.0.1")
+	defer server.Close()
+
+	client := NewClient(server.URL, "Administrator", "password")
+	if err := client.AddNode("10.0.0.2", []string{"kv", "index"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if services := fake.requests["/controller/addNode#services"]; len(services) != 1 || services[0] != "kv,index" {
+		t.Fatalf("Unexpected services %v", services)
+	}
+
+	if err := client.AddNode("10.0.0.2", []string{"kv"}); err != ErrAlreadyClusterMember {
+		t.Fatalf("Expected ErrAlreadyClusterMember got %v", err)
+	}
+
+	if err := client.Rebalance([]string{"ns_1@10.0.0.1", "ns_1@10.0.0.2"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	progress, err := client.RebalanceProgress()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !progress.Running() || progress.Nodes["ns_1@10.0.0.1"] != 0.5 {
+		t.Fatalf("Unexpected progress %+v", progress)
+	}
+
+	tasks, err := client.Tasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tasks) != 1 || tasks[0].Type != "rebalance" || !tasks[0].Running() || tasks[0].NodeProgress()["ns_1@10.0.0.1"] != 40 {
+		t.Fatalf("Unexpected tasks %+v", tasks)
+	}
+
+	if err = client.WaitForRebalance(time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	if progress, err = client.RebalanceProgress(); err != nil || progress.Running() {
+		t.Fatalf("Expected rebalance to have finished got %+v %v", progress, err)
+	}
+
+	task, err := client.RebalanceTask()
+	if err != nil || task.Running() || task.ErrorMessage != "Rebalance stopped by user." {
+		t.Fatalf("Expected the stopped rebalance to be reported got %+v %v", task, err)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	_, server := newFakeCouchbase("10.0.0.1")
+	defer server.Close()
+
+	client := NewClient(server.URL, "Administrator", "wrong")
+	_, err := client.Pool()
+	restErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("Expected *Error got %v", err)
+	}
+
+	if restErr.StatusCode != http.StatusUnauthorized || restErr.Method != "GET" {
+		t.Fatalf("Unexpected error %+v", restErr)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = NewClient(server.URL, "Administrator", "password").WithContext(ctx).Pool(); err == nil || !strings.Contains(err.Error(), "context canceled") {
+		t.Fatalf("Expected the cancelled request to fail got %v", err)
+	}
+}
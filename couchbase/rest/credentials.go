@@ -0,0 +1,96 @@
+package rest
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNoCredentials is returned when a credentials source has no username or password
+var ErrNoCredentials = errors.New("no couchbase credentials")
+
+// Credentials are the administrator username and password of the cluster
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// CredentialsSource supplies the credentials for each request, so rotated credentials
+// are picked up without recreating the client
+type CredentialsSource interface {
+	Credentials() (Credentials, error)
+}
+
+// StaticCredentials always supplies the same credentials
+type StaticCredentials Credentials
+
+// Credentials returns the static credentials
+func (c StaticCredentials) Credentials() (Credentials, error) {
+	return Credentials(c), nil
+}
+
+// EnvCredentials reads the credentials from environment variables
+type EnvCredentials struct {
+	UsernameVar string
+	PasswordVar string
+}
+
+// Credentials returns the credentials currently set in the environment
+func (c EnvCredentials) Credentials() (Credentials, error) {
+	credentials := Credentials{Username: os.Getenv(c.UsernameVar), Password: os.Getenv(c.PasswordVar)}
+	if credentials.Username == "" || credentials.Password == "" {
+		return credentials, ErrNoCredentials
+	}
+
+	return credentials, nil
+}
+
+// FileCredentials reads the credentials from a mounted secret. Path is either a directory
+// holding username and password files, as Kubernetes and Docker mount secrets, or a file
+// holding the username and password on separate lines.
+type FileCredentials struct {
+	Path string
+}
+
+// Credentials reads the secret, so a rotated secret is used by the next request
+func (c FileCredentials) Credentials() (Credentials, error) {
+	var credentials Credentials
+	info, err := os.Stat(c.Path)
+	if err != nil {
+		return credentials, err
+	}
+
+	if info.IsDir() {
+		username, err := ioutil.ReadFile(filepath.Join(c.Path, "username"))
+		if err != nil {
+			return credentials, err
+		}
+
+		password, err := ioutil.ReadFile(filepath.Join(c.Path, "password"))
+		if err != nil {
+			return credentials, err
+		}
+
+		credentials.Username = strings.TrimSpace(string(username))
+		credentials.Password = strings.TrimRight(string(password), "\r\n")
+	} else {
+		contents, err := ioutil.ReadFile(c.Path)
+		if err != nil {
+			return credentials, err
+		}
+
+		lines := strings.SplitN(strings.TrimRight(string(contents), "\r\n"), "\n", 2)
+		credentials.Username = strings.TrimSpace(lines[0])
+		if len(lines) == 2 {
+			credentials.Password = strings.TrimRight(lines[1], "\r\n")
+		}
+	}
+
+	if credentials.Username == "" || credentials.Password == "" {
+		return credentials, ErrNoCredentials
+	}
+
+	return credentials, nil
+}
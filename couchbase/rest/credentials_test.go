@@ -0,0 +1,55 @@
+package rest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "username"), []byte("admin\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "password"), []byte("secret\n"), 0600)
+	credentials, err := FileCredentials{Path: dir}.Credentials()
+	if err != nil || credentials != (Credentials{"admin", "secret"}) {
+		t.Fatalf("Unexpected credentials %v %v", credentials, err)
+	}
+
+	file := filepath.Join(dir, "credentials")
+	ioutil.WriteFile(file, []byte("admin\nrotated\n"), 0600)
+	credentials, err = FileCredentials{Path: file}.Credentials()
+	if err != nil || credentials != (Credentials{"admin", "rotated"}) {
+		t.Fatalf("Unexpected credentials %v %v", credentials, err)
+	}
+
+	ioutil.WriteFile(file, []byte("admin\n"), 0600)
+	if _, err = (FileCredentials{Path: file}).Credentials(); err != ErrNoCredentials {
+		t.Fatalf("Expected ErrNoCredentials got %v", err)
+	}
+}
+
+func TestClientRotatedCredentials(t *testing.T) {
+	_, server := newFakeCouchbase("10.0.0.1")
+	defer server.Close()
+
+	os.Setenv("TEST_COUCHBASE_USERNAME", "Administrator")
+	os.Setenv("TEST_COUCHBASE_PASSWORD", "wrong")
+	defer os.Unsetenv("TEST_COUCHBASE_USERNAME")
+	defer os.Unsetenv("TEST_COUCHBASE_PASSWORD")
+
+	client := NewClientWithCredentials(server.URL, EnvCredentials{"TEST_COUCHBASE_USERNAME", "TEST_COUCHBASE_PASSWORD"})
+	if _, err := client.Pool(); err == nil {
+		t.Fatal("Expected the wrong password to be rejected")
+	}
+
+	os.Setenv("TEST_COUCHBASE_PASSWORD", "password")
+	if _, err := client.Pool(); err != nil {
+		t.Fatal(err)
+	}
+}
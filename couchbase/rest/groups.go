@@ -0,0 +1,91 @@
+package rest
+
+import (
+	"net/url"
+)
+
+// ServerGroups are the server groups of the cluster returned by /pools/default/serverGroups.
+// URI carries the revision the groups were read at and is required to update them.
+type ServerGroups struct {
+	Groups []ServerGroup `json:"groups"`
+	URI    string        `json:"uri"`
+}
+
+// ServerGroup is a failure domain replicas are spread across
+type ServerGroup struct {
+	Name       string `json:"name"`
+	URI        string `json:"uri"`
+	AddNodeURI string `json:"addNodeURI"`
+	Nodes      []Node `json:"nodes"`
+}
+
+// Group returns the group called name
+func (g *ServerGroups) Group(name string) (*ServerGroup, bool) {
+	for i := range g.Groups {
+		if g.Groups[i].Name == name {
+			return &g.Groups[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// ServerGroups returns the server groups of the cluster
+func (c *Client) ServerGroups() (*ServerGroups, error) {
+	var groups ServerGroups
+	if err := c.get("/pools/default/serverGroups", &groups); err != nil {
+		return nil, err
+	}
+
+	return &groups, nil
+}
+
+// CreateServerGroup creates an empty server group
+func (c *Client) CreateServerGroup(name string) error {
+	return c.post("/pools/default/serverGroups", url.Values{"name": {name}})
+}
+
+// UpdateServerGroups moves nodes between groups. Every node of the cluster must be a
+// member of exactly one group and the update is rejected if the groups changed since
+// they were read.
+func (c *Client) UpdateServerGroups(groups *ServerGroups) error {
+	type member struct {
+		OTPNode string `json:"otpNode"`
+	}
+
+	type group struct {
+		Name  string   `json:"name"`
+		URI   string   `json:"uri"`
+		Nodes []member `json:"nodes"`
+	}
+
+	body := struct {
+		Groups []group `json:"groups"`
+	}{}
+	for _, g := range groups.Groups {
+		members := []member{}
+		for _, node := range g.Nodes {
+			members = append(members, member{node.OTPNode})
+		}
+		body.Groups = append(body.Groups, group{Name: g.Name, URI: g.URI, Nodes: members})
+	}
+
+	return c.putJSON(groups.URI, body)
+}
+
+// AddNodeToGroup adds the node at hostname to the cluster in the server group called
+// group, running services. It returns ErrAlreadyClusterMember if the node is already part
+// of the cluster and ErrGroupNotFound if there is no such group.
+func (c *Client) AddNodeToGroup(group string, hostname string, services []string) error {
+	groups, err := c.ServerGroups()
+	if err != nil {
+		return err
+	}
+
+	serverGroup, ok := groups.Group(group)
+	if !ok {
+		return ErrGroupNotFound
+	}
+
+	return c.addNode(serverGroup.AddNodeURI, hostname, services)
+}
@@ -0,0 +1,106 @@
+package rest
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// PoolSettings are the cluster wide memory quotas in megabytes and the cluster name.
+// Zero quotas and an empty name are left unchanged.
+type PoolSettings struct {
+	ClusterName         string
+	MemoryQuota         int
+	IndexMemoryQuota    int
+	FTSMemoryQuota      int
+	CBASMemoryQuota     int
+	EventingMemoryQuota int
+}
+
+// Initialized reports whether the node has been provisioned into a cluster
+func (c *Client) Initialized() (bool, error) {
+	var pools struct {
+		Pools []struct {
+			Name string `json:"name"`
+		} `json:"pools"`
+	}
+
+	if err := c.get("/pools", &pools); err != nil {
+		return false, err
+	}
+
+	return len(pools.Pools) > 0, nil
+}
+
+// SetNodePaths sets where the node stores data and indexes
+func (c *Client) SetNodePaths(dataPath string, indexPath string) error {
+	data := url.Values{}
+	if dataPath != "" {
+		data.Set("path", dataPath)
+	}
+
+	if indexPath != "" {
+		data.Set("index_path", indexPath)
+	}
+
+	return c.post("/nodes/self/controller/settings", data)
+}
+
+// NodeServices returns the services the node runs, which are empty until they are set up
+func (c *Client) NodeServices() ([]string, error) {
+	var self struct {
+		Services []string `json:"services"`
+	}
+
+	if err := c.get("/nodes/self", &self); err != nil {
+		return nil, err
+	}
+
+	return self.Services, nil
+}
+
+// SetupServices sets the services an uninitialized node runs
+func (c *Client) SetupServices(services []string) error {
+	return c.post("/node/controller/setupServices", url.Values{"services": {strings.Join(services, ",")}})
+}
+
+// SetPoolSettings sets the memory quotas and name of the cluster
+func (c *Client) SetPoolSettings(settings PoolSettings) error {
+	data := url.Values{}
+	if settings.ClusterName != "" {
+		data.Set("clusterName", settings.ClusterName)
+	}
+
+	for key, quota := range map[string]int{
+		"memoryQuota":         settings.MemoryQuota,
+		"indexMemoryQuota":    settings.IndexMemoryQuota,
+		"ftsMemoryQuota":      settings.FTSMemoryQuota,
+		"cbasMemoryQuota":     settings.CBASMemoryQuota,
+		"eventingMemoryQuota": settings.EventingMemoryQuota,
+	} {
+		if quota > 0 {
+			data.Set(key, strconv.Itoa(quota))
+		}
+	}
+
+	return c.post("/pools/default", data)
+}
+
+// SetIndexStorageMode sets how the index service stores indexes, such as plasma or memory_optimized
+func (c *Client) SetIndexStorageMode(mode string) error {
+	return c.post("/settings/indexes", url.Values{"storageMode": {mode}})
+}
+
+// RenameNode sets the name the node is known by in the cluster, which is only possible
+// before it has joined other nodes
+func (c *Client) RenameNode(hostname string) error {
+	return c.post("/node/controller/rename", url.Values{"hostname": {hostname}})
+}
+
+// SetWebSettings sets the administrator credentials, keeping the current port
+func (c *Client) SetWebSettings(credentials Credentials) error {
+	return c.post("/settings/web", url.Values{
+		"username": {credentials.Username},
+		"password": {credentials.Password},
+		"port":     {"SAME"}})
+}
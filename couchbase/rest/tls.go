@@ -0,0 +1,72 @@
+package rest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// DefaultTLSPort is the HTTPS port of the Couchbase administration REST API
+const DefaultTLSPort = 18091
+
+// TLSOptions configures HTTPS to the administration REST API
+type TLSOptions struct {
+	// CAFile holds the certificates node certificates are verified against. The system
+	// roots are used when it is empty.
+	CAFile string
+	// CertFile and KeyFile hold a client certificate presented for mutual TLS
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name node certificates are verified against
+	ServerName string
+}
+
+// Config builds the tls.Config described by the options
+func (o TLSOptions) Config() (*tls.Config, error) {
+	config := &tls.Config{ServerName: o.ServerName, MinVersion: tls.VersionTLS12}
+	if o.CertFile != "" || o.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	if o.CAFile != "" {
+		caCert, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("no certificates found in " + o.CAFile)
+		}
+	}
+
+	return config, nil
+}
+
+// NewTLSHTTPClient creates an HTTPS client with config, to be built once and shared by
+// every client from NewTLSClient so their connections and TLS sessions are reused
+func NewTLSHTTPClient(config *tls.Config) *http.Client {
+	return &http.Client{
+		Timeout:   time.Minute,
+		Transport: &http.Transport{TLSClientConfig: config},
+	}
+}
+
+// NewTLSClient creates a client for the node at address over HTTPS through httpClient,
+// see NewTLSHTTPClient, using DefaultTLSPort when no port is given. A client certificate
+// in its config authenticates the client when source is nil.
+func NewTLSClient(address string, source CredentialsSource, httpClient *http.Client) *Client {
+	return &Client{
+		BaseURL:     baseURL(address, "https"),
+		Credentials: source,
+		HTTPClient:  httpClient,
+	}
+}
@@ -0,0 +1,112 @@
+package rest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeClientCertificate writes a self signed client certificate and key into dir
+func writeClientCertificate(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "couchbase-node-announce"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certificate, certFile, keyFile
+}
+
+func TestTLSClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fake, plain := newFakeCouchbase("10.0.0.1")
+	plain.Close()
+	server := newTLSServer(fake)
+	defer server.Close()
+
+	clientCert, certFile, keyFile := writeClientCertificate(t, dir)
+	server.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	server.TLS.ClientCAs = x509.NewCertPool()
+	server.TLS.ClientCAs.AddCert(clientCert)
+	server.StartTLS()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+
+	credentials := StaticCredentials{Username: "Administrator", Password: "password"}
+	config, err := TLSOptions{CAFile: caFile}.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = NewTLSClient(server.URL, credentials, NewTLSHTTPClient(config)).Pool(); err == nil {
+		t.Fatal("Expected the server to require a client certificate")
+	}
+
+	config, err = TLSOptions{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = NewTLSClient(server.URL, credentials, NewTLSHTTPClient(config)).Pool(); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err = TLSOptions{CertFile: certFile, KeyFile: keyFile}.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = NewTLSClient(server.URL, credentials, NewTLSHTTPClient(config)).Pool(); err == nil {
+		t.Fatal("Expected the server certificate to be verified")
+	}
+
+	if _, err = (TLSOptions{CAFile: keyFile}).Config(); err == nil {
+		t.Fatal("Expected a CA file without certificates to be rejected")
+	}
+}
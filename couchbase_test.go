@@ -4,12 +4,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/pborman/uuid"
 )
 
+func TestMain(m *testing.M) {
+	if os.Getenv("ETCDCTL_PEERS") == "" {
+		SetStore(NewMemoryStore())
+	}
+
+	os.Exit(m.Run())
+}
+
 func TestClusterScenarios(t *testing.T) {
 	path := "/TestClusterInitialization"
 	if err := ClearClusterStates(path); err != nil {
@@ -21,12 +30,12 @@ func TestClusterScenarios(t *testing.T) {
 	//
 	//	First cluster boostrap
 	//
-	_, err := CreateTestNodes(path, 2)
+	announcements, err := CreateTestNodes(path, 2)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	currentStates, err := Schedule(path)
+	currentStates, err := ScheduleTestPass(path)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -34,24 +43,16 @@ func TestClusterScenarios(t *testing.T) {
 	log.Println("Current States")
 	log.Println(currentStates)
 
-	log.Println(currentStates)
+	masterFound := false
 	for _, state := range currentStates {
 		if state.DesiredState != SchedulerStateNew {
-			t.Fatal("Expected state should be 'new'")
+			t.Fatal("Expected desired state should be 'new'")
 		}
 
-		if state.State != SchedulerStateEmpty {
-			t.Fatal("Expected state should be ''")
+		if state.State != SchedulerStateNew {
+			t.Fatal("Expected state should be 'new'")
 		}
-	}
-	//
-	// Transition status to 'new'
-	// Expect to be transition to 'clustered'
-	//
-	masterFound := false
-	for key, state := range currentStates {
-		state.State = state.DesiredState
-		currentStates[key] = state
+
 		if !masterFound && state.Master {
 			masterFound = true
 		}
@@ -60,10 +61,15 @@ func TestClusterScenarios(t *testing.T) {
 	if !masterFound {
 		t.Fatal("Expected a master to be selected")
 	}
+	//
+	// Nodes report status 'new'
+	// Expect the master to transition to 'adding' and the others to wait for it
+	//
+	if err = AnnounceTestNodes(path, announcements, SchedulerStateNew); err != nil {
+		t.Fatal(err)
+	}
 
-	SaveClusterStates(path, currentStates)
-
-	currentStates, err = Schedule(path)
+	currentStates, err = ScheduleTestPass(path)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -71,10 +77,13 @@ func TestClusterScenarios(t *testing.T) {
 	log.Println("Current States")
 	log.Println(currentStates)
 
-	log.Println(currentStates)
 	for _, state := range currentStates {
-		if state.DesiredState != SchedulerStateClustered {
-			t.Fatal("Expected state should be 'clustered'")
+		if state.Master && state.DesiredState != SchedulerStateAdding {
+			t.Fatal("Expected master desired state should be 'adding'")
+		}
+
+		if !state.Master && state.DesiredState != SchedulerStateNew {
+			t.Fatal("Expected desired state should stay 'new' until the master is initialized")
 		}
 
 		if state.State != SchedulerStateNew {
@@ -82,70 +91,85 @@ func TestClusterScenarios(t *testing.T) {
 		}
 	}
 	//
-	// 	Transition to clustered
-	//	Simulate non master machine reboot
-	// 	Expect non master to be reset to desired state 'new'
+	// Master reports status 'adding' once it has initialized the cluster
+	// Expect the others to transition to 'adding'
 	//
-	var nonMasterKey string
 	for key, state := range currentStates {
-		state.State = state.DesiredState
-		if !state.Master {
-			state.SessionID = uuid.New()
-			nonMasterKey = key
+		if state.Master {
+			master := announcements[key]
+			master.State = SchedulerStateAdding
+			announcements[key] = master
+			if err = SetClusterAnnouncement(path, master); err != nil {
+				t.Fatal(err)
+			}
 		}
+	}
 
-		currentStates[key] = state
+	currentStates, err = ScheduleTestPass(path)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	SaveClusterStates(path, currentStates)
+	for _, state := range currentStates {
+		if !state.Master && (state.DesiredState != SchedulerStateAdding || state.State != SchedulerStateNew) {
+			t.Fatal("Expected desired state should be 'adding'")
+		}
+	}
+	//
+	// Nodes report status 'adding'
+	// Expect them to wait in 'adding' for the rebalance
+	//
+	if err = AnnounceTestNodes(path, announcements, SchedulerStateAdding); err != nil {
+		t.Fatal(err)
+	}
 
-	currentStates, err = Schedule(path)
+	currentStates, err = ScheduleTestPass(path)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	log.Println("Current States")
-	log.Println(currentStates)
+	for _, state := range currentStates {
+		if state.DesiredState != SchedulerStateAdding {
+			t.Fatal("Expected desired state should be 'adding'")
+		}
 
-	log.Println(currentStates)
-	for key, state := range currentStates {
-		if state.State != SchedulerStateClustered {
-			if key == nonMasterKey {
-				if state.State != SchedulerStateEmpty {
-					t.Fatal("Expected state should be ''")
-				}
-
-				if state.DesiredState != SchedulerStateNew {
-					t.Fatal("Expected state should be 'new'")
-				}
-
-				if state.Master {
-					t.Fatal("Expected state should not be 'mast'")
-				}
-			} else {
-				t.Fatal("Expected state should be 'clustered'")
-			}
+		if state.State != SchedulerStateAdding {
+			t.Fatal("Expected state should be 'adding'")
 		}
 	}
 	//
-	//  Transition both nodes to clustered
-	//	Simulate master machine reboot
-	// 	Expect master to be reset to desired state 'new'
+	// Nodes report status 'clustered' once rebalanced
+	// Expect both nodes to be clustered
 	//
-	var masterKey string
-	for key, state := range currentStates {
-		state.State = SchedulerStateClustered
-		if !state.Master {
-			state.SessionID = uuid.New()
-			masterKey = key
-		}
+	if err = AnnounceTestNodes(path, announcements, SchedulerStateClustered); err != nil {
+		t.Fatal(err)
+	}
+
+	currentStates, err = ScheduleTestPass(path)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-		currentStates[key] = state
+	for _, state := range currentStates {
+		if state.State != SchedulerStateClustered || state.DesiredState != SchedulerStateClustered {
+			t.Fatal("Expected state should be 'clustered'")
+		}
+	}
+	//
+	//	Simulate non master machine reboot
+	// 	Expect the new session to start from desired state 'new'
+	//
+	master, err := GetMasterNode(currentStates)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	SaveClusterStates(path, currentStates)
+	rebootedKey, err := RebootTestNode(path, announcements, master.SessionID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	currentStates, err = Schedule(path)
+	currentStates, err = ScheduleTestPass(path)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -153,38 +177,111 @@ func TestClusterScenarios(t *testing.T) {
 	log.Println("Current States")
 	log.Println(currentStates)
 
-	log.Println(currentStates)
+	if len(currentStates) != 3 {
+		t.Fatalf("Expected 3 states got %v", len(currentStates))
+	}
+
 	for key, state := range currentStates {
-		if state.State != SchedulerStateClustered {
-			if key == masterKey {
-				if state.State != SchedulerStateEmpty {
-					t.Fatal("Expected state should be ''")
-				}
-
-				if state.DesiredState != SchedulerStateNew {
-					t.Fatal("Expected state should be 'new'")
-				}
-
-				if state.Master {
-					t.Fatal("Expected state should not be 'mast'")
-				}
-			} else {
-				t.Fatal("Expected state should be 'clustered'")
+		if state.State == SchedulerStateDeleted {
+			if state.Master {
+				t.Fatal("Expected deleted state should not be 'master'")
+			}
+		} else if key == rebootedKey {
+			if state.DesiredState != SchedulerStateNew {
+				t.Fatal("Expected desired state should be 'new'")
+			}
+
+			if state.Master {
+				t.Fatal("Expected state should not be 'master'")
 			}
 		} else {
+			if state.State != SchedulerStateClustered {
+				t.Fatal("Expected state should be 'clustered'")
+			}
+
 			if !state.Master {
 				t.Fatal("Expected state should be 'master'")
 			}
+		}
+	}
+	//
+	//	Simulate master machine reboot
+	// 	Expect the new session to start from desired state 'new'
+	//
+	if _, err = RebootTestNode(path, announcements, master.SessionID, true); err != nil {
+		t.Fatal(err)
+	}
 
-			if state.DesiredState != SchedulerStateClustered {
-				t.Fatal("Expected state should be 'Clustered'")
-			}
+	currentStates, err = ScheduleTestPass(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log.Println("Current States")
+	log.Println(currentStates)
+
+	if state, ok := currentStates[master.SessionID]; !ok || state.State != SchedulerStateDeleted || state.Master {
+		t.Fatal("Expected old master session to be deleted")
+	}
+
+	masterFound = false
+	for _, state := range currentStates {
+		if state.Master {
+			masterFound = true
 		}
 	}
+
+	if !masterFound {
+		t.Fatal("Expected a master to be selected")
+	}
+
+	currentStates, err = ScheduleTestPass(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := currentStates[master.SessionID]; ok {
+		t.Fatal("Expected old master session to be removed")
+	}
+}
+
+func TestSelectMasterAvoidsBlankNodes(t *testing.T) {
+	states := map[string]NodeState{
+		"a": {IPAddress: "10.100.2.1", SessionID: "a", Master: true, State: SchedulerStateDeleted},
+		"b": {IPAddress: "10.100.2.2", SessionID: "b", State: SchedulerStateNew},
+		"c": {IPAddress: "10.100.2.3", SessionID: "c", State: SchedulerStateAdding},
+	}
+
+	if states = selectMaster(states, true); !states["c"].Master || states["a"].Master {
+		t.Fatalf("Expected the adding node to be promoted got %v", states)
+	}
+
+	states = map[string]NodeState{
+		"a": {IPAddress: "10.100.2.1", SessionID: "a", Master: true, State: SchedulerStateDeleted},
+		"b": {IPAddress: "10.100.2.2", SessionID: "b", State: SchedulerStateNew},
+	}
+	if states = selectMaster(states, true); states["b"].Master {
+		t.Fatalf("Expected a blank node not to be promoted once the cluster was initialized got %v", states)
+	}
+
+	b := states["b"]
+	b.DataIntact = true
+	states["b"] = b
+	if states = selectMaster(states, true); !states["b"].Master {
+		t.Fatalf("Expected the node which kept its data to be promoted got %v", states)
+	}
+
+	if states = selectMaster(map[string]NodeState{"d": {SessionID: "d", State: SchedulerStateNew}}, false); !states["d"].Master {
+		t.Fatalf("Expected a new node to be promoted before the cluster is initialized got %v", states)
+	}
 }
 
 func TestGetClusterAnnouncements(t *testing.T) {
 	path := "/TestGetClusterAnnouncements"
+	if err := ClearAnnouncments(path); err != nil {
+		t.Fatal(err)
+	}
+
 	testNodes, err := CreateTestNodes(path, 2)
 	if err != nil {
 		t.Fatal(err)
@@ -200,23 +297,151 @@ func TestGetClusterAnnouncements(t *testing.T) {
 	}
 }
 
+func TestSaveClusterStatesConflict(t *testing.T) {
+	path := "/TestSaveClusterStatesConflict"
+	if err := ClearClusterStates(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := ClearAnnouncments(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CreateTestNodes(path, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ScheduleTestPass(path); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := GetClusterStates(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := GetClusterStates(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = SaveClusterStates(path, first); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = SaveClusterStates(path, first); err != nil {
+		t.Fatalf("Expected saving with refreshed indexes to succeed got %v", err)
+	}
+
+	if err = SaveClusterStates(path, second); err != ErrStateConflict {
+		t.Fatalf("Expected ErrStateConflict got %v", err)
+	}
+
+	for key, state := range second {
+		state.ModifiedIndex = 0
+		if err = SaveClusterStates(path, map[string]NodeState{key: state}); err != ErrStateConflict {
+			t.Fatalf("Expected ErrStateConflict creating an existing state got %v", err)
+		}
+	}
+}
+
+// ScheduleTestPass runs a scheduling pass the way StartScheduler does
+func ScheduleTestPass(path string) (map[string]NodeState, error) {
+	currentStates, err := Schedule(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if master, err := GetMasterNode(currentStates); err == nil {
+		master.TTL = time.Now().Add(time.Minute).UnixNano()
+		currentStates[master.SessionID] = master
+	}
+
+	return currentStates, SaveClusterStates(path, currentStates)
+}
+
+func TestSaveClusterStatesDeletesDroppedStates(t *testing.T) {
+	testDroppedStates(t, NewMemoryStore())
+}
+
+// testDroppedStates checks saving the cluster states deletes the key of a dropped state
+func testDroppedStates(t *testing.T, s Store) {
+	defer SetStore(GetStore())
+	SetStore(s)
+
+	path := "/TestDroppedStates"
+	states := map[string]NodeState{
+		"a": {IPAddress: "10.0.0.1", SessionID: "a", State: SchedulerStateClustered},
+		"b": {IPAddress: "10.0.0.2", SessionID: "b", State: SchedulerStateDeleted},
+	}
+
+	if err := SaveClusterStates(path, states); err != nil {
+		t.Fatal(err)
+	}
+
+	delete(states, "b")
+	if err := SaveClusterStates(path, states); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get(path + "/states/b"); err != ErrKeyNotFound {
+		t.Fatalf("Expected the dropped state to be deleted got %v", err)
+	}
+
+	if saved, err := GetClusterStates(path); err != nil || len(saved) != 1 {
+		t.Fatalf("Expected the kept state to be saved got %v %v", saved, err)
+	}
+}
+
 func CreateTestNodes(base string, count int) (map[string]NodeState, error) {
-	client := NewEtcdClient()
 	values := make(map[string]NodeState)
 	for i := 0; i < count; i++ {
 		ip := fmt.Sprintf("10.100.2.%v", i)
-		path := fmt.Sprintf("%s/announcements/%s", base, ip)
 		id := uuid.New()
-		node := NodeState{ip, id, false, "", "", time.Now().UnixNano()}
-		values[ip] = node
+		node := NodeState{IPAddress: ip, SessionID: id, TTL: time.Now().UnixNano()}
+		values[id] = node
 		bytes, err := json.Marshal(node)
 		if err != nil {
 			return nil, err
 		}
-		if _, err := client.Set(path, string(bytes), 0); err != nil {
+
+		path := fmt.Sprintf("%s/announcements/%s", base, id)
+		if _, err := store.Set(path, string(bytes), 0); err != nil {
 			return nil, err
 		}
 	}
 
 	return values, nil
 }
+
+func AnnounceTestNodes(base string, nodes map[string]NodeState, state SchedulerState) error {
+	for key, node := range nodes {
+		node.State = state
+		nodes[key] = node
+		if err := SetClusterAnnouncement(base, node); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func RebootTestNode(base string, nodes map[string]NodeState, masterKey string, master bool) (string, error) {
+	for key, node := range nodes {
+		if (key == masterKey) != master {
+			continue
+		}
+
+		if err := store.Delete(fmt.Sprintf("%s/announcements/%s", base, key), false); err != nil {
+			return "", err
+		}
+
+		delete(nodes, key)
+		node.SessionID = uuid.New()
+		node.State = SchedulerStateEmpty
+		node.DataIntact = true
+		nodes[node.SessionID] = node
+		return node.SessionID, SetClusterAnnouncement(base, node)
+	}
+
+	return "", fmt.Errorf("No test node found")
+}
@@ -0,0 +1,44 @@
+package couchbasearray
+
+import (
+	"encoding/json"
+
+	"github.com/andrewwebber/couchbase-array/couchbase/rest"
+)
+
+// StoreCredentials reads the Couchbase credentials from a key in the store holding
+// {"username": "...", "password": "..."}. The key is read for every request so the
+// credentials can be rotated by rewriting it.
+type StoreCredentials struct {
+	Key string
+}
+
+// Credentials reads the credentials key
+func (c StoreCredentials) Credentials() (rest.Credentials, error) {
+	var credentials rest.Credentials
+	node, err := store.Get(c.Key)
+	if err != nil {
+		return credentials, err
+	}
+
+	if err = json.Unmarshal([]byte(node.Value), &credentials); err != nil {
+		return credentials, err
+	}
+
+	if credentials.Username == "" || credentials.Password == "" {
+		return credentials, rest.ErrNoCredentials
+	}
+
+	return credentials, nil
+}
+
+// SetStoreCredentials writes credentials to key, rotating them for every StoreCredentials reading it
+func SetStoreCredentials(key string, credentials rest.Credentials) error {
+	bytes, err := json.Marshal(credentials)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.Set(key, string(bytes), 0)
+	return err
+}
@@ -0,0 +1,26 @@
+package couchbasearray
+
+import (
+	"testing"
+
+	"github.com/andrewwebber/couchbase-array/couchbase/rest"
+)
+
+func TestStoreCredentials(t *testing.T) {
+	source := StoreCredentials{Key: "/TestStoreCredentials/credentials"}
+	store.Delete(source.Key, false)
+	if _, err := source.Credentials(); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound got %v", err)
+	}
+
+	for _, password := range []string{"first", "rotated"} {
+		if err := SetStoreCredentials(source.Key, rest.Credentials{Username: "admin", Password: password}); err != nil {
+			t.Fatal(err)
+		}
+
+		credentials, err := source.Credentials()
+		if err != nil || credentials.Password != password {
+			t.Fatalf("Expected password %s got %v %v", password, credentials, err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package couchbasearray
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// ErrStaleToken is returned when a write carries a fencing token older than the current leader's
+var ErrStaleToken = errors.New("stale fencing token")
+
+// LeaderElection campaigns for a lock in the store and reports when this process
+// starts and stops leading. Each term is identified by a fencing token, the store
+// index at which the lock was taken, which increases with every change of leader.
+type LeaderElection struct {
+	Identifier    string
+	Namespace     string
+	TTL           uint64
+	RetryInterval time.Duration
+
+	OnStartedLeading func(token uint64)
+	OnStoppedLeading func()
+
+	resign chan bool
+}
+
+// NewLeaderElection creates an election for the master lock beneath servicePath
+func NewLeaderElection(identifier string, servicePath string, ttl uint64) *LeaderElection {
+	return &LeaderElection{
+		Identifier:    identifier,
+		Namespace:     servicePath + "/master",
+		TTL:           ttl,
+		RetryInterval: time.Duration(ttl) * time.Second * 4 / 5,
+		resign:        make(chan bool, 1),
+	}
+}
+
+// Resign gives up the current term without waiting for it to end. The term is stopped,
+// the lock released and the election waits a retry interval, so another process can take
+// over, before it campaigns again. Elections not created by NewLeaderElection cannot resign.
+func (e *LeaderElection) Resign() {
+	select {
+	case e.resign <- true:
+	default:
+	}
+}
+
+// Run campaigns until ctx is cancelled, renewing the lock while leading.
+// Leadership is given up as soon as a renewal fails. On cancellation the current
+// term is stopped before the lock is released so the next leader can take over.
+func (e *LeaderElection) Run(ctx context.Context) {
+	leading := false
+	for {
+		token, err := AcquireLockToken(e.Identifier, e.Namespace, e.TTL)
+		if err == nil && !leading {
+			leading = true
+			log.Printf("Started leading with token %d\n", token)
+			if e.OnStartedLeading != nil {
+				e.OnStartedLeading(token)
+			}
+		}
+
+		if err != nil {
+			if err != ErrLockInUse {
+				log.Println(err)
+			}
+
+			if leading {
+				leading = false
+				log.Println("Stopped leading")
+				if e.OnStoppedLeading != nil {
+					e.OnStoppedLeading()
+				}
+			}
+		}
+
+		select {
+		case <-time.After(e.RetryInterval):
+		case <-e.resign:
+			if !leading {
+				continue
+			}
+
+			leading = false
+			log.Println("Resigned leadership")
+			if e.OnStoppedLeading != nil {
+				e.OnStoppedLeading()
+			}
+
+			if err := ReleaseLock(e.Identifier, e.Namespace); err != nil {
+				log.Println(err)
+			}
+
+			select {
+			case <-time.After(e.RetryInterval):
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			if leading {
+				log.Println("Stopped leading")
+				if e.OnStoppedLeading != nil {
+					e.OnStoppedLeading()
+				}
+
+				if err := ReleaseLock(e.Identifier, e.Namespace); err != nil {
+					log.Println(err)
+				}
+			}
+			return
+		}
+	}
+}
+
+// AdvanceFence records token as the newest fencing token beneath base.
+// It returns ErrStaleToken if a newer token has already been recorded.
+func AdvanceFence(base string, token uint64) error {
+	key := fmt.Sprintf("%s/fence", base)
+	value := strconv.FormatUint(token, 10)
+	for {
+		node, err := store.Get(key)
+		if err == ErrKeyNotFound {
+			if _, err = store.Create(key, value, 0); err == ErrNodeExist {
+				continue
+			}
+			return err
+		}
+
+		if err != nil {
+			return err
+		}
+
+		current, err := strconv.ParseUint(node.Value, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		if current > token {
+			return ErrStaleToken
+		}
+
+		if current == token {
+			return nil
+		}
+
+		if _, err = store.CompareAndSwap(key, value, 0, "", node.ModifiedIndex); err == ErrCompareFailed {
+			continue
+		}
+
+		return err
+	}
+}
+
+// CheckFence returns ErrStaleToken unless token is the newest fencing token beneath base
+func CheckFence(base string, token uint64) error {
+	node, err := store.Get(fmt.Sprintf("%s/fence", base))
+	if err != nil {
+		return err
+	}
+
+	if node.Value != strconv.FormatUint(token, 10) {
+		return ErrStaleToken
+	}
+
+	return nil
+}
+
+// FencedStore is implemented by stores which can check the fencing token in the same
+// transaction as a write, so a deposed leader cannot land a write after being fenced off.
+// FencedCompareAndSwap writes key only while fenceKey holds fenceValue, creating it when
+// prevIndex is zero and otherwise comparing against prevIndex like CompareAndSwap.
+// It returns ErrStaleToken when the fence has moved on.
+type FencedStore interface {
+	FencedCompareAndSwap(fenceKey string, fenceValue string, key string, value string, ttl uint64, prevIndex uint64) (StoreNode, error)
+}
+
+// SaveFencedClusterStates saves states like SaveClusterStates, refusing to write
+// when token is no longer the newest fencing token. With a FencedStore (memory, etcd v3
+// and Consul) every write is also conditional on the fence. The other stores (etcd v2 and
+// Kubernetes) only check the fence before saving, so a leader deposed between the check
+// and the writes can still land the states of that one pass.
+func SaveFencedClusterStates(base string, token uint64, states map[string]NodeState) error {
+	if err := CheckFence(base, token); err != nil {
+		return err
+	}
+
+	fenced, ok := store.(FencedStore)
+	if !ok {
+		return SaveClusterStates(base, states)
+	}
+
+	fenceKey := fmt.Sprintf("%s/fence", base)
+	fenceValue := strconv.FormatUint(token, 10)
+	return saveClusterStates(base, states, func(key string, value string, prevIndex uint64) (StoreNode, error) {
+		return fenced.FencedCompareAndSwap(fenceKey, fenceValue, key, value, TTL, prevIndex)
+	})
+}
@@ -0,0 +1,167 @@
+package couchbasearray
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLeaderElectionFencing(t *testing.T) {
+	defer SetStore(GetStore())
+	SetStore(NewMemoryStore())
+
+	path := "/TestLeaderElectionFencing"
+	tokens := make(chan uint64, 2)
+	stopped := make(chan bool, 2)
+	newElection := func(identifier string) *LeaderElection {
+		election := NewLeaderElection(identifier, path, 1)
+		election.RetryInterval = 100 * time.Millisecond
+		election.OnStartedLeading = func(token uint64) { tokens <- token }
+		election.OnStoppedLeading = func() { stopped <- true }
+		return election
+	}
+
+	ctxFirst, stopFirst := context.WithCancel(context.Background())
+	firstDone := make(chan bool)
+	go func() {
+		newElection("first").Run(ctxFirst)
+		close(firstDone)
+	}()
+
+	var first uint64
+	select {
+	case first = <-tokens:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected first election to lead")
+	}
+
+	if err := AdvanceFence(path, first); err != nil {
+		t.Fatal(err)
+	}
+
+	ctxSecond, stopSecond := context.WithCancel(context.Background())
+	secondDone := make(chan bool)
+	defer func() {
+		stopSecond()
+		<-secondDone
+	}()
+	go func() {
+		newElection("second").Run(ctxSecond)
+		close(secondDone)
+	}()
+
+	select {
+	case <-tokens:
+		t.Fatal("Expected second election not to lead while the lock is held")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	stopFirst()
+	<-stopped
+	<-firstDone
+
+	var second uint64
+	select {
+	case second = <-tokens:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected second election to lead")
+	}
+
+	if second <= first {
+		t.Fatalf("Expected token %d to be newer than %d", second, first)
+	}
+
+	if err := AdvanceFence(path, second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AdvanceFence(path, first); err != ErrStaleToken {
+		t.Fatalf("Expected ErrStaleToken got %v", err)
+	}
+
+	if err := SaveFencedClusterStates(path, first, map[string]NodeState{}); err != ErrStaleToken {
+		t.Fatalf("Expected ErrStaleToken got %v", err)
+	}
+
+	if err := SaveFencedClusterStates(path, second, map[string]NodeState{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScheduleWhileLeadingResignsOnStaleFence(t *testing.T) {
+	defer SetStore(GetStore())
+	SetStore(NewMemoryStore())
+
+	path := "/TestScheduleWhileLeadingResignsOnStaleFence"
+	if err := AdvanceFence(path, 1<<62); err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan bool, 1)
+	election := NewLeaderElection("stale", path, 1)
+	election.RetryInterval = time.Hour
+	election.OnStoppedLeading = func() { stopped <- true }
+	ScheduleWhileLeading(election, path, 10, path+"/masterip")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	defer func() {
+		cancel()
+		<-done
+	}()
+	go func() {
+		election.Run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the election to resign when the fence cannot be advanced")
+	}
+
+	if _, err := store.Get(election.Namespace); err != ErrKeyNotFound {
+		t.Fatalf("Expected the lock to be released got %v", err)
+	}
+}
+
+func TestMemoryStoreFencedCompareAndSwap(t *testing.T) {
+	testFencedStore(t, NewMemoryStore())
+}
+
+// testFencedStore checks a write lands only while the fence holds the writer's token
+func testFencedStore(t *testing.T, s FencedStore) {
+	kv := s.(Store)
+	if _, err := kv.Create("/base/fence", "1", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := s.FencedCompareAndSwap("/base/fence", "1", "/base/states/a", "a", 30, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.FencedCompareAndSwap("/base/fence", "1", "/base/states/a", "b", 30, 0); err != ErrNodeExist {
+		t.Fatalf("Expected ErrNodeExist got %v", err)
+	}
+
+	if _, err = s.FencedCompareAndSwap("/base/fence", "1", "/base/states/a", "b", 30, node.ModifiedIndex+100); err != ErrCompareFailed {
+		t.Fatalf("Expected ErrCompareFailed got %v", err)
+	}
+
+	if node, err = s.FencedCompareAndSwap("/base/fence", "1", "/base/states/a", "b", 30, node.ModifiedIndex); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = kv.Set("/base/fence", "2", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.FencedCompareAndSwap("/base/fence", "1", "/base/states/a", "c", 30, node.ModifiedIndex); err != ErrStaleToken {
+		t.Fatalf("Expected ErrStaleToken got %v", err)
+	}
+
+	if current, err := kv.Get("/base/states/a"); err != nil || current.Value != "b" {
+		t.Fatalf("Expected the stale write to be refused got %v %v", current, err)
+	}
+}
@@ -0,0 +1,140 @@
+package couchbasearray
+
+import (
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// EtcdStore is a Store backed by the etcd v2 keys API
+type EtcdStore struct {
+	client *etcd.Client
+}
+
+// NewEtcdStore creates a Store using an existing etcd v2 client
+func NewEtcdStore(client *etcd.Client) *EtcdStore {
+	return &EtcdStore{client: client}
+}
+
+// Get returns a single key
+func (s *EtcdStore) Get(key string) (StoreNode, error) {
+	response, err := s.client.Get(key, false, false)
+	if err != nil {
+		return StoreNode{}, etcdStoreError(err)
+	}
+
+	return etcdStoreNode(response.Node), nil
+}
+
+// GetDir returns the keys directly beneath dir
+func (s *EtcdStore) GetDir(dir string) ([]StoreNode, error) {
+	response, err := s.client.Get(dir, false, false)
+	if err != nil {
+		return nil, etcdStoreError(err)
+	}
+
+	var nodes []StoreNode
+	for _, node := range response.Node.Nodes {
+		if node.Dir {
+			continue
+		}
+
+		nodes = append(nodes, etcdStoreNode(node))
+	}
+
+	return nodes, nil
+}
+
+// Set writes a key, expiring it after ttl seconds unless ttl is zero
+func (s *EtcdStore) Set(key string, value string, ttl uint64) (StoreNode, error) {
+	response, err := s.client.Set(key, value, ttl)
+	if err != nil {
+		return StoreNode{}, etcdStoreError(err)
+	}
+
+	return etcdStoreNode(response.Node), nil
+}
+
+// Create writes a key only if it does not already exist
+func (s *EtcdStore) Create(key string, value string, ttl uint64) (StoreNode, error) {
+	response, err := s.client.Create(key, value, ttl)
+	if err != nil {
+		return StoreNode{}, etcdStoreError(err)
+	}
+
+	return etcdStoreNode(response.Node), nil
+}
+
+// CompareAndSwap writes a key only if its current value or index matches
+func (s *EtcdStore) CompareAndSwap(key string, value string, ttl uint64, prevValue string, prevIndex uint64) (StoreNode, error) {
+	response, err := s.client.CompareAndSwap(key, value, ttl, prevValue, prevIndex)
+	if err != nil {
+		return StoreNode{}, etcdStoreError(err)
+	}
+
+	return etcdStoreNode(response.Node), nil
+}
+
+// CompareAndDelete removes a key only if its current value or index matches
+func (s *EtcdStore) CompareAndDelete(key string, prevValue string, prevIndex uint64) error {
+	_, err := s.client.CompareAndDelete(key, prevValue, prevIndex)
+	return etcdStoreError(err)
+}
+
+// Delete removes a key, or a whole directory when recursive is set
+func (s *EtcdStore) Delete(key string, recursive bool) error {
+	_, err := s.client.Delete(key, recursive)
+	return etcdStoreError(err)
+}
+
+// Watch blocks until a key beneath prefix changes at or after waitIndex or stop is signalled
+func (s *EtcdStore) Watch(prefix string, waitIndex uint64, stop chan bool) (StoreEvent, error) {
+	response, err := s.client.Watch(prefix, waitIndex, true, nil, stop)
+	if err != nil {
+		return StoreEvent{}, etcdStoreError(err)
+	}
+
+	event := StoreEvent{Node: etcdStoreNode(response.Node)}
+	switch response.Action {
+	case "delete", "compareAndDelete":
+		event.Action = StoreActionDelete
+	case "expire":
+		event.Action = StoreActionExpire
+	default:
+		event.Action = StoreActionSet
+	}
+
+	return event, nil
+}
+
+func etcdStoreNode(node *etcd.Node) StoreNode {
+	if node == nil {
+		return StoreNode{}
+	}
+
+	return StoreNode{Key: node.Key, Value: node.Value, ModifiedIndex: node.ModifiedIndex}
+}
+
+func etcdStoreError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if err == etcd.ErrWatchStoppedByUser {
+		return ErrWatchStopped
+	}
+
+	eerr, ok := err.(*etcd.EtcdError)
+	if !ok {
+		return err
+	}
+
+	switch eerr.ErrorCode {
+	case ErrorKeyNotFound:
+		return ErrKeyNotFound
+	case ErrorCompareFailed:
+		return ErrCompareFailed
+	case ErrorNodeExist:
+		return ErrNodeExist
+	}
+
+	return err
+}
@@ -0,0 +1,674 @@
+package couchbasearray
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EtcdV3Store is a Store backed by the etcd v3 API through the etcd gRPC gateway.
+// Keys written with a TTL are attached to a lease owned by this store, its session,
+// which is kept alive instead of the keys being re-written. Close stops keeping the
+// leases alive and revokes them, deleting their keys.
+type EtcdV3Store struct {
+	endpoints []string
+	client    *http.Client
+
+	mutex  sync.Mutex
+	leases map[uint64]int64
+	closed chan struct{}
+}
+
+// NewEtcdV3Store creates a Store talking to the given etcd v3 endpoints
+func NewEtcdV3Store(endpoints []string, client *http.Client) *EtcdV3Store {
+	if client == nil {
+		client = &http.Client{}
+	}
+
+	return &EtcdV3Store{
+		endpoints: endpoints,
+		client:    client,
+		leases:    make(map[uint64]int64),
+		closed:    make(chan struct{}),
+	}
+}
+
+func etcdV3Endpoints() []string {
+	endpoints := os.Getenv("ETCDCTL_ENDPOINTS")
+	if endpoints == "" {
+		endpoints = os.Getenv("ETCDCTL_PEERS")
+	}
+
+	if endpoints == "" {
+		return []string{"http://127.0.0.1:2379"}
+	}
+
+	log.Println("Connecting to etcd v3 endpoints : " + endpoints)
+	return strings.Split(endpoints, ",")
+}
+
+func etcdV3HTTPClient() *http.Client {
+	if len(os.Getenv("ETCDCTL_TLS")) == 0 {
+		return &http.Client{}
+	}
+
+	config := &tls.Config{}
+	certFile := os.Getenv("ETCDCTL_CERT_FILE")
+	keyFile := os.Getenv("ETCDCTL_KEY_FILE")
+	if certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	if caFile := os.Getenv("ETCDCTL_TRUSTED_CA_FILE"); caFile != "" {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		config.RootCAs.AppendCertsFromPEM(caCert)
+	}
+
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+}
+
+type v3Int int64
+
+func (i *v3Int) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	*i = v3Int(value)
+	return nil
+}
+
+type v3Header struct {
+	Revision v3Int `json:"revision"`
+}
+
+type v3KeyValue struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value"`
+	ModRevision v3Int  `json:"mod_revision"`
+	Lease       v3Int  `json:"lease"`
+}
+
+type v3RangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type v3RangeResponse struct {
+	Header v3Header     `json:"header"`
+	Kvs    []v3KeyValue `json:"kvs"`
+}
+
+type v3PutRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	Lease int64  `json:"lease,string,omitempty"`
+}
+
+type v3PutResponse struct {
+	Header v3Header `json:"header"`
+}
+
+type v3DeleteRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type v3DeleteRangeResponse struct {
+	Header  v3Header `json:"header"`
+	Deleted v3Int    `json:"deleted"`
+}
+
+type v3Compare struct {
+	Result         string `json:"result"`
+	Target         string `json:"target"`
+	Key            []byte `json:"key"`
+	Value          []byte `json:"value,omitempty"`
+	ModRevision    *int64 `json:"mod_revision,omitempty"`
+	CreateRevision *int64 `json:"create_revision,omitempty"`
+}
+
+type v3RequestOp struct {
+	RequestRange       *v3RangeRequest       `json:"request_range,omitempty"`
+	RequestPut         *v3PutRequest         `json:"request_put,omitempty"`
+	RequestDeleteRange *v3DeleteRangeRequest `json:"request_delete_range,omitempty"`
+}
+
+type v3TxnRequest struct {
+	Compare []v3Compare   `json:"compare"`
+	Success []v3RequestOp `json:"success"`
+	Failure []v3RequestOp `json:"failure"`
+}
+
+type v3ResponseOp struct {
+	ResponseRange *v3RangeResponse `json:"response_range"`
+}
+
+type v3TxnResponse struct {
+	Header    v3Header       `json:"header"`
+	Succeeded bool           `json:"succeeded"`
+	Responses []v3ResponseOp `json:"responses"`
+}
+
+type v3LeaseGrantRequest struct {
+	TTL int64 `json:"TTL,string"`
+}
+
+type v3LeaseResponse struct {
+	ID  v3Int `json:"ID"`
+	TTL v3Int `json:"TTL"`
+}
+
+type v3LeaseKeepAliveRequest struct {
+	ID int64 `json:"ID,string"`
+}
+
+type v3LeaseRevokeRequest struct {
+	ID int64 `json:"ID,string"`
+}
+
+type v3WatchCreateRequest struct {
+	Key           []byte `json:"key"`
+	RangeEnd      []byte `json:"range_end"`
+	StartRevision int64  `json:"start_revision,string,omitempty"`
+}
+
+type v3WatchRequest struct {
+	CreateRequest v3WatchCreateRequest `json:"create_request"`
+}
+
+type v3WatchEvent struct {
+	Type string     `json:"type"`
+	Kv   v3KeyValue `json:"kv"`
+}
+
+type v3WatchResponse struct {
+	Result struct {
+		Header          v3Header       `json:"header"`
+		Events          []v3WatchEvent `json:"events"`
+		Canceled        bool           `json:"canceled"`
+		CancelReason    string         `json:"cancel_reason"`
+		CompactRevision v3Int          `json:"compact_revision"`
+	} `json:"result"`
+	Error *v3Error `json:"error"`
+}
+
+type v3Error struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+// Get returns a single key
+func (s *EtcdV3Store) Get(key string) (StoreNode, error) {
+	var response v3RangeResponse
+	if err := s.call("/v3/kv/range", v3RangeRequest{Key: []byte(storeKey(key))}, &response); err != nil {
+		return StoreNode{}, err
+	}
+
+	if len(response.Kvs) == 0 {
+		return StoreNode{}, ErrKeyNotFound
+	}
+
+	return v3StoreNode(response.Kvs[0]), nil
+}
+
+// GetDir returns the keys directly beneath dir
+func (s *EtcdV3Store) GetDir(dir string) ([]StoreNode, error) {
+	prefix := storeKey(dir) + "/"
+	var response v3RangeResponse
+	request := v3RangeRequest{Key: []byte(prefix), RangeEnd: v3RangeEnd(prefix)}
+	if err := s.call("/v3/kv/range", request, &response); err != nil {
+		return nil, err
+	}
+
+	if len(response.Kvs) == 0 {
+		return nil, ErrKeyNotFound
+	}
+
+	var nodes []StoreNode
+	for _, kv := range response.Kvs {
+		if strings.Contains(string(kv.Key[len(prefix):]), "/") {
+			continue
+		}
+
+		nodes = append(nodes, v3StoreNode(kv))
+	}
+
+	return nodes, nil
+}
+
+// Set writes a key, attaching it to the session lease for ttl unless ttl is zero
+func (s *EtcdV3Store) Set(key string, value string, ttl uint64) (StoreNode, error) {
+	put, err := s.put(key, value, ttl)
+	if err != nil {
+		return StoreNode{}, err
+	}
+
+	var response v3PutResponse
+	if err = s.call("/v3/kv/put", put, &response); err != nil {
+		return StoreNode{}, err
+	}
+
+	return StoreNode{Key: storeKey(key), Value: value, ModifiedIndex: uint64(response.Header.Revision)}, nil
+}
+
+// Create writes a key only if it does not already exist
+func (s *EtcdV3Store) Create(key string, value string, ttl uint64) (StoreNode, error) {
+	put, err := s.put(key, value, ttl)
+	if err != nil {
+		return StoreNode{}, err
+	}
+
+	request := v3TxnRequest{
+		Compare: []v3Compare{{Result: "EQUAL", Target: "CREATE", Key: put.Key, CreateRevision: new(int64)}},
+		Success: []v3RequestOp{{RequestPut: &put}},
+	}
+
+	var response v3TxnResponse
+	if err = s.call("/v3/kv/txn", request, &response); err != nil {
+		return StoreNode{}, err
+	}
+
+	if !response.Succeeded {
+		return StoreNode{}, ErrNodeExist
+	}
+
+	return StoreNode{Key: storeKey(key), Value: value, ModifiedIndex: uint64(response.Header.Revision)}, nil
+}
+
+// CompareAndSwap writes a key only if its current value or mod revision matches
+func (s *EtcdV3Store) CompareAndSwap(key string, value string, ttl uint64, prevValue string, prevIndex uint64) (StoreNode, error) {
+	put, err := s.put(key, value, ttl)
+	if err != nil {
+		return StoreNode{}, err
+	}
+
+	revision, err := s.compareTxn(put.Key, prevValue, prevIndex, v3RequestOp{RequestPut: &put})
+	if err != nil {
+		return StoreNode{}, err
+	}
+
+	return StoreNode{Key: storeKey(key), Value: value, ModifiedIndex: revision}, nil
+}
+
+// FencedCompareAndSwap writes a key in a transaction which also compares the value of
+// fenceKey, see FencedStore
+func (s *EtcdV3Store) FencedCompareAndSwap(fenceKey string, fenceValue string, key string, value string, ttl uint64, prevIndex uint64) (StoreNode, error) {
+	put, err := s.put(key, value, ttl)
+	if err != nil {
+		return StoreNode{}, err
+	}
+
+	fence := []byte(storeKey(fenceKey))
+	request := v3TxnRequest{
+		Compare: []v3Compare{{Result: "EQUAL", Target: "VALUE", Key: fence, Value: []byte(fenceValue)}},
+		Success: []v3RequestOp{{RequestPut: &put}},
+		Failure: []v3RequestOp{{RequestRange: &v3RangeRequest{Key: fence}}, {RequestRange: &v3RangeRequest{Key: put.Key}}},
+	}
+
+	if prevIndex == 0 {
+		request.Compare = append(request.Compare, v3Compare{Result: "EQUAL", Target: "CREATE", Key: put.Key, CreateRevision: new(int64)})
+	} else {
+		revision := int64(prevIndex)
+		request.Compare = append(request.Compare, v3Compare{Result: "EQUAL", Target: "MOD", Key: put.Key, ModRevision: &revision})
+	}
+
+	var response v3TxnResponse
+	if err = s.call("/v3/kv/txn", request, &response); err != nil {
+		return StoreNode{}, err
+	}
+
+	if !response.Succeeded {
+		found := func(i int) []v3KeyValue {
+			if len(response.Responses) > i && response.Responses[i].ResponseRange != nil {
+				return response.Responses[i].ResponseRange.Kvs
+			}
+			return nil
+		}
+
+		if fences := found(0); len(fences) == 0 || string(fences[0].Value) != fenceValue {
+			return StoreNode{}, ErrStaleToken
+		}
+
+		switch {
+		case prevIndex == 0:
+			return StoreNode{}, ErrNodeExist
+		case len(found(1)) > 0:
+			return StoreNode{}, ErrCompareFailed
+		}
+
+		return StoreNode{}, ErrKeyNotFound
+	}
+
+	return StoreNode{Key: storeKey(key), Value: value, ModifiedIndex: uint64(response.Header.Revision)}, nil
+}
+
+// CompareAndDelete removes a key only if its current value or mod revision matches
+func (s *EtcdV3Store) CompareAndDelete(key string, prevValue string, prevIndex uint64) error {
+	k := []byte(storeKey(key))
+	_, err := s.compareTxn(k, prevValue, prevIndex, v3RequestOp{RequestDeleteRange: &v3DeleteRangeRequest{Key: k}})
+	return err
+}
+
+// Delete removes a key, or every key beneath it when recursive is set
+func (s *EtcdV3Store) Delete(key string, recursive bool) error {
+	key = storeKey(key)
+	var response v3DeleteRangeResponse
+	if err := s.call("/v3/kv/deleterange", v3DeleteRangeRequest{Key: []byte(key)}, &response); err != nil {
+		return err
+	}
+
+	deleted := response.Deleted
+	if recursive {
+		prefix := key + "/"
+		request := v3DeleteRangeRequest{Key: []byte(prefix), RangeEnd: v3RangeEnd(prefix)}
+		if err := s.call("/v3/kv/deleterange", request, &response); err != nil {
+			return err
+		}
+
+		deleted += response.Deleted
+	}
+
+	if deleted == 0 {
+		return ErrKeyNotFound
+	}
+
+	return nil
+}
+
+// Watch blocks until a key beneath prefix changes at or after waitIndex or stop is signalled
+func (s *EtcdV3Store) Watch(prefix string, waitIndex uint64, stop chan bool) (StoreEvent, error) {
+	prefix = storeKey(prefix)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	request := v3WatchRequest{CreateRequest: v3WatchCreateRequest{
+		Key:           []byte(prefix),
+		RangeEnd:      v3RangeEnd(prefix),
+		StartRevision: int64(waitIndex),
+	}}
+
+	body, err := s.open(ctx, "/v3/watch", request)
+	if err != nil {
+		if ctx.Err() != nil {
+			return StoreEvent{}, ErrWatchStopped
+		}
+		return StoreEvent{}, err
+	}
+	defer body.Close()
+
+	decoder := json.NewDecoder(body)
+	for {
+		var response v3WatchResponse
+		if err := decoder.Decode(&response); err != nil {
+			if ctx.Err() != nil {
+				return StoreEvent{}, ErrWatchStopped
+			}
+			return StoreEvent{}, err
+		}
+
+		if response.Error != nil {
+			return StoreEvent{}, fmt.Errorf("etcd watch: %s", response.Error.Message)
+		}
+
+		if response.Result.Canceled {
+			return StoreEvent{}, fmt.Errorf("etcd watch cancelled: %s", response.Result.CancelReason)
+		}
+
+		for _, event := range response.Result.Events {
+			key := string(event.Kv.Key)
+			if key != prefix && !strings.HasPrefix(key, prefix+"/") {
+				continue
+			}
+
+			storeEvent := StoreEvent{Action: StoreActionSet, Node: v3StoreNode(event.Kv)}
+			if event.Type == "DELETE" {
+				storeEvent.Action = StoreActionDelete
+			}
+
+			return storeEvent, nil
+		}
+	}
+}
+
+func (s *EtcdV3Store) compareTxn(key []byte, prevValue string, prevIndex uint64, op v3RequestOp) (uint64, error) {
+	if prevValue == "" && prevIndex == 0 {
+		return 0, fmt.Errorf("prevValue or prevIndex is required")
+	}
+
+	request := v3TxnRequest{
+		Success: []v3RequestOp{op},
+		Failure: []v3RequestOp{{RequestRange: &v3RangeRequest{Key: key}}},
+	}
+
+	if prevValue != "" {
+		request.Compare = append(request.Compare, v3Compare{Result: "EQUAL", Target: "VALUE", Key: key, Value: []byte(prevValue)})
+	}
+
+	if prevIndex != 0 {
+		revision := int64(prevIndex)
+		request.Compare = append(request.Compare, v3Compare{Result: "EQUAL", Target: "MOD", Key: key, ModRevision: &revision})
+	}
+
+	var response v3TxnResponse
+	if err := s.call("/v3/kv/txn", request, &response); err != nil {
+		return 0, err
+	}
+
+	if !response.Succeeded {
+		if len(response.Responses) > 0 && response.Responses[0].ResponseRange != nil && len(response.Responses[0].ResponseRange.Kvs) > 0 {
+			return 0, ErrCompareFailed
+		}
+
+		return 0, ErrKeyNotFound
+	}
+
+	return uint64(response.Header.Revision), nil
+}
+
+func (s *EtcdV3Store) put(key string, value string, ttl uint64) (v3PutRequest, error) {
+	put := v3PutRequest{Key: []byte(storeKey(key)), Value: []byte(value)}
+	if ttl == 0 {
+		return put, nil
+	}
+
+	lease, err := s.lease(ttl)
+	if err != nil {
+		return put, err
+	}
+
+	put.Lease = lease
+	return put, nil
+}
+
+// Close stops keeping the session leases alive and revokes them, deleting every key
+// written with a TTL. Keys written with a TTL after Close fail.
+func (s *EtcdV3Store) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	select {
+	case <-s.closed:
+		return nil
+	default:
+		close(s.closed)
+	}
+
+	var lastErr error
+	for ttl, id := range s.leases {
+		var response struct{}
+		if err := s.call("/v3/lease/revoke", v3LeaseRevokeRequest{ID: id}, &response); err != nil {
+			lastErr = err
+		}
+		delete(s.leases, ttl)
+	}
+
+	return lastErr
+}
+
+// lease returns the session lease for ttl, granting it and starting its keep alive on first use
+func (s *EtcdV3Store) lease(ttl uint64) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	select {
+	case <-s.closed:
+		return 0, ErrStoreClosed
+	default:
+	}
+
+	if id, ok := s.leases[ttl]; ok {
+		return id, nil
+	}
+
+	var response v3LeaseResponse
+	if err := s.call("/v3/lease/grant", v3LeaseGrantRequest{TTL: int64(ttl)}, &response); err != nil {
+		return 0, err
+	}
+
+	id := int64(response.ID)
+	s.leases[ttl] = id
+	go s.keepAlive(ttl, id)
+	return id, nil
+}
+
+func (s *EtcdV3Store) keepAlive(ttl uint64, id int64) {
+	interval := time.Duration(ttl) * time.Second / 3
+	if interval < 500*time.Millisecond {
+		interval = 500 * time.Millisecond
+	}
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-time.After(interval):
+		}
+
+		var response struct {
+			Result v3LeaseResponse `json:"result"`
+		}
+
+		err := s.call("/v3/lease/keepalive", v3LeaseKeepAliveRequest{ID: id}, &response)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if response.Result.TTL <= 0 {
+			log.Printf("etcd lease %x expired", id)
+			s.mutex.Lock()
+			if s.leases[ttl] == id {
+				delete(s.leases, ttl)
+			}
+			s.mutex.Unlock()
+			return
+		}
+	}
+}
+
+// call reads the first message of a gateway response and closes the connection
+func (s *EtcdV3Store) call(path string, request interface{}, response interface{}) error {
+	body, err := s.open(context.Background(), path, request)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	return json.NewDecoder(body).Decode(response)
+}
+
+func (s *EtcdV3Store) open(ctx context.Context, path string, request interface{}) (io.ReadCloser, error) {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, endpoint := range s.endpoints {
+		req, err := http.NewRequest("POST", strings.TrimRight(endpoint, "/")+path, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := s.client.Do(req)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			// an unavailable or failing member is left for the next endpoint
+			var gatewayErr v3Error
+			if json.Unmarshal(body, &gatewayErr) == nil && gatewayErr.Message != "" {
+				lastErr = fmt.Errorf("etcd %s %s: %s", endpoint, path, gatewayErr.Message)
+			} else {
+				lastErr = fmt.Errorf("etcd %s %s: %s", endpoint, path, resp.Status)
+			}
+			continue
+		}
+
+		return resp.Body, nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no etcd endpoints configured")
+	}
+
+	return nil, lastErr
+}
+
+func v3StoreNode(kv v3KeyValue) StoreNode {
+	return StoreNode{Key: string(kv.Key), Value: string(kv.Value), ModifiedIndex: uint64(kv.ModRevision)}
+}
+
+// v3RangeEnd returns the range end matching every key with the given prefix
+func v3RangeEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	return []byte{0}
+}
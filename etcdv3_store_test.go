@@ -0,0 +1,418 @@
+package couchbasearray
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcdV3 serves the etcd v3 gateway. Watches see the changes made from their start
+// revision and are answered with the first of them.
+type fakeEtcdV3 struct {
+	mutex    sync.Mutex
+	revision int64
+	kvs      map[string]fakeEtcdV3KV
+	leases   int64
+	events   []fakeEtcdV3Event
+	changed  chan struct{}
+}
+
+type fakeEtcdV3Event struct {
+	kind     string
+	key      string
+	value    []byte
+	revision int64
+}
+
+type fakeEtcdV3KV struct {
+	value    []byte
+	revision int64
+	lease    int64
+}
+
+type fakeEtcdV3Compare struct {
+	Target         string `json:"target"`
+	Key            []byte `json:"key"`
+	Value          []byte `json:"value"`
+	ModRevision    *v3Int `json:"mod_revision"`
+	CreateRevision *v3Int `json:"create_revision"`
+}
+
+func newFakeEtcdV3() *httptest.Server {
+	fake := &fakeEtcdV3{kvs: make(map[string]fakeEtcdV3KV), changed: make(chan struct{})}
+	return httptest.NewServer(fake)
+}
+
+func (f *fakeEtcdV3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v3/watch" {
+		f.watch(w, r)
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var response interface{}
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		var request v3RangeRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		response = f.rangeKeys(request.Key, request.RangeEnd)
+	case "/v3/kv/put":
+		var request struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+			Lease string `json:"lease"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		lease, _ := strconv.ParseInt(request.Lease, 10, 64)
+		f.put(request.Key, request.Value, lease)
+		response = map[string]interface{}{"header": f.header()}
+	case "/v3/kv/deleterange":
+		var request v3DeleteRangeRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		response = map[string]interface{}{"header": f.header(), "deleted": strconv.Itoa(f.deleteRange(request.Key, request.RangeEnd))}
+	case "/v3/kv/txn":
+		var request struct {
+			Compare []fakeEtcdV3Compare `json:"compare"`
+			Success []v3RequestOp       `json:"success"`
+			Failure []v3RequestOp       `json:"failure"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		succeeded := true
+		for _, compare := range request.Compare {
+			kv, ok := f.kvs[string(compare.Key)]
+			switch compare.Target {
+			case "CREATE":
+				succeeded = succeeded && !ok
+			case "VALUE":
+				succeeded = succeeded && ok && bytes.Equal(kv.value, compare.Value)
+			case "MOD":
+				succeeded = succeeded && ok && compare.ModRevision != nil && int64(*compare.ModRevision) == kv.revision
+			}
+		}
+
+		ops := request.Failure
+		if succeeded {
+			ops = request.Success
+		}
+
+		var responses []map[string]interface{}
+		for _, op := range ops {
+			switch {
+			case op.RequestPut != nil:
+				f.put(op.RequestPut.Key, op.RequestPut.Value, op.RequestPut.Lease)
+				responses = append(responses, map[string]interface{}{})
+			case op.RequestDeleteRange != nil:
+				f.deleteRange(op.RequestDeleteRange.Key, op.RequestDeleteRange.RangeEnd)
+				responses = append(responses, map[string]interface{}{})
+			case op.RequestRange != nil:
+				responses = append(responses, map[string]interface{}{"response_range": f.rangeKeys(op.RequestRange.Key, op.RequestRange.RangeEnd)})
+			}
+		}
+		response = map[string]interface{}{"header": f.header(), "succeeded": succeeded, "responses": responses}
+	case "/v3/lease/grant":
+		f.leases++
+		response = map[string]interface{}{"ID": strconv.FormatInt(f.leases, 10), "TTL": "5"}
+	case "/v3/lease/keepalive":
+		var request v3LeaseKeepAliveRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		response = map[string]interface{}{"result": map[string]string{"ID": strconv.FormatInt(request.ID, 10), "TTL": "5"}}
+	case "/v3/lease/revoke":
+		var request v3LeaseRevokeRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		for key, kv := range f.kvs {
+			if kv.lease == request.ID {
+				f.deleteRange([]byte(key), nil)
+			}
+		}
+		response = map[string]interface{}{"header": f.header()}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+func (f *fakeEtcdV3) header() map[string]string {
+	return map[string]string{"revision": strconv.FormatInt(f.revision, 10)}
+}
+
+func (f *fakeEtcdV3) put(key []byte, value []byte, lease int64) {
+	f.revision++
+	f.kvs[string(key)] = fakeEtcdV3KV{value: value, revision: f.revision, lease: lease}
+	f.notify(fakeEtcdV3Event{kind: "PUT", key: string(key), value: value, revision: f.revision})
+}
+
+func (f *fakeEtcdV3) notify(events ...fakeEtcdV3Event) {
+	f.events = append(f.events, events...)
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeEtcdV3) watch(w http.ResponseWriter, r *http.Request) {
+	var request v3WatchRequest
+	json.NewDecoder(r.Body).Decode(&request)
+	create := request.CreateRequest
+
+	f.mutex.Lock()
+	if create.StartRevision == 0 {
+		create.StartRevision = f.revision + 1
+	}
+	f.mutex.Unlock()
+
+	for {
+		f.mutex.Lock()
+		var events []map[string]interface{}
+		for _, event := range f.events {
+			if event.revision >= create.StartRevision && f.inRange(event.key, create.Key, create.RangeEnd) {
+				events = append(events, map[string]interface{}{"type": event.kind, "kv": map[string]interface{}{
+					"key":          []byte(event.key),
+					"value":        event.value,
+					"mod_revision": strconv.FormatInt(event.revision, 10),
+				}})
+			}
+		}
+		header := f.header()
+		changed := f.changed
+		f.mutex.Unlock()
+
+		if len(events) > 0 {
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{"header": header, "events": events}})
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (f *fakeEtcdV3) inRange(key string, start []byte, end []byte) bool {
+	if len(end) == 0 {
+		return key == string(start)
+	}
+
+	return key >= string(start) && key < string(end)
+}
+
+func (f *fakeEtcdV3) rangeKeys(start []byte, end []byte) map[string]interface{} {
+	var kvs []map[string]interface{}
+	for key, kv := range f.kvs {
+		if f.inRange(key, start, end) {
+			kvs = append(kvs, map[string]interface{}{
+				"key":          []byte(key),
+				"value":        kv.value,
+				"mod_revision": strconv.FormatInt(kv.revision, 10),
+			})
+		}
+	}
+
+	return map[string]interface{}{"header": f.header(), "kvs": kvs}
+}
+
+func (f *fakeEtcdV3) deleteRange(start []byte, end []byte) int {
+	var events []fakeEtcdV3Event
+	for key := range f.kvs {
+		if f.inRange(key, start, end) {
+			delete(f.kvs, key)
+			events = append(events, fakeEtcdV3Event{kind: "DELETE", key: key, revision: f.revision + 1})
+		}
+	}
+
+	if len(events) > 0 {
+		f.revision++
+		f.notify(events...)
+	}
+
+	return len(events)
+}
+
+func TestEtcdV3StoreLock(t *testing.T) {
+	server := newFakeEtcdV3()
+	defer server.Close()
+
+	s := NewEtcdV3Store([]string{server.URL}, nil)
+	node, err := s.Create("/base/master", "a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.Create("/base/master", "b", 0); err != ErrNodeExist {
+		t.Fatalf("Expected ErrNodeExist got %v", err)
+	}
+
+	if _, err = s.CompareAndSwap("/base/master", "b", 0, "b", 0); err != ErrCompareFailed {
+		t.Fatalf("Expected ErrCompareFailed got %v", err)
+	}
+
+	if _, err = s.CompareAndSwap("/base/master", "b", 0, "", node.ModifiedIndex); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.CompareAndSwap("/base/missing", "b", 0, "a", 0); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound got %v", err)
+	}
+
+	if err = s.CompareAndDelete("/base/master", "b", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.Get("/base/master"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound got %v", err)
+	}
+}
+
+func TestEtcdV3StoreDirectories(t *testing.T) {
+	server := newFakeEtcdV3()
+	defer server.Close()
+
+	s := NewEtcdV3Store([]string{server.URL}, nil)
+	s.Set("/base/announcements/a", "1", 30)
+	s.Set("/base/announcements/b", "2", 30)
+	s.Set("/base/announcements/nested/c", "3", 0)
+	if len(s.leases) != 1 {
+		t.Fatalf("Expected a single session lease got %v", s.leases)
+	}
+
+	nodes, err := s.GetDir("/base/announcements/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(nodes) != 2 {
+		t.Fatalf("Expected 2 nodes got %v", nodes)
+	}
+
+	if err = s.Delete("/base/announcements/", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.GetDir("/base/announcements/"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound got %v", err)
+	}
+}
+
+func TestEtcdV3StoreFencedCompareAndSwap(t *testing.T) {
+	server := newFakeEtcdV3()
+	defer server.Close()
+
+	testFencedStore(t, NewEtcdV3Store([]string{server.URL}, nil))
+}
+
+func TestEtcdV3StoreDroppedStates(t *testing.T) {
+	server := newFakeEtcdV3()
+	defer server.Close()
+
+	testDroppedStates(t, NewEtcdV3Store([]string{server.URL}, nil))
+}
+
+func TestEtcdV3StoreWatch(t *testing.T) {
+	server := newFakeEtcdV3()
+	defer server.Close()
+
+	s := NewEtcdV3Store([]string{server.URL}, nil)
+	node, err := s.Set("/base/other", "1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		event StoreEvent
+		err   error
+	}
+
+	results := make(chan result, 1)
+	stop := make(chan bool)
+	watch := func(waitIndex uint64) {
+		go func() {
+			event, err := s.Watch("/base/states", waitIndex, stop)
+			results <- result{event, err}
+		}()
+	}
+
+	watch(node.ModifiedIndex + 1)
+	if node, err = s.Set("/base/states/a", "2", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case r := <-results:
+		if r.err != nil || r.event.Action != StoreActionSet || r.event.Node.Key != "/base/states/a" || r.event.Node.ModifiedIndex != node.ModifiedIndex {
+			t.Fatalf("Expected the set to be watched got %v %v", r.event, r.err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the watch to see the set")
+	}
+
+	if err = s.Delete("/base/states/a", false); err != nil {
+		t.Fatal(err)
+	}
+
+	watch(node.ModifiedIndex + 1)
+	if r := <-results; r.err != nil || r.event.Action != StoreActionDelete {
+		t.Fatalf("Expected the delete to be watched got %v %v", r.event, r.err)
+	}
+
+	watch(0)
+	close(stop)
+	select {
+	case r := <-results:
+		if r.err != ErrWatchStopped {
+			t.Fatalf("Expected ErrWatchStopped got %v", r.err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the watch to stop")
+	}
+}
+
+func TestEtcdV3StoreFailsOverEndpoints(t *testing.T) {
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"etcdserver: no leader","message":"etcdserver: no leader","code":14}`, http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	server := newFakeEtcdV3()
+	defer server.Close()
+
+	s := NewEtcdV3Store([]string{unavailable.URL, server.URL}, nil)
+	if _, err := s.Set("/base/master", "a", 0); err != nil {
+		t.Fatalf("Expected the write to fail over to the next endpoint got %v", err)
+	}
+
+	if node, err := s.Get("/base/master"); err != nil || node.Value != "a" {
+		t.Fatalf("Expected the read to fail over to the next endpoint got %v %v", node, err)
+	}
+}
+
+func TestEtcdV3StoreClose(t *testing.T) {
+	server := newFakeEtcdV3()
+	defer server.Close()
+
+	s := NewEtcdV3Store([]string{server.URL}, nil)
+	s.Set("/base/announcements/a", "1", 30)
+	s.Set("/base/config", "2", 0)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get("/base/announcements/a"); err != ErrKeyNotFound {
+		t.Fatalf("Expected the session keys to be deleted got %v", err)
+	}
+
+	if _, err := s.Get("/base/config"); err != nil {
+		t.Fatalf("Expected keys without a TTL to be kept got %v", err)
+	}
+
+	if _, err := s.Set("/base/announcements/a", "1", 30); err != ErrStoreClosed {
+		t.Fatalf("Expected ErrStoreClosed got %v", err)
+	}
+}
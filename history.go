@@ -0,0 +1,136 @@
+package couchbasearray
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// HistoryLimit is how many transitions are kept beneath the history directory before the oldest are pruned
+var HistoryLimit = 1000
+
+// Transition records a change the scheduler made to a node's state
+type Transition struct {
+	SessionID       string         `json:"sessionID"`
+	IPAddress       string         `json:"ipAddress"`
+	OldState        SchedulerState `json:"oldState"`
+	NewState        SchedulerState `json:"newState"`
+	OldDesiredState SchedulerState `json:"oldDesiredState"`
+	NewDesiredState SchedulerState `json:"newDesiredState"`
+	Reason          string         `json:"reason"`
+	Scheduler       string         `json:"scheduler"`
+	Timestamp       int64          `json:"timestamp"`
+}
+
+// NewTransition creates a transition from the previous to the current state of a node
+func NewTransition(previous NodeState, current NodeState, reason string) Transition {
+	return Transition{
+		SessionID:       current.SessionID,
+		IPAddress:       current.IPAddress,
+		OldState:        previous.State,
+		NewState:        current.State,
+		OldDesiredState: previous.DesiredState,
+		NewDesiredState: current.DesiredState,
+		Reason:          reason,
+		Timestamp:       time.Now().UnixNano()}
+}
+
+func (t Transition) String() string {
+	return fmt.Sprintf("%s IP:%s, ID:%s, State:%s->%s, DesiredState:%s->%s, Reason:%s, Scheduler:%s",
+		time.Unix(0, t.Timestamp).UTC().Format(time.RFC3339Nano),
+		t.IPAddress,
+		t.SessionID,
+		t.OldState,
+		t.NewState,
+		t.OldDesiredState,
+		t.NewDesiredState,
+		t.Reason,
+		t.Scheduler)
+}
+
+// RecordTransitions writes transitions beneath base/history/ on behalf of scheduler and
+// prunes the oldest entries beyond HistoryLimit
+func RecordTransitions(base string, scheduler string, transitions []Transition) error {
+	if len(transitions) == 0 {
+		return nil
+	}
+
+	for _, transition := range transitions {
+		transition.Scheduler = scheduler
+		bytes, err := json.Marshal(transition)
+		if err != nil {
+			return err
+		}
+
+		key := fmt.Sprintf("%s/history/%020d-%s", base, transition.Timestamp, transition.SessionID)
+		if _, err = store.Set(key, string(bytes), 0); err != nil {
+			return err
+		}
+	}
+
+	return pruneHistory(base)
+}
+
+// GetHistory returns the recorded transitions beneath base, oldest first. A sessionID
+// other than empty only returns the transitions of that node.
+func GetHistory(base string, sessionID string) ([]Transition, error) {
+	nodes, err := store.GetDir(fmt.Sprintf("%s/history/", base))
+	if err == ErrKeyNotFound {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var transitions []Transition
+	for _, node := range nodes {
+		var transition Transition
+		if err = json.Unmarshal([]byte(node.Value), &transition); err != nil {
+			return nil, err
+		}
+
+		if sessionID == "" || transition.SessionID == sessionID {
+			transitions = append(transitions, transition)
+		}
+	}
+
+	sort.SliceStable(transitions, func(i, j int) bool {
+		return transitions[i].Timestamp < transitions[j].Timestamp
+	})
+
+	return transitions, nil
+}
+
+// ClearHistory removes every recorded transition beneath base
+func ClearHistory(base string) error {
+	err := store.Delete(fmt.Sprintf("%s/history/", base), true)
+	if err == ErrKeyNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// pruneHistory deletes the oldest transitions beyond HistoryLimit
+func pruneHistory(base string) error {
+	nodes, err := store.GetDir(fmt.Sprintf("%s/history/", base))
+	if err != nil || len(nodes) <= HistoryLimit {
+		return err
+	}
+
+	keys := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		keys = append(keys, node.Key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys[:len(keys)-HistoryLimit] {
+		if err = store.Delete(key, false); err != nil && err != ErrKeyNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package couchbasearray
+
+import "testing"
+
+func TestHistory(t *testing.T) {
+	defer func(limit int) { HistoryLimit = limit }(HistoryLimit)
+	HistoryLimit = 3
+
+	path := "/TestHistory"
+	if err := ClearHistory(path); err != nil {
+		t.Fatal(err)
+	}
+
+	states := map[string]NodeState{}
+	announcements := map[string]NodeState{
+		"a": {IPAddress: "10.100.2.1", SessionID: "a"},
+		"b": {IPAddress: "10.100.2.2", SessionID: "b"},
+	}
+
+	states, transitions := scheduleCore(announcements, states, PlacementPolicy{}, nil)
+	if len(transitions) != 2 {
+		t.Fatalf("Expected 2 transitions got %v", transitions)
+	}
+
+	if err := RecordTransitions(path, "scheduler-1", transitions); err != nil {
+		t.Fatal(err)
+	}
+
+	master := states["a"]
+	master.Master = true
+	states["a"] = master
+	announcements["a"] = NodeState{IPAddress: "10.100.2.1", SessionID: "a", State: SchedulerStateNew}
+	delete(announcements, "b")
+	states, transitions = scheduleCore(announcements, states, PlacementPolicy{}, nil)
+	if len(transitions) != 2 {
+		t.Fatalf("Expected 2 transitions got %v", transitions)
+	}
+
+	if err := RecordTransitions(path, "scheduler-2", transitions); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := GetHistory(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history) != HistoryLimit {
+		t.Fatalf("Expected history to be pruned to %d got %v", HistoryLimit, history)
+	}
+
+	history, err = GetHistory(path, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history) == 0 {
+		t.Fatal("Expected transitions for b")
+	}
+
+	last := history[len(history)-1]
+	if last.OldState != SchedulerStateNew || last.NewState != SchedulerStateDeleted || last.Reason != "announcement expired" || last.Scheduler != "scheduler-2" {
+		t.Fatalf("Unexpected transition %v", last)
+	}
+}
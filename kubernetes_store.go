@@ -0,0 +1,709 @@
+package couchbasearray
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	kubernetesManagedByLabel = "app.kubernetes.io/managed-by"
+	kubernetesManagedBy      = "couchbase-array"
+	kubernetesDirectoryLabel = "couchbase-array.io/directory"
+	kubernetesKeyAnnotation  = "couchbase-array.io/key"
+	kubernetesExpiresAnno    = "couchbase-array.io/expires"
+	kubernetesServiceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+	kubernetesMicroTime      = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// KubernetesStore is a Store backed by the Kubernetes API.
+// Every key is kept in its own ConfigMap so the ConfigMap resourceVersion acts as the
+// key's modified index; keys written with a TTL carry an expiry annotation and are
+// treated as missing (and garbage collected) once it has passed, which Watch reports
+// as an expiry.
+// The master lock is a coordination.k8s.io Lease.
+type KubernetesStore struct {
+	server    string
+	namespace string
+	token     string
+	client    *http.Client
+}
+
+// NewKubernetesStore creates a Store using the API server at server within namespace
+func NewKubernetesStore(server string, namespace string, token string, client *http.Client) *KubernetesStore {
+	if client == nil {
+		client = &http.Client{}
+	}
+
+	return &KubernetesStore{
+		server:    strings.TrimRight(server, "/"),
+		namespace: namespace,
+		token:     token,
+		client:    client,
+	}
+}
+
+// NewInClusterKubernetesStore creates a Store from the pod service account
+func NewInClusterKubernetesStore() (*KubernetesStore, error) {
+	host := os.Getenv("KUBERNETES_SERVICE_HOST")
+	port := os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+
+	token, err := ioutil.ReadFile(kubernetesServiceAccount + "/token")
+	if err != nil {
+		return nil, err
+	}
+
+	caCert, err := ioutil.ReadFile(kubernetesServiceAccount + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		ns, err := ioutil.ReadFile(kubernetesServiceAccount + "/namespace")
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caCert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	server := "https://" + host + ":" + port
+	return NewKubernetesStore(server, namespace, strings.TrimSpace(string(token)), client), nil
+}
+
+type kubernetesMetadata struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+type kubernetesConfigMap struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Metadata   kubernetesMetadata `json:"metadata"`
+	Data       map[string]string  `json:"data,omitempty"`
+}
+
+type kubernetesConfigMapList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []kubernetesConfigMap `json:"items"`
+}
+
+type kubernetesWatchEvent struct {
+	Type   string              `json:"type"`
+	Object kubernetesConfigMap `json:"object"`
+}
+
+type kubernetesLeaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity"`
+	LeaseDurationSeconds int64  `json:"leaseDurationSeconds"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int64  `json:"leaseTransitions"`
+}
+
+type kubernetesLease struct {
+	APIVersion string              `json:"apiVersion"`
+	Kind       string              `json:"kind"`
+	Metadata   kubernetesMetadata  `json:"metadata"`
+	Spec       kubernetesLeaseSpec `json:"spec"`
+}
+
+// kubernetesStatusError is returned when the API server answers with an unexpected status
+type kubernetesStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *kubernetesStatusError) Error() string {
+	return fmt.Sprintf("kubernetes: %d %s", e.StatusCode, e.Body)
+}
+
+// Get returns a single key
+func (s *KubernetesStore) Get(key string) (StoreNode, error) {
+	key = storeKey(key)
+	var configMap kubernetesConfigMap
+	if err := s.do("GET", s.configMapPath(kubernetesName(key)), nil, nil, &configMap); err != nil {
+		return StoreNode{}, err
+	}
+
+	if s.expired(configMap) {
+		return StoreNode{}, ErrKeyNotFound
+	}
+
+	return kubernetesStoreNode(configMap), nil
+}
+
+// GetDir returns the keys directly beneath dir
+func (s *KubernetesStore) GetDir(dir string) ([]StoreNode, error) {
+	selector := fmt.Sprintf("%s=%s,%s=%s", kubernetesManagedByLabel, kubernetesManagedBy, kubernetesDirectoryLabel, kubernetesHash(storeKey(dir)+"/"))
+	list, err := s.list(url.Values{"labelSelector": {selector}})
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []StoreNode
+	for _, configMap := range list.Items {
+		if s.expired(configMap) {
+			continue
+		}
+
+		nodes = append(nodes, kubernetesStoreNode(configMap))
+	}
+
+	if len(nodes) == 0 {
+		return nil, ErrKeyNotFound
+	}
+
+	return nodes, nil
+}
+
+// Set writes a key, expiring it after ttl seconds unless ttl is zero
+func (s *KubernetesStore) Set(key string, value string, ttl uint64) (StoreNode, error) {
+	key = storeKey(key)
+	configMap := kubernetesNewConfigMap(key, value, ttl)
+	var updated kubernetesConfigMap
+	err := s.do("PUT", s.configMapPath(configMap.Metadata.Name), nil, configMap, &updated)
+	if err == ErrKeyNotFound {
+		err = s.do("POST", s.configMapPath(""), nil, configMap, &updated)
+	}
+
+	if err != nil {
+		return StoreNode{}, err
+	}
+
+	return kubernetesStoreNode(updated), nil
+}
+
+// Create writes a key only if it does not already exist
+func (s *KubernetesStore) Create(key string, value string, ttl uint64) (StoreNode, error) {
+	key = storeKey(key)
+	// reading the key first garbage collects it when it has expired
+	if _, err := s.Get(key); err == nil {
+		return StoreNode{}, ErrNodeExist
+	}
+
+	configMap := kubernetesNewConfigMap(key, value, ttl)
+	var created kubernetesConfigMap
+	err := s.do("POST", s.configMapPath(""), nil, configMap, &created)
+	if serr, ok := err.(*kubernetesStatusError); ok && serr.StatusCode == http.StatusConflict {
+		return StoreNode{}, ErrNodeExist
+	}
+
+	if err != nil {
+		return StoreNode{}, err
+	}
+
+	return kubernetesStoreNode(created), nil
+}
+
+// CompareAndSwap writes a key only if its current value or resource version matches
+func (s *KubernetesStore) CompareAndSwap(key string, value string, ttl uint64, prevValue string, prevIndex uint64) (StoreNode, error) {
+	key = storeKey(key)
+	existing, err := s.compare(key, prevValue, prevIndex)
+	if err != nil {
+		return StoreNode{}, err
+	}
+
+	configMap := kubernetesNewConfigMap(key, value, ttl)
+	configMap.Metadata.ResourceVersion = existing.Metadata.ResourceVersion
+	var updated kubernetesConfigMap
+	err = s.do("PUT", s.configMapPath(configMap.Metadata.Name), nil, configMap, &updated)
+	if serr, ok := err.(*kubernetesStatusError); ok && serr.StatusCode == http.StatusConflict {
+		return StoreNode{}, ErrCompareFailed
+	}
+
+	if err != nil {
+		return StoreNode{}, err
+	}
+
+	return kubernetesStoreNode(updated), nil
+}
+
+// CompareAndDelete removes a key only if its current value or resource version matches
+func (s *KubernetesStore) CompareAndDelete(key string, prevValue string, prevIndex uint64) error {
+	key = storeKey(key)
+	existing, err := s.compare(key, prevValue, prevIndex)
+	if err != nil {
+		return err
+	}
+
+	return s.deleteConfigMap(existing)
+}
+
+// Delete removes a key, or every key beneath it when recursive is set
+func (s *KubernetesStore) Delete(key string, recursive bool) error {
+	key = storeKey(key)
+	err := s.do("DELETE", s.configMapPath(kubernetesName(key)), nil, nil, nil)
+	if !recursive || (err != nil && err != ErrKeyNotFound) {
+		return err
+	}
+
+	list, lerr := s.list(url.Values{"labelSelector": {kubernetesManagedByLabel + "=" + kubernetesManagedBy}})
+	if lerr != nil {
+		return lerr
+	}
+
+	for _, configMap := range list.Items {
+		if strings.HasPrefix(configMap.Metadata.Annotations[kubernetesKeyAnnotation], key+"/") {
+			if derr := s.do("DELETE", s.configMapPath(configMap.Metadata.Name), nil, nil, nil); derr != nil && derr != ErrKeyNotFound {
+				return derr
+			}
+			err = nil
+		}
+	}
+
+	return err
+}
+
+// Watch blocks until a key beneath prefix changes at or after waitIndex or stop is signalled.
+// The API server never expires keys, so the watch is also woken when the next key beneath
+// prefix reaches its TTL, which is deleted and reported with StoreActionExpire.
+func (s *KubernetesStore) Watch(prefix string, waitIndex uint64, stop chan bool) (StoreEvent, error) {
+	prefix = storeKey(prefix)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	selector := url.Values{"labelSelector": {kubernetesManagedByLabel + "=" + kubernetesManagedBy}}
+	var resourceVersion string
+	if waitIndex > 0 {
+		resourceVersion = strconv.FormatUint(waitIndex-1, 10)
+	}
+
+	for {
+		list, err := s.list(selector)
+		if err != nil {
+			return StoreEvent{}, err
+		}
+
+		if resourceVersion == "" {
+			resourceVersion = list.Metadata.ResourceVersion
+		}
+
+		var next time.Time
+		for _, configMap := range list.Items {
+			node := kubernetesStoreNode(configMap)
+			if node.Key != prefix && !strings.HasPrefix(node.Key, prefix+"/") {
+				continue
+			}
+
+			if s.expired(configMap) {
+				return StoreEvent{Action: StoreActionExpire, Node: node}, nil
+			}
+
+			if expires, ok := kubernetesExpires(configMap); ok && (next.IsZero() || expires.Before(next)) {
+				next = expires
+			}
+		}
+
+		watchCtx, watchCancel := ctx, context.CancelFunc(func() {})
+		if !next.IsZero() {
+			watchCtx, watchCancel = context.WithDeadline(ctx, next)
+		}
+
+		event, err := s.watch(watchCtx, prefix, selector.Get("labelSelector"), resourceVersion)
+		watchCancel()
+		if err == ErrWatchStopped && ctx.Err() == nil {
+			// a key is due to expire
+			continue
+		}
+
+		return event, err
+	}
+}
+
+// watch streams the changes to ConfigMaps after resourceVersion until one beneath prefix
+// changes, returning ErrWatchStopped once ctx is done
+func (s *KubernetesStore) watch(ctx context.Context, prefix string, selector string, resourceVersion string) (StoreEvent, error) {
+	query := url.Values{
+		"labelSelector":   {selector},
+		"watch":           {"1"},
+		"resourceVersion": {resourceVersion},
+	}
+
+	req, err := s.request("GET", s.configMapPath("")+"?"+query.Encode(), nil)
+	if err != nil {
+		return StoreEvent{}, err
+	}
+
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return StoreEvent{}, ErrWatchStopped
+		}
+		return StoreEvent{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return StoreEvent{}, &kubernetesStatusError{resp.StatusCode, string(body)}
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var event kubernetesWatchEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return StoreEvent{}, err
+		}
+
+		if event.Type == "ERROR" {
+			return StoreEvent{}, fmt.Errorf("kubernetes watch: %s", scanner.Text())
+		}
+
+		node := kubernetesStoreNode(event.Object)
+		if node.Key != prefix && !strings.HasPrefix(node.Key, prefix+"/") {
+			continue
+		}
+
+		if event.Type == "DELETED" {
+			return StoreEvent{Action: StoreActionDelete, Node: node}, nil
+		}
+
+		return StoreEvent{Action: StoreActionSet, Node: node}, nil
+	}
+
+	if ctx.Err() != nil {
+		return StoreEvent{}, ErrWatchStopped
+	}
+
+	if err := scanner.Err(); err != nil {
+		return StoreEvent{}, err
+	}
+
+	return StoreEvent{}, fmt.Errorf("kubernetes watch closed")
+}
+
+// AcquireLock takes or renews the Lease named after namespace for durationInSeconds,
+// returning the resource version of the Lease
+func (s *KubernetesStore) AcquireLock(identifier string, namespace string, durationInSeconds uint64) (uint64, error) {
+	name := kubernetesName(storeKey(namespace))
+	now := time.Now()
+	var lease kubernetesLease
+	var updated kubernetesLease
+	err := s.do("GET", s.leasePath(name), nil, nil, &lease)
+	if err == ErrKeyNotFound {
+		lease = kubernetesLease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   kubernetesMetadata{Name: name, Labels: map[string]string{kubernetesManagedByLabel: kubernetesManagedBy}},
+			Spec: kubernetesLeaseSpec{
+				HolderIdentity:       identifier,
+				LeaseDurationSeconds: int64(durationInSeconds),
+				AcquireTime:          now.UTC().Format(kubernetesMicroTime),
+				RenewTime:            now.UTC().Format(kubernetesMicroTime),
+			},
+		}
+
+		err = s.do("POST", s.leasePath(""), nil, lease, &updated)
+		if serr, ok := err.(*kubernetesStatusError); ok && serr.StatusCode == http.StatusConflict {
+			return 0, ErrLockInUse
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		return strconv.ParseUint(updated.Metadata.ResourceVersion, 10, 64)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if lease.Spec.HolderIdentity != identifier && lease.Spec.HolderIdentity != "" && !kubernetesLeaseExpired(lease, now) {
+		return 0, ErrLockInUse
+	}
+
+	if lease.Spec.HolderIdentity != identifier {
+		lease.Spec.HolderIdentity = identifier
+		lease.Spec.AcquireTime = now.UTC().Format(kubernetesMicroTime)
+		lease.Spec.LeaseTransitions++
+	}
+
+	lease.Spec.LeaseDurationSeconds = int64(durationInSeconds)
+	lease.Spec.RenewTime = now.UTC().Format(kubernetesMicroTime)
+	err = s.do("PUT", s.leasePath(name), nil, lease, &updated)
+	if serr, ok := err.(*kubernetesStatusError); ok && serr.StatusCode == http.StatusConflict {
+		return 0, ErrLockInUse
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(updated.Metadata.ResourceVersion, 10, 64)
+}
+
+// ReleaseLock clears the Lease holder if it is held by identifier
+func (s *KubernetesStore) ReleaseLock(identifier string, namespace string) error {
+	name := kubernetesName(storeKey(namespace))
+	var lease kubernetesLease
+	if err := s.do("GET", s.leasePath(name), nil, nil, &lease); err != nil {
+		return err
+	}
+
+	if lease.Spec.HolderIdentity != identifier {
+		return ErrLockInUse
+	}
+
+	lease.Spec.HolderIdentity = ""
+	lease.Spec.LeaseDurationSeconds = 1
+	err := s.do("PUT", s.leasePath(name), nil, lease, nil)
+	if serr, ok := err.(*kubernetesStatusError); ok && serr.StatusCode == http.StatusConflict {
+		return ErrLockInUse
+	}
+
+	return err
+}
+
+func (s *KubernetesStore) compare(key string, prevValue string, prevIndex uint64) (kubernetesConfigMap, error) {
+	if prevValue == "" && prevIndex == 0 {
+		return kubernetesConfigMap{}, fmt.Errorf("prevValue or prevIndex is required")
+	}
+
+	existing, err := s.getConfigMap(kubernetesName(key))
+	if err != nil {
+		return existing, err
+	}
+
+	if s.expired(existing) {
+		return existing, ErrKeyNotFound
+	}
+
+	node := kubernetesStoreNode(existing)
+	if prevValue != "" && node.Value != prevValue {
+		return existing, ErrCompareFailed
+	}
+
+	if prevIndex != 0 && node.ModifiedIndex != prevIndex {
+		return existing, ErrCompareFailed
+	}
+
+	return existing, nil
+}
+
+// expired reports whether a ConfigMap is past its TTL, deleting it when it is
+func (s *KubernetesStore) expired(configMap kubernetesConfigMap) bool {
+	expires, ok := kubernetesExpires(configMap)
+	if !ok || time.Now().Before(expires) {
+		return false
+	}
+
+	s.deleteConfigMap(configMap)
+	return true
+}
+
+func (s *KubernetesStore) deleteConfigMap(configMap kubernetesConfigMap) error {
+	options := map[string]interface{}{
+		"kind":          "DeleteOptions",
+		"apiVersion":    "v1",
+		"preconditions": map[string]string{"resourceVersion": configMap.Metadata.ResourceVersion},
+	}
+
+	err := s.do("DELETE", s.configMapPath(configMap.Metadata.Name), nil, options, nil)
+	if serr, ok := err.(*kubernetesStatusError); ok && serr.StatusCode == http.StatusConflict {
+		return ErrCompareFailed
+	}
+
+	return err
+}
+
+func (s *KubernetesStore) getConfigMap(name string) (kubernetesConfigMap, error) {
+	var configMap kubernetesConfigMap
+	err := s.do("GET", s.configMapPath(name), nil, nil, &configMap)
+	return configMap, err
+}
+
+func (s *KubernetesStore) list(query url.Values) (kubernetesConfigMapList, error) {
+	var list kubernetesConfigMapList
+	err := s.do("GET", s.configMapPath(""), query, nil, &list)
+	return list, err
+}
+
+func (s *KubernetesStore) configMapPath(name string) string {
+	path := fmt.Sprintf("/api/v1/namespaces/%s/configmaps", s.namespace)
+	if name != "" {
+		path += "/" + name
+	}
+
+	return path
+}
+
+func (s *KubernetesStore) leasePath(name string) string {
+	path := fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", s.namespace)
+	if name != "" {
+		path += "/" + name
+	}
+
+	return path
+}
+
+func (s *KubernetesStore) request(method string, path string, body interface{}) (*http.Request, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method, s.server+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	return req, nil
+}
+
+func (s *KubernetesStore) do(method string, path string, query url.Values, body interface{}, response interface{}) error {
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	req, err := s.request(method, path, body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrKeyNotFound
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &kubernetesStatusError{resp.StatusCode, string(data)}
+	}
+
+	if response == nil {
+		return nil
+	}
+
+	return json.Unmarshal(data, response)
+}
+
+func kubernetesNewConfigMap(key string, value string, ttl uint64) kubernetesConfigMap {
+	configMap := kubernetesConfigMap{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Metadata: kubernetesMetadata{
+			Name: kubernetesName(key),
+			Labels: map[string]string{
+				kubernetesManagedByLabel: kubernetesManagedBy,
+				kubernetesDirectoryLabel: kubernetesHash(key[:strings.LastIndex(key, "/")+1]),
+			},
+			Annotations: map[string]string{kubernetesKeyAnnotation: key},
+		},
+		Data: map[string]string{"value": value},
+	}
+
+	if ttl > 0 {
+		expires := time.Now().Add(time.Duration(ttl) * time.Second).UTC().Format(time.RFC3339Nano)
+		configMap.Metadata.Annotations[kubernetesExpiresAnno] = expires
+	}
+
+	return configMap
+}
+
+// kubernetesExpires returns when a ConfigMap written with a TTL expires
+func kubernetesExpires(configMap kubernetesConfigMap) (time.Time, bool) {
+	expires, ok := configMap.Metadata.Annotations[kubernetesExpiresAnno]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, expires)
+	return t, err == nil
+}
+
+func kubernetesStoreNode(configMap kubernetesConfigMap) StoreNode {
+	index, _ := strconv.ParseUint(configMap.Metadata.ResourceVersion, 10, 64)
+	return StoreNode{
+		Key:           configMap.Metadata.Annotations[kubernetesKeyAnnotation],
+		Value:         configMap.Data["value"],
+		ModifiedIndex: index,
+	}
+}
+
+func kubernetesLeaseExpired(lease kubernetesLease, now time.Time) bool {
+	renewed, err := time.Parse(kubernetesMicroTime, lease.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+
+	return now.After(renewed.Add(time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+// kubernetesName maps a store key to a valid Kubernetes object name
+func kubernetesName(key string) string {
+	var name []rune
+	for _, r := range strings.ToLower(strings.Trim(key, "/")) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			name = append(name, r)
+		} else {
+			name = append(name, '-')
+		}
+	}
+
+	slug := strings.Trim(string(name), "-")
+	if len(slug) > 200 {
+		slug = slug[len(slug)-200:]
+	}
+
+	return "cba-" + slug + "-" + kubernetesHash(key)
+}
+
+func kubernetesHash(value string) string {
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
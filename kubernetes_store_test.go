@@ -0,0 +1,278 @@
+package couchbasearray
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKubernetes is a minimal API server holding ConfigMaps and Leases. Watches never
+// see a change and end when they are cancelled.
+type fakeKubernetes struct {
+	mutex    sync.Mutex
+	revision int
+	objects  map[string]map[string]map[string]interface{}
+}
+
+func newFakeKubernetes() *httptest.Server {
+	return httptest.NewServer(&fakeKubernetes{objects: map[string]map[string]map[string]interface{}{
+		"configmaps": {},
+		"leases":     {},
+	}})
+}
+
+func (f *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("watch") != "" {
+		<-r.Context().Done()
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	sections := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var resource, name string
+	for i, section := range sections {
+		if section == "configmaps" || section == "leases" {
+			resource = section
+			if i+1 < len(sections) {
+				name = sections[i+1]
+			}
+		}
+	}
+
+	objects, ok := f.objects[resource]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	switch {
+	case r.Method == "GET" && name == "":
+		var items []interface{}
+		for _, object := range objects {
+			if f.matches(object, r.URL.Query().Get("labelSelector")) {
+				items = append(items, object)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"metadata": map[string]string{"resourceVersion": strconv.Itoa(f.revision)},
+			"items":    items,
+		})
+	case r.Method == "GET":
+		object, ok := objects[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(object)
+	case r.Method == "POST":
+		metadata := body["metadata"].(map[string]interface{})
+		name = metadata["name"].(string)
+		if _, ok := objects[name]; ok {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.store(objects, name, body)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(body)
+	case r.Method == "PUT":
+		existing, ok := objects[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		version, _ := body["metadata"].(map[string]interface{})["resourceVersion"].(string)
+		if version != "" && version != f.version(existing) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.store(objects, name, body)
+		json.NewEncoder(w).Encode(body)
+	case r.Method == "DELETE":
+		existing, ok := objects[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if preconditions, ok := body["preconditions"].(map[string]interface{}); ok {
+			if preconditions["resourceVersion"] != f.version(existing) {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+		}
+		delete(objects, name)
+		w.Write([]byte("{}"))
+	}
+}
+
+func (f *fakeKubernetes) store(objects map[string]map[string]interface{}, name string, object map[string]interface{}) {
+	f.revision++
+	object["metadata"].(map[string]interface{})["resourceVersion"] = strconv.Itoa(f.revision)
+	objects[name] = object
+}
+
+func (f *fakeKubernetes) version(object map[string]interface{}) string {
+	return object["metadata"].(map[string]interface{})["resourceVersion"].(string)
+}
+
+func (f *fakeKubernetes) matches(object map[string]interface{}, selector string) bool {
+	labels, _ := object["metadata"].(map[string]interface{})["labels"].(map[string]interface{})
+	for _, requirement := range strings.Split(selector, ",") {
+		pair := strings.SplitN(requirement, "=", 2)
+		if len(pair) == 2 && labels[pair[0]] != pair[1] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestKubernetesStoreStates(t *testing.T) {
+	server := newFakeKubernetes()
+	defer server.Close()
+
+	defer SetStore(GetStore())
+	SetStore(NewKubernetesStore(server.URL, "default", "", nil))
+
+	path := "/TestKubernetesStoreStates"
+	nodes, err := CreateTestNodes(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	announcements, err := GetClusterAnnouncements(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(announcements) != len(nodes) {
+		t.Fatalf("Expected %v announcements got %v", len(nodes), len(announcements))
+	}
+
+	currentStates, err := ScheduleTestPass(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	savedStates, err := GetClusterStates(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(savedStates) != len(currentStates) {
+		t.Fatalf("Expected %v states got %v", len(currentStates), len(savedStates))
+	}
+
+	if err = ClearClusterStates(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if savedStates, err = GetClusterStates(path); err != nil || len(savedStates) != 0 {
+		t.Fatalf("Expected no states got %v %v", savedStates, err)
+	}
+}
+
+func TestKubernetesStoreExpiry(t *testing.T) {
+	server := newFakeKubernetes()
+	defer server.Close()
+
+	s := NewKubernetesStore(server.URL, "default", "", nil)
+	if _, err := s.Set("/base/announcements/a", "1", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Create("/base/announcements/a", "2", 1); err != ErrNodeExist {
+		t.Fatalf("Expected ErrNodeExist got %v", err)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := s.Get("/base/announcements/a"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound got %v", err)
+	}
+
+	if _, err := s.Create("/base/announcements/a", "2", 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKubernetesStoreWatchExpiry(t *testing.T) {
+	server := newFakeKubernetes()
+	defer server.Close()
+
+	s := NewKubernetesStore(server.URL, "default", "", nil)
+	if _, err := s.Set("/base/announcements/a", "1", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan StoreEvent, 1)
+	go func() {
+		event, err := s.Watch("/base/announcements", 0, make(chan bool))
+		if err != nil {
+			t.Error(err)
+		}
+		events <- event
+	}()
+
+	select {
+	case event := <-events:
+		if event.Action != StoreActionExpire || event.Node.Key != "/base/announcements/a" {
+			t.Fatalf("Expected the announcement to expire got %v", event)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected the watch to report the expiry")
+	}
+
+	if _, err := s.Get("/base/announcements/a"); err != ErrKeyNotFound {
+		t.Fatalf("Expected the expired key to be deleted got %v", err)
+	}
+
+	stop := make(chan bool)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := s.Watch("/base/announcements", 0, stop)
+		errs <- err
+	}()
+
+	close(stop)
+	if err := <-errs; err != ErrWatchStopped {
+		t.Fatalf("Expected ErrWatchStopped got %v", err)
+	}
+}
+
+func TestKubernetesStoreLease(t *testing.T) {
+	server := newFakeKubernetes()
+	defer server.Close()
+
+	s := NewKubernetesStore(server.URL, "default", "", nil)
+	if _, err := s.AcquireLock("first", "/base/master", 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.AcquireLock("first", "/base/master", 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.AcquireLock("second", "/base/master", 5); err != ErrLockInUse {
+		t.Fatalf("Expected ErrLockInUse got %v", err)
+	}
+
+	if err := s.ReleaseLock("second", "/base/master"); err != ErrLockInUse {
+		t.Fatalf("Expected ErrLockInUse got %v", err)
+	}
+
+	if err := s.ReleaseLock("first", "/base/master"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.AcquireLock("second", "/base/master", 5); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,8 +3,6 @@ package couchbasearray
 import (
 	"errors"
 	"log"
-
-	"github.com/coreos/go-etcd/etcd"
 )
 
 const (
@@ -19,40 +17,56 @@ const (
 // ErrLockInUse is returned when a lock is in use
 var ErrLockInUse = errors.New("lock in use")
 
+// Locker is implemented by stores with a native lock primitive which replaces the
+// create and compare-and-swap lock used by AcquireLock and ReleaseLock.
+// AcquireLock returns the store index of the lock, see AcquireLockToken.
+type Locker interface {
+	AcquireLock(identifier string, namespace string, durationInSeconds uint64) (uint64, error)
+	ReleaseLock(identifier string, namespace string) error
+}
+
 // AcquireLock attempts to create a new lock. If the lock already exists it returns an error
 func AcquireLock(identifier string, namespace string, durationInSeconds uint64) error {
-	client := NewEtcdClient()
-	_, err := client.Create(namespace, identifier, durationInSeconds)
-	if err != nil {
-		eerr, ok := err.(*etcd.EtcdError)
-		if ok && eerr.ErrorCode == ErrorNodeExist {
+	_, err := AcquireLockToken(identifier, namespace, durationInSeconds)
+	return err
+}
 
-		} else {
-			log.Println(err)
-			return err
-		}
+// AcquireLockToken acquires or renews a lock like AcquireLock and returns the store index
+// at which the lock was written. The index only ever increases, so the index returned when
+// a holder first takes the lock can be used as a fencing token for its term.
+func AcquireLockToken(identifier string, namespace string, durationInSeconds uint64) (uint64, error) {
+	if locker, ok := store.(Locker); ok {
+		return locker.AcquireLock(identifier, namespace, durationInSeconds)
+	}
+
+	_, err := store.Create(namespace, identifier, durationInSeconds)
+	if err != nil && err != ErrNodeExist {
+		log.Println(err)
+		return 0, err
 	}
 
-	_, err = client.CompareAndSwap(namespace, identifier, durationInSeconds, identifier, 0)
+	node, err := store.CompareAndSwap(namespace, identifier, durationInSeconds, identifier, 0)
 	if err != nil {
-		eerr, ok := err.(*etcd.EtcdError)
-		if ok && eerr.ErrorCode == ErrorCompareFailed {
-			return ErrLockInUse
+		if err == ErrCompareFailed {
+			return 0, ErrLockInUse
 		}
 
 		log.Println(err)
-		return err
+		return 0, err
 	}
-	return err
+
+	return node.ModifiedIndex, nil
 }
 
 // ReleaseLock releases an existing lock
 func ReleaseLock(identifier string, namespace string) error {
+	if locker, ok := store.(Locker); ok {
+		return locker.ReleaseLock(identifier, namespace)
+	}
+
 	if err := AcquireLock(identifier, namespace, 10); err != nil {
 		return err
 	}
 
-	client := NewEtcdClient()
-	_, err := client.CompareAndDelete(namespace, identifier, 0)
-	return err
+	return store.CompareAndDelete(namespace, identifier, 0)
 }
@@ -0,0 +1,109 @@
+package couchbasearray
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Maintenance is an operator's request to leave a node alone while its host is patched.
+// A cordoned node is gracefully failed over and held out of the cluster, keeping its
+// state when it restarts, until it is uncordoned and recovered.
+type Maintenance struct {
+	IPAddress string `json:"ipAddress"`
+	Since     int64  `json:"since"`
+}
+
+// Cordon puts the node at ipAddress into maintenance
+func Cordon(base string, ipAddress string) error {
+	bytes, err := json.Marshal(Maintenance{IPAddress: ipAddress, Since: time.Now().UnixNano()})
+	if err != nil {
+		return err
+	}
+
+	_, err = store.Set(base+"/maintenance/"+ipAddress, string(bytes), 0)
+	return err
+}
+
+// Uncordon takes the node at ipAddress out of maintenance
+func Uncordon(base string, ipAddress string) error {
+	err := store.Delete(base+"/maintenance/"+ipAddress, false)
+	if err == ErrKeyNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// GetCordonedNodes returns the nodes in maintenance beneath base keyed by IP address
+func GetCordonedNodes(base string) (map[string]Maintenance, error) {
+	cordoned := make(map[string]Maintenance)
+	nodes, err := store.GetDir(base + "/maintenance/")
+	if err == ErrKeyNotFound {
+		return cordoned, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, node := range nodes {
+		var maintenance Maintenance
+		if err = json.Unmarshal([]byte(node.Value), &maintenance); err != nil {
+			return nil, err
+		}
+
+		cordoned[nodeKey(node.Key)] = maintenance
+	}
+
+	return cordoned, nil
+}
+
+// maintenanceState returns the state the scheduler drives a cordoned node in state s
+// towards. Cluster members are failed over and the others are held where they are.
+func maintenanceState(s SchedulerState) SchedulerState {
+	switch s {
+	case SchedulerStateAdding, SchedulerStateClustered:
+		return SchedulerStateFailingOver
+	case SchedulerStateFailingOver:
+		return SchedulerStateRemoved
+	}
+
+	return s
+}
+
+// resumeMaintenance moves the state of a cordoned node which restarted with a new session
+// to its new announcement once the old one has gone, instead of the node being announced
+// as new. It returns the announcements which wait for the old announcement to expire.
+func resumeMaintenance(announcements map[string]NodeState, currentStates map[string]NodeState, cordoned map[string]Maintenance) map[string]bool {
+	restarting := make(map[string]bool)
+	for key, announcement := range announcements {
+		if _, ok := currentStates[key]; ok {
+			continue
+		}
+
+		if _, ok := cordoned[announcement.IPAddress]; !ok {
+			continue
+		}
+
+		for previousKey, state := range currentStates {
+			if state.IPAddress != announcement.IPAddress || !state.Maintenance {
+				continue
+			}
+
+			restarting[key] = true
+			if _, ok := announcements[previousKey]; ok {
+				break
+			}
+
+			log.Printf("Resuming maintenance of node %s with session %s\n", announcement.IPAddress, announcement.SessionID)
+			delete(currentStates, previousKey)
+			state.SessionID = announcement.SessionID
+			state.ModifiedIndex = 0
+			currentStates[key] = state
+			break
+		}
+	}
+
+	return restarting
+}
@@ -0,0 +1,77 @@
+package couchbasearray
+
+import "testing"
+
+func TestScheduleCoreMaintenance(t *testing.T) {
+	cordoned := map[string]Maintenance{"10.100.2.2": {IPAddress: "10.100.2.2"}}
+	announcements := map[string]NodeState{
+		"a": {IPAddress: "10.100.2.1", SessionID: "a", State: SchedulerStateClustered},
+		"b": {IPAddress: "10.100.2.2", SessionID: "b", State: SchedulerStateClustered},
+	}
+	states := map[string]NodeState{
+		"a": {IPAddress: "10.100.2.1", SessionID: "a", Master: true, State: SchedulerStateClustered, DesiredState: SchedulerStateClustered},
+		"b": {IPAddress: "10.100.2.2", SessionID: "b", State: SchedulerStateClustered, DesiredState: SchedulerStateClustered},
+	}
+
+	states, transitions := scheduleCore(announcements, states, PlacementPolicy{}, cordoned)
+	if !states["b"].Maintenance || states["b"].DesiredState != SchedulerStateFailingOver {
+		t.Fatalf("Expected the cordoned node to be failed over got %v", states["b"])
+	}
+
+	if len(transitions) != 1 || transitions[0].Reason != "cordoned for maintenance" {
+		t.Fatalf("Expected the cordon to be recorded got %v", transitions)
+	}
+
+	announcements["b"] = NodeState{IPAddress: "10.100.2.2", SessionID: "b", State: SchedulerStateFailingOver}
+	if states, _ = scheduleCore(announcements, states, PlacementPolicy{}, cordoned); states["b"].DesiredState != SchedulerStateRemoved {
+		t.Fatalf("Expected the failed over node to be removed got %v", states["b"])
+	}
+
+	announcements["b"] = NodeState{IPAddress: "10.100.2.2", SessionID: "b", State: SchedulerStateRemoved}
+	states, _ = scheduleCore(announcements, states, PlacementPolicy{}, cordoned)
+	if states["b"].State != SchedulerStateRemoved || states["b"].DesiredState != SchedulerStateRemoved {
+		t.Fatalf("Expected the drained node to be held out of the cluster got %v", states["b"])
+	}
+
+	// the host goes down for patching and comes back with a new session
+	delete(announcements, "b")
+	if states, _ = scheduleCore(announcements, states, PlacementPolicy{}, cordoned); states["b"].State != SchedulerStateRemoved {
+		t.Fatalf("Expected the drained node to be kept while it is down got %v", states["b"])
+	}
+
+	announcements["c"] = NodeState{IPAddress: "10.100.2.2", SessionID: "c"}
+	states, _ = scheduleCore(announcements, states, PlacementPolicy{}, cordoned)
+	if _, ok := states["b"]; ok || states["c"].State != SchedulerStateRemoved || !states["c"].Maintenance {
+		t.Fatalf("Expected the restarted node to resume maintenance got %v", states)
+	}
+
+	announcements["c"] = NodeState{IPAddress: "10.100.2.2", SessionID: "c", State: SchedulerStateRemoved}
+	states, _ = scheduleCore(announcements, states, PlacementPolicy{}, nil)
+	if states["c"].Maintenance || states["c"].DesiredState != SchedulerStateAdding {
+		t.Fatalf("Expected the uncordoned node to be recovered got %v", states["c"])
+	}
+}
+
+func TestCordon(t *testing.T) {
+	base := "/services/couchbase-array-maintenance"
+	if err := Cordon(base, "10.100.2.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	cordoned, err := GetCordonedNodes(base)
+	if err != nil || len(cordoned) != 1 || cordoned["10.100.2.2"].Since == 0 {
+		t.Fatalf("Expected the node to be cordoned got %v %v", cordoned, err)
+	}
+
+	if err = Uncordon(base, "10.100.2.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if cordoned, err = GetCordonedNodes(base); err != nil || len(cordoned) != 0 {
+		t.Fatalf("Expected the node to be uncordoned got %v %v", cordoned, err)
+	}
+
+	if err = Uncordon(base, "10.100.2.2"); err != nil {
+		t.Fatalf("Expected uncordoning twice to succeed got %v", err)
+	}
+}
@@ -0,0 +1,274 @@
+package couchbasearray
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const memoryStoreHistory = 1000
+
+type memoryEntry struct {
+	node    StoreNode
+	expires time.Time
+}
+
+// MemoryStore is an in process Store used for testing and single node setups
+type MemoryStore struct {
+	mutex   sync.Mutex
+	index   uint64
+	entries map[string]memoryEntry
+	events  []StoreEvent
+	changed chan struct{}
+}
+
+// NewMemoryStore creates an empty in memory Store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries: make(map[string]memoryEntry),
+		changed: make(chan struct{}),
+	}
+}
+
+// Get returns a single key
+func (s *MemoryStore) Get(key string) (StoreNode, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expire()
+
+	entry, ok := s.entries[storeKey(key)]
+	if !ok {
+		return StoreNode{}, ErrKeyNotFound
+	}
+
+	return entry.node, nil
+}
+
+// GetDir returns the keys directly beneath dir
+func (s *MemoryStore) GetDir(dir string) ([]StoreNode, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expire()
+
+	prefix := storeKey(dir) + "/"
+	found := false
+	var nodes []StoreNode
+	for key, entry := range s.entries {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		found = true
+		if strings.Contains(key[len(prefix):], "/") {
+			continue
+		}
+
+		nodes = append(nodes, entry.node)
+	}
+
+	if !found {
+		return nil, ErrKeyNotFound
+	}
+
+	return nodes, nil
+}
+
+// Set writes a key, expiring it after ttl seconds unless ttl is zero
+func (s *MemoryStore) Set(key string, value string, ttl uint64) (StoreNode, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expire()
+
+	return s.write(storeKey(key), value, ttl), nil
+}
+
+// Create writes a key only if it does not already exist
+func (s *MemoryStore) Create(key string, value string, ttl uint64) (StoreNode, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expire()
+
+	key = storeKey(key)
+	if _, ok := s.entries[key]; ok {
+		return StoreNode{}, ErrNodeExist
+	}
+
+	return s.write(key, value, ttl), nil
+}
+
+// CompareAndSwap writes a key only if its current value or index matches
+func (s *MemoryStore) CompareAndSwap(key string, value string, ttl uint64, prevValue string, prevIndex uint64) (StoreNode, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expire()
+
+	key = storeKey(key)
+	if err := s.compare(key, prevValue, prevIndex); err != nil {
+		return StoreNode{}, err
+	}
+
+	return s.write(key, value, ttl), nil
+}
+
+// FencedCompareAndSwap writes a key only while fenceKey holds fenceValue, see FencedStore
+func (s *MemoryStore) FencedCompareAndSwap(fenceKey string, fenceValue string, key string, value string, ttl uint64, prevIndex uint64) (StoreNode, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expire()
+
+	if fence, ok := s.entries[storeKey(fenceKey)]; !ok || fence.node.Value != fenceValue {
+		return StoreNode{}, ErrStaleToken
+	}
+
+	key = storeKey(key)
+	if prevIndex == 0 {
+		if _, ok := s.entries[key]; ok {
+			return StoreNode{}, ErrNodeExist
+		}
+	} else if err := s.compare(key, "", prevIndex); err != nil {
+		return StoreNode{}, err
+	}
+
+	return s.write(key, value, ttl), nil
+}
+
+// CompareAndDelete removes a key only if its current value or index matches
+func (s *MemoryStore) CompareAndDelete(key string, prevValue string, prevIndex uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expire()
+
+	key = storeKey(key)
+	if err := s.compare(key, prevValue, prevIndex); err != nil {
+		return err
+	}
+
+	s.remove(key, StoreActionDelete)
+	return nil
+}
+
+// Delete removes a key, or a whole directory when recursive is set
+func (s *MemoryStore) Delete(key string, recursive bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expire()
+
+	key = storeKey(key)
+	if _, ok := s.entries[key]; ok {
+		s.remove(key, StoreActionDelete)
+		return nil
+	}
+
+	if !recursive {
+		return ErrKeyNotFound
+	}
+
+	found := false
+	for child := range s.entries {
+		if strings.HasPrefix(child, key+"/") {
+			s.remove(child, StoreActionDelete)
+			found = true
+		}
+	}
+
+	if !found {
+		return ErrKeyNotFound
+	}
+
+	return nil
+}
+
+// Watch blocks until a key beneath prefix changes at or after waitIndex or stop is signalled.
+// A zero waitIndex waits for the next change.
+func (s *MemoryStore) Watch(prefix string, waitIndex uint64, stop chan bool) (StoreEvent, error) {
+	prefix = storeKey(prefix)
+	if waitIndex == 0 {
+		s.mutex.Lock()
+		waitIndex = s.index + 1
+		s.mutex.Unlock()
+	}
+
+	for {
+		s.mutex.Lock()
+		s.expire()
+		for _, event := range s.events {
+			if event.Node.ModifiedIndex < waitIndex {
+				continue
+			}
+
+			if event.Node.Key == prefix || strings.HasPrefix(event.Node.Key, prefix+"/") {
+				s.mutex.Unlock()
+				return event, nil
+			}
+		}
+		changed := s.changed
+		s.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-time.After(100 * time.Millisecond):
+		case <-stop:
+			return StoreEvent{}, ErrWatchStopped
+		}
+	}
+}
+
+func (s *MemoryStore) compare(key string, prevValue string, prevIndex uint64) error {
+	if prevValue == "" && prevIndex == 0 {
+		return errors.New("prevValue or prevIndex is required")
+	}
+
+	entry, ok := s.entries[key]
+	if !ok {
+		return ErrKeyNotFound
+	}
+
+	if prevValue != "" && entry.node.Value != prevValue {
+		return ErrCompareFailed
+	}
+
+	if prevIndex != 0 && entry.node.ModifiedIndex != prevIndex {
+		return ErrCompareFailed
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) write(key string, value string, ttl uint64) StoreNode {
+	s.index++
+	entry := memoryEntry{node: StoreNode{Key: key, Value: value, ModifiedIndex: s.index}}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(time.Duration(ttl) * time.Second)
+	}
+
+	s.entries[key] = entry
+	s.notify(StoreEvent{Action: StoreActionSet, Node: entry.node})
+	return entry.node
+}
+
+func (s *MemoryStore) remove(key string, action string) {
+	entry := s.entries[key]
+	delete(s.entries, key)
+	s.index++
+	s.notify(StoreEvent{Action: action, Node: StoreNode{Key: key, Value: entry.node.Value, ModifiedIndex: s.index}})
+}
+
+func (s *MemoryStore) expire() {
+	now := time.Now()
+	for key, entry := range s.entries {
+		if !entry.expires.IsZero() && now.After(entry.expires) {
+			s.remove(key, StoreActionExpire)
+		}
+	}
+}
+
+func (s *MemoryStore) notify(event StoreEvent) {
+	s.events = append(s.events, event)
+	if len(s.events) > memoryStoreHistory {
+		s.events = s.events[len(s.events)-memoryStoreHistory:]
+	}
+
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
@@ -0,0 +1,88 @@
+package couchbasearray
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreCompareAndSwap(t *testing.T) {
+	s := NewMemoryStore()
+	node, err := s.Create("/lock", "a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.Create("/lock", "b", 0); err != ErrNodeExist {
+		t.Fatalf("Expected ErrNodeExist got %v", err)
+	}
+
+	if _, err = s.CompareAndSwap("/lock", "b", 0, "b", 0); err != ErrCompareFailed {
+		t.Fatalf("Expected ErrCompareFailed got %v", err)
+	}
+
+	if _, err = s.CompareAndSwap("/lock", "b", 0, "", node.ModifiedIndex); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.CompareAndDelete("/lock", "a", 0); err != ErrCompareFailed {
+		t.Fatalf("Expected ErrCompareFailed got %v", err)
+	}
+
+	if err = s.CompareAndDelete("/lock", "b", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.Get("/lock"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound got %v", err)
+	}
+}
+
+func TestMemoryStoreGetDir(t *testing.T) {
+	s := NewMemoryStore()
+	if _, err := s.GetDir("/base/states/"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound got %v", err)
+	}
+
+	s.Set("/base/states/a", "1", 0)
+	s.Set("/base/states/b", "2", 0)
+	s.Set("/base/states/nested/c", "3", 0)
+	nodes, err := s.GetDir("/base/states/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(nodes) != 2 {
+		t.Fatalf("Expected 2 nodes got %v", nodes)
+	}
+
+	if err = s.Delete("/base/states", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.GetDir("/base/states/"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound got %v", err)
+	}
+}
+
+func TestMemoryStoreWatchExpire(t *testing.T) {
+	s := NewMemoryStore()
+	node, err := s.Set("/base/announcements/a", "1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan bool)
+	go func() {
+		time.Sleep(5 * time.Second)
+		close(stop)
+	}()
+
+	event, err := s.Watch("/base/announcements", node.ModifiedIndex+1, stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if event.Action != StoreActionExpire || event.Node.Key != "/base/announcements/a" {
+		t.Fatalf("Unexpected event %v", event)
+	}
+}
@@ -0,0 +1,108 @@
+package couchbasearray
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// DefaultServices are the services run by a node which has not announced any
+var DefaultServices = []string{"kv", "index", "n1ql"}
+
+// PlacementPolicy places Couchbase services on nodes. Nodes are keyed by IP address and
+// otherwise run Default. Minimum is how many cluster members must run each service; new
+// and recovering nodes which run a service below its minimum are added first.
+type PlacementPolicy struct {
+	Default []string            `json:"default"`
+	Nodes   map[string][]string `json:"nodes"`
+	Minimum map[string]int      `json:"minimum"`
+}
+
+// ServicesFor returns the services the policy places on the node at ipAddress, which are
+// empty when the policy places none
+func (p PlacementPolicy) ServicesFor(ipAddress string) []string {
+	if services, ok := p.Nodes[ipAddress]; ok {
+		return services
+	}
+
+	return p.Default
+}
+
+// ServiceDeficits returns how many more cluster members each service below its minimum needs
+func (p PlacementPolicy) ServiceDeficits(states map[string]NodeState) map[string]int {
+	counts := make(map[string]int)
+	for _, state := range states {
+		if state.State != SchedulerStateAdding && state.State != SchedulerStateClustered {
+			continue
+		}
+
+		for _, service := range state.ServiceList() {
+			counts[service]++
+		}
+	}
+
+	deficits := make(map[string]int)
+	for service, minimum := range p.Minimum {
+		if counts[service] < minimum {
+			deficits[service] = minimum - counts[service]
+		}
+	}
+
+	return deficits
+}
+
+// ServiceList returns the services the node runs
+func (n NodeState) ServiceList() []string {
+	if len(n.Services) == 0 {
+		return DefaultServices
+	}
+
+	return n.Services
+}
+
+// RunsAny reports whether the node runs any of services
+func (n NodeState) RunsAny(services map[string]int) bool {
+	for _, service := range n.ServiceList() {
+		if _, ok := services[service]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetPlacementPolicy reads the placement policy beneath base, which is empty when none is set
+func GetPlacementPolicy(base string) (PlacementPolicy, error) {
+	var policy PlacementPolicy
+	node, err := store.Get(base + "/placement")
+	if err == ErrKeyNotFound {
+		return policy, nil
+	}
+
+	if err != nil {
+		return policy, err
+	}
+
+	err = json.Unmarshal([]byte(node.Value), &policy)
+	return policy, err
+}
+
+// SetPlacementPolicy writes the placement policy beneath base
+func SetPlacementPolicy(base string, policy PlacementPolicy) error {
+	bytes, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.Set(base+"/placement", string(bytes), 0)
+	return err
+}
+
+// deficitServices lists the services in deficits in a stable order
+func deficitServices(deficits map[string]int) []string {
+	services := make([]string, 0, len(deficits))
+	for service := range deficits {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	return services
+}
@@ -0,0 +1,69 @@
+package couchbasearray
+
+import "testing"
+
+func TestPlacementAddsDeficitServicesFirst(t *testing.T) {
+	policy := PlacementPolicy{Minimum: map[string]int{"fts": 1}}
+	announcements := map[string]NodeState{
+		"master": {IPAddress: "10.100.2.1", SessionID: "master", State: SchedulerStateClustered},
+		"kv":     {IPAddress: "10.100.2.2", SessionID: "kv", Services: []string{"kv"}, State: SchedulerStateNew},
+		"fts":    {IPAddress: "10.100.2.3", SessionID: "fts", Services: []string{"fts"}, State: SchedulerStateNew},
+	}
+	states := map[string]NodeState{
+		"master": {IPAddress: "10.100.2.1", SessionID: "master", Master: true, State: SchedulerStateClustered, DesiredState: SchedulerStateClustered},
+		"kv":     {IPAddress: "10.100.2.2", SessionID: "kv", State: SchedulerStateNew, DesiredState: SchedulerStateNew},
+		"fts":    {IPAddress: "10.100.2.3", SessionID: "fts", State: SchedulerStateNew, DesiredState: SchedulerStateNew},
+	}
+
+	states, transitions := scheduleCore(announcements, states, policy, nil)
+	if states["fts"].DesiredState != SchedulerStateAdding || states["kv"].DesiredState != SchedulerStateNew {
+		t.Fatalf("Expected only the fts node to be added got %v %v", states["fts"], states["kv"])
+	}
+
+	if len(transitions) != 1 || transitions[0].SessionID != "fts" {
+		t.Fatalf("Expected a single transition for the fts node got %v", transitions)
+	}
+
+	if states["fts"].ServiceList()[0] != "fts" || states["master"].ServiceList()[0] != "kv" {
+		t.Fatalf("Expected announced services to be kept got %v %v", states["fts"], states["master"])
+	}
+
+	fts := announcements["fts"]
+	fts.State = SchedulerStateAdding
+	announcements["fts"] = fts
+	states, _ = scheduleCore(announcements, states, policy, nil)
+	if states["kv"].DesiredState != SchedulerStateAdding {
+		t.Fatalf("Expected the kv node to be added once fts is met got %v", states["kv"])
+	}
+
+	if deficits := policy.ServiceDeficits(states); len(deficits) != 0 {
+		t.Fatalf("Expected no deficits got %v", deficits)
+	}
+}
+
+func TestPlacementPolicyStore(t *testing.T) {
+	base := "/services/couchbase-array-placement"
+	store.Delete(base+"/placement", false)
+
+	policy, err := GetPlacementPolicy(base)
+	if err != nil || policy.ServicesFor("10.100.2.1") != nil {
+		t.Fatalf("Expected an empty policy got %v %v", policy, err)
+	}
+
+	policy = PlacementPolicy{Default: []string{"kv"}, Nodes: map[string][]string{"10.100.2.2": {"index", "n1ql"}}}
+	if err = SetPlacementPolicy(base, policy); err != nil {
+		t.Fatal(err)
+	}
+
+	if policy, err = GetPlacementPolicy(base); err != nil {
+		t.Fatal(err)
+	}
+
+	if services := policy.ServicesFor("10.100.2.2"); len(services) != 2 || services[0] != "index" {
+		t.Fatalf("Expected the node placement got %v", services)
+	}
+
+	if services := policy.ServicesFor("10.100.2.1"); len(services) != 1 || services[0] != "kv" {
+		t.Fatalf("Expected the default placement got %v", services)
+	}
+}
@@ -1,43 +1,294 @@
 package couchbasearray
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
+	"os"
+	"reflect"
 	"time"
 )
 
-// StartScheduler starts a scheduling loop
-func StartScheduler(servicePath string, timeoutInSeconds int, stop <-chan bool, masterIPPath string) {
-	for {
-		currentStates, err := Schedule(servicePath)
-		if err != nil {
+// SchedulerConflictRetries is how many times a scheduling pass is attempted when the
+// cluster states change underneath it
+var SchedulerConflictRetries = 5
+
+// Reconciler converges part of the Couchbase cluster on behalf of the scheduler. It is
+// called after every scheduling pass which saved the cluster states, once the master is
+// adding or clustered, and may update states, returning a transition for every node it
+// moved. The updated states are saved once every reconciler has run.
+type Reconciler interface {
+	Reconcile(ctx context.Context, master NodeState, states map[string]NodeState) ([]Transition, error)
+}
+
+// ReconcilerFunc adapts a function to a Reconciler
+type ReconcilerFunc func(ctx context.Context, master NodeState, states map[string]NodeState) ([]Transition, error)
+
+// Reconcile calls f
+func (f ReconcilerFunc) Reconcile(ctx context.Context, master NodeState, states map[string]NodeState) ([]Transition, error) {
+	return f(ctx, master, states)
+}
+
+// StartScheduler starts a scheduling loop which runs whenever an announcement changes
+// and at least every timeoutInSeconds, running the reconcilers after every pass. The
+// loop exits once ctx is cancelled, clearing the master IP key it published. An error
+// ending the loop early is sent on the returned channel, which is closed when the
+// scheduler has exited. Transitions are recorded on behalf of the agent session sessionID.
+func StartScheduler(ctx context.Context, sessionID string, servicePath string, timeoutInSeconds int, masterIPPath string, reconcilers ...Reconciler) <-chan error {
+	s := &scheduler{
+		servicePath:  servicePath,
+		timeout:      timeoutInSeconds,
+		masterIPPath: masterIPPath,
+		identity:     schedulerIdentity(sessionID),
+		reconcilers:  reconcilers,
+	}
+	return s.start(ctx)
+}
+
+// ScheduleWhileLeading hooks the scheduler into an election. When the election starts
+// leading the fencing token is recorded and a scheduler is started for the term; the
+// scheduler is stopped, and waited for, when the election stops leading, and exits on
+// its own once a newer term has advanced the fence. The election resigns when the fence
+// cannot be advanced or the scheduler exits, so this process never leads without
+// scheduling.
+func ScheduleWhileLeading(election *LeaderElection, servicePath string, timeoutInSeconds int, masterIPPath string, reconcilers ...Reconciler) {
+	var cancel context.CancelFunc
+	var errs <-chan error
+
+	started := election.OnStartedLeading
+	election.OnStartedLeading = func(token uint64) {
+		if err := AdvanceFence(servicePath, token); err != nil {
 			log.Println(err)
+			election.Resign()
+			return
 		}
 
-		master, err := GetMasterNode(currentStates)
-		if err == nil {
-			ttl := time.Now().Add(time.Duration(timeoutInSeconds+3) * time.Second).UnixNano()
-			master.TTL = ttl
-			currentStates[master.SessionID] = master
-			etcdClient = NewEtcdClient()
-			if _, err = etcdClient.Set(masterIPPath, master.IPAddress, uint64(timeoutInSeconds)); err != nil {
-				log.Println(err)
-			}
+		s := &scheduler{
+			servicePath:  servicePath,
+			timeout:      timeoutInSeconds,
+			masterIPPath: masterIPPath,
+			identity:     schedulerIdentity(election.Identifier),
+			token:        token,
+			reconcilers:  reconcilers,
+			exited:       election.Resign,
+		}
+
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		errs = s.start(ctx)
+		if started != nil {
+			started(token)
 		}
+	}
 
-		if err == nil {
-			err = SaveClusterStates(servicePath, currentStates)
-			if err != nil {
+	stopped := election.OnStoppedLeading
+	election.OnStoppedLeading = func() {
+		if cancel != nil {
+			cancel()
+			for err := range errs {
 				log.Println(err)
 			}
+			cancel = nil
+		}
+
+		if stopped != nil {
+			stopped()
+		}
+	}
+}
+
+// schedulerIdentity names the scheduler of the agent session sessionID in the history
+// as the host it runs on and the session
+func schedulerIdentity(sessionID string) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Println(err)
+	}
+
+	return fmt.Sprintf("%s/%s", hostname, sessionID)
+}
+
+// scheduler schedules the cluster beneath servicePath. Every write is fenced with token
+// unless it is zero and transitions are recorded on behalf of identity.
+type scheduler struct {
+	servicePath  string
+	timeout      int
+	masterIPPath string
+	identity     string
+	token        uint64
+	reconcilers  []Reconciler
+	// exited is called when the loop exits before ctx is cancelled
+	exited func()
+
+	masterIP string
+}
+
+// start runs the scheduling loop in the background
+func (s *scheduler) start(ctx context.Context) <-chan error {
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		if err := s.run(ctx); err != nil {
+			errs <- err
+		}
+
+		if ctx.Err() == nil && s.exited != nil {
+			s.exited()
+		}
+	}()
+
+	return errs
+}
+
+// run runs the scheduling loop until ctx is cancelled or a newer term has advanced the fence
+func (s *scheduler) run(ctx context.Context) error {
+	stop := make(chan bool)
+	defer close(stop)
+	changes := WatchChanges(s.servicePath+"/announcements", SchedulerDebounce, stop)
+	defer s.handOff()
+
+	for {
+		err := s.schedule(ctx)
+		if err == ErrStaleToken {
+			log.Printf("Stopping scheduling for token %d: %v\n", s.token, err)
+			return err
+		}
+
+		if err != nil {
+			log.Println(err)
 		}
 
 		select {
-		case <-time.After(time.Duration(timeoutInSeconds) * time.Second):
-		case <-stop:
+		case <-time.After(time.Duration(s.timeout) * time.Second):
+		case <-changes:
+		case <-ctx.Done():
 			log.Println("Stopping scheduling")
+			return nil
+		}
+	}
+}
+
+// schedule checks the fence and runs a pass followed by the reconcilers. Errors other than
+// ErrStaleToken are retried on the next pass.
+func (s *scheduler) schedule(ctx context.Context) error {
+	if s.token != 0 {
+		if err := CheckFence(s.servicePath, s.token); err != nil {
+			return err
 		}
 	}
+
+	currentStates, err := s.pass()
+	for attempt := 1; err == ErrStateConflict && attempt < SchedulerConflictRetries; attempt++ {
+		log.Println(err)
+		currentStates, err = s.pass()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.reconcile(ctx, currentStates)
+	return nil
+}
+
+// handOff clears the master IP, unless a newer scheduler has replaced it
+func (s *scheduler) handOff() {
+	if s.masterIP == "" {
+		return
+	}
+
+	if err := store.CompareAndDelete(s.masterIPPath, s.masterIP, 0); err != nil && err != ErrKeyNotFound && err != ErrCompareFailed {
+		log.Println(err)
+	}
+}
+
+// pass schedules the cluster once, publishing the master IP, saving the states and
+// recording their transitions. It returns the saved states, which are empty when there
+// is no master yet.
+func (s *scheduler) pass() (map[string]NodeState, error) {
+	currentStates, transitions, err := schedule(s.servicePath)
+	if err != nil {
+		return nil, err
+	}
+
+	master, err := GetMasterNode(currentStates)
+	if err != nil {
+		return nil, nil
+	}
+
+	ttl := time.Now().Add(time.Duration(s.timeout+3) * time.Second).UnixNano()
+	master.TTL = ttl
+	currentStates[master.SessionID] = master
+	if _, err = store.Set(s.masterIPPath, master.IPAddress, uint64(s.timeout)); err != nil {
+		return nil, err
+	}
+	s.masterIP = master.IPAddress
+
+	if err = s.save(currentStates, transitions); err != nil {
+		return nil, err
+	}
+
+	return currentStates, nil
+}
+
+// save saves the states, fenced by the token, and records their transitions
+func (s *scheduler) save(currentStates map[string]NodeState, transitions []Transition) error {
+	var err error
+	if s.token == 0 {
+		err = SaveClusterStates(s.servicePath, currentStates)
+	} else {
+		err = SaveFencedClusterStates(s.servicePath, s.token, currentStates)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err = RecordTransitions(s.servicePath, s.identity, transitions); err != nil {
+		log.Println(err)
+	}
+
+	return nil
+}
+
+// reconcile runs the reconcilers against the saved states once the master has initialized
+// the cluster, saving the states they updated
+func (s *scheduler) reconcile(ctx context.Context, currentStates map[string]NodeState) {
+	master, err := GetMasterNode(currentStates)
+	if err != nil {
+		return
+	}
+
+	if master.State != SchedulerStateAdding && master.State != SchedulerStateClustered {
+		return
+	}
+
+	saved := make(map[string]NodeState, len(currentStates))
+	for key, state := range currentStates {
+		saved[key] = state
+	}
+
+	var transitions []Transition
+	for _, reconciler := range s.reconcilers {
+		if ctx.Err() != nil {
+			break
+		}
+
+		moved, err := reconciler.Reconcile(ctx, master, currentStates)
+		if err != nil {
+			log.Println(err)
+		}
+		transitions = append(transitions, moved...)
+	}
+
+	if reflect.DeepEqual(saved, currentStates) {
+		return
+	}
+
+	if err = s.save(currentStates, transitions); err != nil {
+		log.Println(err)
+	}
 }
 
 // GetMasterNode gets the master node
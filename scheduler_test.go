@@ -1,6 +1,7 @@
 package couchbasearray
 
 import (
+	"context"
 	"testing"
 	"time"
 )
@@ -12,3 +13,136 @@ func TestTTL(t *testing.T) {
 		t.Fatal("Unexpected compare")
 	}
 }
+
+func TestStartSchedulerStops(t *testing.T) {
+	defer SetStore(GetStore())
+	SetStore(NewMemoryStore())
+
+	path := "/TestStartSchedulerStops"
+	masterIPPath := path + "/masterip"
+	if _, err := CreateTestNodes(path, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := StartScheduler(ctx, "scheduler", path, 10, masterIPPath)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := store.Get(masterIPPath); err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the scheduler to publish a master IP")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err, ok := <-errs:
+		if ok {
+			t.Fatalf("Expected a clean exit got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the scheduler to exit")
+	}
+
+	if _, err := store.Get(masterIPPath); err != ErrKeyNotFound {
+		t.Fatalf("Expected the master IP to be cleared got %v", err)
+	}
+
+	transitions, err := GetHistory(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(transitions) != 2 || transitions[0].NewState != SchedulerStateNew || transitions[0].Scheduler != schedulerIdentity("scheduler") {
+		t.Fatalf("Expected the new nodes to be recorded got %v", transitions)
+	}
+}
+
+func TestSchedulerSavesReconciledStates(t *testing.T) {
+	defer SetStore(GetStore())
+	SetStore(NewMemoryStore())
+
+	path := "/TestSchedulerSavesReconciledStates"
+	nodes, err := CreateTestNodes(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reconciled := ReconcilerFunc(func(ctx context.Context, master NodeState, states map[string]NodeState) ([]Transition, error) {
+		if master.Error != "" {
+			return nil, nil
+		}
+
+		previous := master
+		master.Error = "reconciled"
+		states[master.SessionID] = master
+		return []Transition{NewTransition(previous, master, "reconciled")}, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := StartScheduler(ctx, "scheduler", path, 10, path+"/masterip", reconciled)
+
+	waitForMaster := func(expected func(NodeState) bool, message string) {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			states, err := GetClusterStates(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if master, err := GetMasterNode(states); err == nil && expected(master) {
+				return
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("%s got %v", message, states)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	waitForMaster(func(master NodeState) bool {
+		return master.State == SchedulerStateNew
+	}, "Expected the master to be scheduled")
+
+	time.Sleep(200 * time.Millisecond)
+	states, err := GetClusterStates(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if master, err := GetMasterNode(states); err != nil || master.Error != "" {
+		t.Fatalf("Expected the reconcilers to wait for the master to initialize the cluster got %v", states)
+	}
+
+	if err = AnnounceTestNodes(path, nodes, SchedulerStateAdding); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForMaster(func(master NodeState) bool {
+		return master.State == SchedulerStateAdding && master.Error == "reconciled"
+	}, "Expected the reconciled state to be saved")
+
+	cancel()
+	for range errs {
+	}
+
+	transitions, err := GetHistory(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorded := false
+	for _, transition := range transitions {
+		recorded = recorded || transition.Reason == "reconciled"
+	}
+
+	if !recorded {
+		t.Fatalf("Expected the reconciled transition to be recorded got %v", transitions)
+	}
+}
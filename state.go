@@ -0,0 +1,104 @@
+package couchbasearray
+
+import "errors"
+
+// SchedulerState is the lifecycle state of a node in the cluster
+type SchedulerState string
+
+const (
+	// SchedulerStateEmpty is announced by agents which have not been given a state yet
+	SchedulerStateEmpty SchedulerState = ""
+	// SchedulerStateNew is a node which has announced itself but is not part of the cluster
+	SchedulerStateNew SchedulerState = "new"
+	// SchedulerStateAdding is a node which has been added to the cluster and awaits a rebalance
+	SchedulerStateAdding SchedulerState = "adding"
+	// SchedulerStateClustered is a node which has been rebalanced into the cluster
+	SchedulerStateClustered SchedulerState = "clustered"
+	// SchedulerStateFailingOver is a node which is being failed over out of the cluster
+	SchedulerStateFailingOver SchedulerState = "failing-over"
+	// SchedulerStateRemoved is a node which has been failed over. A removed node which is
+	// still announcing is recovered back into the cluster.
+	SchedulerStateRemoved SchedulerState = "removed"
+	// SchedulerStateRelax is a node held where it is. The scheduler does not drive a relaxed
+	// node until it announces another state.
+	SchedulerStateRelax SchedulerState = "relax"
+	// SchedulerStateDeleted is a node whose announcement has gone. Its state is kept for one
+	// scheduling pass so watchers see the deletion and is then dropped.
+	SchedulerStateDeleted SchedulerState = "deleted"
+)
+
+// ErrInvalidTransition is returned when a node cannot move between two states
+var ErrInvalidTransition = errors.New("invalid state transition")
+
+var schedulerTransitions = map[SchedulerState][]SchedulerState{
+	SchedulerStateEmpty:       {SchedulerStateNew},
+	SchedulerStateNew:         {SchedulerStateAdding, SchedulerStateRelax, SchedulerStateDeleted},
+	SchedulerStateAdding:      {SchedulerStateClustered, SchedulerStateFailingOver, SchedulerStateRelax, SchedulerStateDeleted},
+	SchedulerStateClustered:   {SchedulerStateFailingOver, SchedulerStateRelax, SchedulerStateDeleted},
+	SchedulerStateFailingOver: {SchedulerStateRemoved, SchedulerStateDeleted},
+	SchedulerStateRemoved:     {SchedulerStateAdding, SchedulerStateDeleted},
+	SchedulerStateRelax:       {SchedulerStateNew, SchedulerStateAdding, SchedulerStateClustered, SchedulerStateFailingOver, SchedulerStateDeleted},
+	SchedulerStateDeleted:     {SchedulerStateNew},
+}
+
+// CanTransition reports whether a node in state s may move to state to
+func (s SchedulerState) CanTransition(to SchedulerState) bool {
+	if s == to {
+		return true
+	}
+
+	for _, allowed := range schedulerTransitions[s] {
+		if allowed == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidateTransition returns ErrInvalidTransition unless a node may move from one state to another
+func ValidateTransition(from SchedulerState, to SchedulerState) error {
+	if !from.CanTransition(to) {
+		return ErrInvalidTransition
+	}
+
+	return nil
+}
+
+// Next returns the state the scheduler drives a node towards once it has reached s
+func (s SchedulerState) Next() SchedulerState {
+	switch s {
+	case SchedulerStateEmpty:
+		return SchedulerStateNew
+	case SchedulerStateNew:
+		return SchedulerStateAdding
+	case SchedulerStateAdding:
+		return SchedulerStateClustered
+	case SchedulerStateFailingOver:
+		return SchedulerStateRemoved
+	case SchedulerStateRemoved:
+		return SchedulerStateAdding
+	}
+
+	return s
+}
+
+// CanBeMaster reports whether a node in state s may be selected as the master
+func (s SchedulerState) CanBeMaster() bool {
+	switch s {
+	case SchedulerStateNew, SchedulerStateAdding, SchedulerStateClustered, SchedulerStateRelax:
+		return true
+	}
+
+	return false
+}
+
+// IsMember reports whether a node in state s has joined the Couchbase cluster
+func (s SchedulerState) IsMember() bool {
+	switch s {
+	case SchedulerStateAdding, SchedulerStateClustered, SchedulerStateFailingOver, SchedulerStateRemoved:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,57 @@
+package couchbasearray
+
+import "testing"
+
+func TestStateTransitions(t *testing.T) {
+	lifecycle := []SchedulerState{
+		SchedulerStateEmpty,
+		SchedulerStateNew,
+		SchedulerStateAdding,
+		SchedulerStateClustered,
+		SchedulerStateFailingOver,
+		SchedulerStateRemoved,
+		SchedulerStateAdding,
+	}
+
+	for i := 1; i < len(lifecycle); i++ {
+		if err := ValidateTransition(lifecycle[i-1], lifecycle[i]); err != nil {
+			t.Fatalf("Expected %s to %s to be valid got %v", lifecycle[i-1], lifecycle[i], err)
+		}
+
+		if lifecycle[i-1].Next() != lifecycle[i] && lifecycle[i-1] != SchedulerStateClustered {
+			t.Fatalf("Expected %s to be followed by %s", lifecycle[i-1], lifecycle[i])
+		}
+	}
+
+	if err := ValidateTransition(SchedulerStateNew, SchedulerStateClustered); err != ErrInvalidTransition {
+		t.Fatalf("Expected ErrInvalidTransition got %v", err)
+	}
+
+	if err := ValidateTransition(SchedulerStateRemoved, SchedulerStateClustered); err != ErrInvalidTransition {
+		t.Fatalf("Expected ErrInvalidTransition got %v", err)
+	}
+}
+
+func TestScheduleCoreRelax(t *testing.T) {
+	announcement := NodeState{IPAddress: "10.100.2.1", SessionID: "a", State: SchedulerStateRelax}
+	states := map[string]NodeState{
+		"a": {IPAddress: "10.100.2.1", SessionID: "a", State: SchedulerStateClustered, DesiredState: SchedulerStateClustered},
+	}
+
+	states = ScheduleCore(map[string]NodeState{"a": announcement}, states)
+	if states["a"].State != SchedulerStateRelax || states["a"].DesiredState != SchedulerStateRelax {
+		t.Fatalf("Expected node to be held in relax got %v", states["a"])
+	}
+
+	announcement.State = SchedulerStateClustered
+	states = ScheduleCore(map[string]NodeState{"a": announcement}, states)
+	if states["a"].State != SchedulerStateClustered || states["a"].DesiredState != SchedulerStateClustered {
+		t.Fatalf("Expected node to return to clustered got %v", states["a"])
+	}
+
+	announcement.State = SchedulerStateNew
+	states = ScheduleCore(map[string]NodeState{"a": announcement}, states)
+	if states["a"].State != SchedulerStateClustered {
+		t.Fatalf("Expected invalid transition to be ignored got %v", states["a"])
+	}
+}
@@ -0,0 +1,96 @@
+package couchbasearray
+
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
+var (
+	// ErrKeyNotFound is returned by a Store when the requested key or directory does not exist
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrCompareFailed is returned by a Store when a compare-and-swap or compare-and-delete precondition fails
+	ErrCompareFailed = errors.New("compare failed")
+	// ErrNodeExist is returned by a Store when creating a key that already exists
+	ErrNodeExist = errors.New("key already exists")
+	// ErrWatchStopped is returned by a Store when a watch is cancelled through its stop channel
+	ErrWatchStopped = errors.New("watch stopped")
+	// ErrStoreClosed is returned by a Store writing a key with a TTL after its session was closed
+	ErrStoreClosed = errors.New("store closed")
+)
+
+const (
+	// StoreActionSet is the watch action reported when a key is created or updated
+	StoreActionSet = "set"
+	// StoreActionDelete is the watch action reported when a key is deleted
+	StoreActionDelete = "delete"
+	// StoreActionExpire is the watch action reported when a key reaches its TTL
+	StoreActionExpire = "expire"
+)
+
+// StoreNode is a single key/value pair held by a Store
+type StoreNode struct {
+	Key   string
+	Value string
+	// ModifiedIndex is the store revision at which the key was last written
+	ModifiedIndex uint64
+}
+
+// StoreEvent describes a change observed by Store.Watch
+type StoreEvent struct {
+	Action string
+	Node   StoreNode
+}
+
+// Store is the coordination service used to exchange node announcements, states and locks.
+// Keys are slash separated paths; a directory is the set of keys directly beneath a path.
+type Store interface {
+	// Get returns a single key
+	Get(key string) (StoreNode, error)
+	// GetDir returns the keys directly beneath dir
+	GetDir(dir string) ([]StoreNode, error)
+	// Set writes a key, expiring it after ttl seconds unless ttl is zero
+	Set(key string, value string, ttl uint64) (StoreNode, error)
+	// Create writes a key only if it does not already exist
+	Create(key string, value string, ttl uint64) (StoreNode, error)
+	// CompareAndSwap writes a key only if its current value or index matches
+	CompareAndSwap(key string, value string, ttl uint64, prevValue string, prevIndex uint64) (StoreNode, error)
+	// CompareAndDelete removes a key only if its current value or index matches
+	CompareAndDelete(key string, prevValue string, prevIndex uint64) error
+	// Delete removes a key, or a whole directory when recursive is set
+	Delete(key string, recursive bool) error
+	// Watch blocks until a key beneath prefix changes at or after waitIndex or stop is signalled
+	Watch(prefix string, waitIndex uint64, stop chan bool) (StoreEvent, error)
+}
+
+var store Store
+
+// SetStore replaces the coordination store used by the package
+func SetStore(s Store) {
+	store = s
+}
+
+// GetStore returns the coordination store used by the package
+func GetStore() Store {
+	return store
+}
+
+// CloseStore ends the session of stores which bind keys written with a TTL to one,
+// deleting those keys straight away instead of leaving them to expire
+func CloseStore() error {
+	if closer, ok := store.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// storeKey normalises a key to a leading slash and no trailing slash
+func storeKey(key string) string {
+	return "/" + strings.Trim(key, "/")
+}
+
+func nodeKey(key string) string {
+	sections := strings.Split(strings.TrimRight(key, "/"), "/")
+	return sections[len(sections)-1]
+}
@@ -0,0 +1,80 @@
+package couchbasearray
+
+import (
+	"log"
+	"time"
+)
+
+// SchedulerDebounce is how long the scheduler waits for further changes before scheduling
+var SchedulerDebounce = 250 * time.Millisecond
+
+// WatchChanges watches every key beneath prefix in the background and signals on the
+// returned channel debounce after the first of a burst of changes. Writes which do not
+// change a key's value, such as TTL refreshes, are ignored. The store is the one set when
+// the watch starts. Closing stop ends the watch, after which the returned channel is closed.
+func WatchChanges(prefix string, debounce time.Duration, stop chan bool) <-chan bool {
+	watched := store
+	events := make(chan bool)
+	changes := make(chan bool, 1)
+
+	go func() {
+		values := make(map[string]string)
+		var waitIndex uint64
+		for {
+			event, err := watched.Watch(prefix, waitIndex, stop)
+			if err == ErrWatchStopped {
+				close(events)
+				return
+			}
+
+			if err != nil {
+				log.Println(err)
+				waitIndex = 0
+				select {
+				case <-time.After(time.Second):
+				case <-stop:
+					close(events)
+					return
+				}
+				continue
+			}
+
+			waitIndex = event.Node.ModifiedIndex + 1
+			if event.Action == StoreActionSet {
+				if value, ok := values[event.Node.Key]; ok && value == event.Node.Value {
+					continue
+				}
+
+				values[event.Node.Key] = event.Node.Value
+			} else {
+				delete(values, event.Node.Key)
+			}
+
+			events <- true
+		}
+	}()
+
+	go func() {
+		defer close(changes)
+		var timer <-chan time.Time
+		for {
+			select {
+			case _, ok := <-events:
+				if !ok {
+					return
+				}
+				if timer == nil {
+					timer = time.After(debounce)
+				}
+			case <-timer:
+				timer = nil
+				select {
+				case changes <- true:
+				default:
+				}
+			}
+		}
+	}()
+
+	return changes
+}
@@ -0,0 +1,51 @@
+package couchbasearray
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatchChanges(t *testing.T) {
+	defer SetStore(GetStore())
+	SetStore(NewMemoryStore())
+
+	stop := make(chan bool)
+	changes := WatchChanges("/TestWatchChanges/announcements", 50*time.Millisecond, stop)
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		store.Set("/TestWatchChanges/announcements/a", "1", 0)
+		store.Set("/TestWatchChanges/announcements/b", string(rune('0'+i)), 0)
+	}
+
+	select {
+	case <-changes:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a change notification")
+	}
+
+	select {
+	case <-changes:
+		t.Fatal("Expected changes to be debounced into a single notification")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	store.Set("/TestWatchChanges/announcements/a", "1", 0)
+	select {
+	case <-changes:
+		t.Fatal("Expected an unchanged value to be ignored")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	store.Delete("/TestWatchChanges/announcements/a", false)
+	select {
+	case <-changes:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a change notification for a delete")
+	}
+
+	// the watch has to have stopped before the store is restored
+	close(stop)
+	for range changes {
+	}
+}